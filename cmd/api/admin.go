@@ -0,0 +1,394 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"fetch.trungnng.github.io/internal/abuse"
+	"fetch.trungnng.github.io/internal/audit"
+	"fetch.trungnng.github.io/internal/validator"
+	"fetch.trungnng.github.io/pkg/attestation"
+)
+
+// adminAbuseHandler lists the clients tracked by the abuse tracker along with their
+// current penalty and ban status.
+func (app *application) adminAbuseHandler(w http.ResponseWriter, r *http.Request) {
+	clients := []abuse.ClientStatus{}
+	if app.abuse != nil {
+		clients = app.abuse.Snapshot()
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminAuditHandler lists audit log entries. The optional "after" query parameter
+// returns only the entries with a higher sequence number, for incremental polling.
+func (app *application) adminAuditHandler(w http.ResponseWriter, r *http.Request) {
+	var after int64
+	if s := r.URL.Query().Get("after"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			app.badRequestResponse(w, r, "after must be a non-negative integer")
+			return
+		}
+		after = n
+	}
+
+	entries := []audit.Entry{}
+	for _, e := range app.model.Receipts.AuditLog.Entries() {
+		if e.Seq > after {
+			entries = append(entries, e)
+		}
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"entries": entries}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminAuditVerifyHandler verifies the audit log's hash chain and reports the first
+// broken link, if any.
+func (app *application) adminAuditVerifyHandler(w http.ResponseWriter, r *http.Request) {
+	env := envelope{"valid": true}
+
+	err := app.model.Receipts.AuditLog.Verify()
+	if err != nil {
+		var broken *audit.BrokenLinkError
+		if !errors.As(err, &broken) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		env["valid"] = false
+		env["first_broken_link"] = envelope{"seq": broken.Seq, "reason": broken.Reason}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminLogLevelHandler returns the current minimum log level.
+func (app *application) adminLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"level": app.logLevel.Level().String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminSetLogLevelHandler changes the minimum log level without a restart, for
+// example to turn on debug logging while investigating an incident. Like the other
+// admin changes it wins over the configured level on a config reload and is cleared
+// by a restart.
+func (app *application) adminSetLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	var level slog.Level
+	err = level.UnmarshalText([]byte(input.Level))
+	if err != nil {
+		app.badRequestResponse(w, r, "level must be debug, info, warn or error")
+		return
+	}
+
+	app.configMu.Lock()
+	previous := app.logLevel.Level()
+	app.overrides.logLevel = &level
+	app.overrides.apply(&app.config)
+	app.logLevel.Set(level)
+	app.configMu.Unlock()
+
+	app.logger.InfoContext(r.Context(), "log level changed", "from", previous.String(), "to", level.String(), "actor", app.actor(r))
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"level": level.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminModeHandler returns the service mode in effect.
+func (app *application) adminModeHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"service": app.modeEnvelope()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminSetModeHandler switches the service mode, for example to stop writes during a
+// store migration. Fields left out of the request keep their value. The change wins
+// over the configured mode on a config reload and is cleared by a restart.
+func (app *application) adminSetModeHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Mode       *string `json:"mode"`
+		Message    *string `json:"message"`
+		RetryAfter *string `json:"retry_after"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	var retryAfter time.Duration
+	v := validator.New()
+	if input.Mode != nil {
+		v.Check(validator.PermittedValue(*input.Mode, modeNormal, modeReadOnly, modeMaintenance), "mode", "must be one of normal, read-only or maintenance")
+	}
+	if input.RetryAfter != nil {
+		retryAfter, err = time.ParseDuration(*input.RetryAfter)
+		v.Check(err == nil && retryAfter > 0, "retry_after", "must be a positive duration, e.g. 30s")
+	}
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.configMu.Lock()
+	previous := app.config.service.mode
+	if input.Mode != nil {
+		app.overrides.mode = input.Mode
+	}
+	if input.Message != nil {
+		app.overrides.modeMessage = input.Message
+	}
+	if input.RetryAfter != nil {
+		app.overrides.modeRetryAfter = &retryAfter
+	}
+	app.overrides.apply(&app.config)
+	app.configMu.Unlock()
+
+	env := app.modeEnvelope()
+	app.logger.InfoContext(r.Context(), "service mode changed", "from", previous, "to", env["mode"], "actor", app.actor(r))
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"service": env}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminStatsHandler reports the size of the in-memory stores.
+func (app *application) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := envelope{
+		"receipts":        app.model.Receipts.Len(),
+		"audit_entries":   app.model.Receipts.AuditLog.Len(),
+		"limiter_clients": app.limiterClients.Load(),
+		"abuse_clients":   0,
+	}
+	if app.abuse != nil {
+		stats["abuse_clients"] = len(app.abuse.Snapshot())
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"stats": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// rulesEnvelope describes the scoring rule parameters and IP policies in effect.
+func (app *application) rulesEnvelope() envelope {
+	rules := app.currentConfig().rules
+
+	ipRules := envelope{}
+	if app.ipRules != nil {
+		for group, policy := range app.ipRules.Policies() {
+			list := make([]string, 0, len(policy.Rules))
+			for _, rule := range policy.Rules {
+				list = append(list, rule.String())
+			}
+			ipRules[group] = envelope{"default": policy.Default, "rules": list}
+		}
+	}
+
+	return envelope{
+		"ruleset_version":  app.rulesetVersion(),
+		"verified_bonus":   rules.verifiedBonus,
+		"require_verified": rules.requireVerified,
+		"ip_rules":         ipRules,
+	}
+}
+
+// adminRulesHandler shows the scoring rule parameters and IP policies in effect.
+func (app *application) adminRulesHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"rules": app.rulesEnvelope()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminUpdateRulesHandler changes the scoring rule parameters at runtime. Fields left
+// out of the request keep their value. The change outlasts config reloads and is
+// cleared by a restart.
+func (app *application) adminUpdateRulesHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		VerifiedBonus   *int64 `json:"verified_bonus"`
+		RequireVerified *bool  `json:"require_verified"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.VerifiedBonus == nil || *input.VerifiedBonus >= 0, "verified_bonus", "must not be negative")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.configMu.Lock()
+	if input.VerifiedBonus != nil {
+		app.overrides.verifiedBonus = input.VerifiedBonus
+	}
+	if input.RequireVerified != nil {
+		app.overrides.requireVerified = input.RequireVerified
+	}
+	app.overrides.apply(&app.config)
+	app.configMu.Unlock()
+
+	env := app.rulesEnvelope()
+	app.logger.InfoContext(r.Context(), "rules changed", "ruleset_version", env["ruleset_version"])
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"rules": env}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminKeysHandler lists the key IDs of the attestation keys, the retailer keys in
+// the trust store and the partners with a signing secret. Secrets are never returned.
+func (app *application) adminKeysHandler(w http.ResponseWriter, r *http.Request) {
+	attestationKeys := []string{}
+	if app.attestations != nil {
+		for _, key := range app.attestations.keySet().Keys {
+			attestationKeys = append(attestationKeys, key.KeyID)
+		}
+	}
+
+	trustKeys := make(map[string][]attestation.PublicKey)
+	if app.trustStore != nil {
+		for retailer, keys := range app.trustStore.Keys() {
+			for _, key := range keys {
+				trustKeys[retailer] = append(trustKeys[retailer], attestation.NewPublicKey(key))
+			}
+		}
+	}
+
+	signingKeys := []string{}
+	for keyID := range app.signingSecrets {
+		signingKeys = append(signingKeys, keyID)
+	}
+	sort.Strings(signingKeys)
+
+	env := envelope{
+		"attestation": attestationKeys,
+		"trust_store": trustKeys,
+		"signing":     signingKeys,
+	}
+
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"keys": env}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminRotateAttestationKeyHandler generates a new attestation key and makes it the
+// active one. The old keys stay published. The new key only lives in memory, so
+// configure it in -attest-key-files to keep it across restarts.
+func (app *application) adminRotateAttestationKeyHandler(w http.ResponseWriter, r *http.Request) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.attestations.rotate(key)
+
+	keyID := attestation.KeyID(key.Public().(ed25519.PublicKey))
+	app.logger.WarnContext(r.Context(), "rotated to an in-memory attestation key", "kid", keyID)
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"kid": keyID}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminAddTrustKeyHandler adds a retailer public key to the trust store. Like the
+// rotated attestation keys, the change is lost on restart unless the trust store file
+// is updated too.
+func (app *application) adminAddTrustKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Retailer  string `json:"retailer"`
+		PublicKey string `json:"public_key"`
+	}
+
+	err := app.readRequest(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err.Error())
+		return
+	}
+
+	key, err := base64.StdEncoding.DecodeString(input.PublicKey)
+
+	v := validator.New()
+	v.Check(input.Retailer != "", "retailer", "must be provided")
+	v.Check(err == nil && len(key) == ed25519.PublicKeySize, "public_key", "must be a base64-encoded Ed25519 public key")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	app.trustStore.Add(input.Retailer, ed25519.PublicKey(key))
+
+	keyID := attestation.KeyID(key)
+	app.logger.InfoContext(r.Context(), "added trust store key", "retailer", input.Retailer, "kid", keyID)
+
+	err = app.writeResponse(w, r, http.StatusCreated, envelope{"retailer": input.Retailer, "kid": keyID}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// adminRemoveTrustKeyHandler removes the retailer key given by the "retailer" and
+// "kid" query parameters from the trust store.
+func (app *application) adminRemoveTrustKeyHandler(w http.ResponseWriter, r *http.Request) {
+	retailer := r.URL.Query().Get("retailer")
+	keyID := r.URL.Query().Get("kid")
+
+	for _, key := range app.trustStore.Keys()[retailer] {
+		if attestation.KeyID(key) != keyID {
+			continue
+		}
+
+		app.trustStore.Remove(retailer, key)
+		app.logger.InfoContext(r.Context(), "removed trust store key", "retailer", retailer, "kid", keyID)
+
+		err := app.writeResponse(w, r, http.StatusOK, envelope{"message": "key removed"}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.notFoundResponse(w, r)
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/audit"
+	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/ipfilter"
+	"fetch.trungnng.github.io/internal/trust"
+	"fetch.trungnng.github.io/pkg/attestation"
+)
+
+// adminGet makes a GET request to an admin endpoint with the admin token.
+func (ts *testServer) adminGet(t *testing.T, urlPath, token string) (int, string) {
+	return ts.adminDo(t, http.MethodGet, urlPath, token, "")
+}
+
+// adminDo makes a request to an admin endpoint with the admin token and an optional
+// JSON body.
+func (ts *testServer) adminDo(t *testing.T, method, urlPath, token, body string) (int, string) {
+	req, err := http.NewRequest(method, ts.URL+urlPath, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	b, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return rs.StatusCode, strings.TrimSpace(string(b))
+}
+
+func TestAdminAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	auditLog, err := audit.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer auditLog.Close()
+
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+	app.model = data.NewModels()
+	app.model.Receipts.AuditLog = auditLog
+
+	receipt := app.model.Receipts.NewReceipt()
+	receipt.Retailer = "Target"
+
+	assert.NoError(t, app.model.Receipts.Insert(t.Context(), "ip:192.0.2.1", receipt))
+
+	updated := *receipt
+	updated.Retailer = "Walmart"
+	assert.NoError(t, app.model.Receipts.Update(t.Context(), "partner:partner-1", &updated))
+	assert.NoError(t, app.model.Receipts.Delete(t.Context(), "ip:192.0.2.1", receipt.ID, 0))
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	status, res := ts.adminGet(t, "/admin/audit?after=1", "secret")
+	assert.Equal(t, status, http.StatusOK)
+
+	var list struct {
+		Entries []audit.Entry `json:"entries"`
+	}
+	if err := json.Unmarshal([]byte(res), &list); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(list.Entries), 2)
+	assert.Equal(t, list.Entries[0].Action, audit.ActionUpdate)
+	assert.Equal(t, list.Entries[0].Actor, "partner:partner-1")
+	assert.Equal(t, list.Entries[1].Action, audit.ActionDelete)
+	assert.Equal(t, list.Entries[1].After, "")
+
+	status, res = ts.adminGet(t, "/admin/audit/verify", "secret")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, res, `{"valid":true}`)
+
+	// Rewrite who made the update directly in the file.
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b = []byte(strings.Replace(string(b), "partner:partner-1", "partner:partner-2", 1))
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	status, res = ts.adminGet(t, "/admin/audit/verify", "secret")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Contains(t, res, `"valid":false`)
+	assert.Contains(t, res, `"seq":2`)
+
+	status, _ = ts.adminGet(t, "/admin/audit/verify", "wrong")
+	assert.Equal(t, status, http.StatusUnauthorized)
+}
+
+func TestAdminLogLevel(t *testing.T) {
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	status, res := ts.adminGet(t, "/admin/log-level", "secret")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, res, `{"level":"INFO"}`)
+
+	put := func(body string) (int, string) {
+		req, err := http.NewRequest(http.MethodPut, ts.URL+"/admin/log-level", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		b, err := io.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.StatusCode, strings.TrimSpace(string(b))
+	}
+
+	status, res = put(`{"level":"debug"}`)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, res, `{"level":"DEBUG"}`)
+	assert.Equal(t, app.logLevel.Level(), slog.LevelDebug)
+
+	status, _ = put(`{"level":"loud"}`)
+	assert.Equal(t, status, http.StatusBadRequest)
+	assert.Equal(t, app.logLevel.Level(), slog.LevelDebug)
+
+	// The level set at runtime wins over the configured one on a reload.
+	app.configArgs = []string{"-admin-token", "secret", "-log-level", "warn"}
+
+	_, err := app.reloadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, app.logLevel.Level(), slog.LevelDebug)
+	assert.Equal(t, app.currentConfig().log.level, "debug")
+}
+
+func TestAdminTokens(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{"Missing name", `[{"token": "0123456789abcdef0123456789abcdef", "scopes": ["metrics"]}]`, "every token needs a name"},
+		{"Short token", `[{"name": "ci", "token": "short", "scopes": ["metrics"]}]`, "must be at least 32 characters long"},
+		{"Unknown scope", `[{"name": "ci", "token": "0123456789abcdef0123456789abcdef", "scopes": ["root"]}]`, `unknown scope "root"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(dir, "tokens.json")
+			os.WriteFile(path, []byte(tc.content), 0o600)
+
+			_, err := loadAdminTokens(path)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+
+	path := filepath.Join(dir, "tokens.json")
+	os.WriteFile(path, []byte(`[{"name": "ops", "token": "ops-token-0123456789abcdef0123456789", "scopes": ["rules", "store"]}]`), 0o600)
+
+	tokens, err := loadAdminTokens(path)
+	assert.NoError(t, err)
+
+	app := newTestApplication()
+	app.model = data.NewModels()
+	app.model.Receipts.AuditLog = audit.New()
+	app.adminTokens = tokens
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	status, _ := ts.adminGet(t, "/admin/stats", "ops-token-0123456789abcdef0123456789")
+	assert.Equal(t, status, http.StatusOK)
+
+	status, res := ts.adminGet(t, "/admin/keys", "ops-token-0123456789abcdef0123456789")
+	assert.Equal(t, status, http.StatusForbidden)
+	assert.Contains(t, res, `this token does not grant the \"keys\" scope`)
+}
+
+func TestAdminRules(t *testing.T) {
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+	app.ipRules = ipfilter.New(map[string]*ipfilter.Policy{
+		ipGroupReceiptsWrite: {
+			Default: ipfilter.Deny,
+			Rules:   []ipfilter.Rule{mustParseRule(t, "allow 10.0.0.0/8"), mustParseRule(t, "deny 192.0.2.1")},
+		},
+	})
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	status, res := ts.adminGet(t, "/admin/rules", "secret")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Contains(t, res, `"verified_bonus":0`)
+	assert.Contains(t, res, `"receipts.write":{"default":"deny","rules":["allow 10.0.0.0/8","deny 192.0.2.1"]}`)
+
+	version := app.rulesetVersion()
+
+	status, _ = ts.adminDo(t, http.MethodPut, "/admin/rules", "secret", `{"verified_bonus": -5}`)
+	assert.Equal(t, status, http.StatusUnprocessableEntity)
+
+	status, res = ts.adminDo(t, http.MethodPut, "/admin/rules", "secret", `{"verified_bonus": 25}`)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Contains(t, res, `"verified_bonus":25`)
+	assert.Contains(t, res, `"require_verified":false`)
+	assert.Equal(t, app.currentConfig().rules.verifiedBonus, 25)
+	assert.Equal(t, app.rulesetVersion() != version, true)
+}
+
+func TestAdminMode(t *testing.T) {
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+	app.config.service.mode = modeNormal
+	app.config.service.retryAfter = time.Minute
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	status, res := ts.adminGet(t, "/admin/mode", "secret")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Contains(t, res, `"mode":"normal"`)
+
+	status, res = ts.adminDo(t, http.MethodPut, "/admin/mode", "secret", `{"mode": "off", "retry_after": "-1s"}`)
+	assert.Equal(t, status, http.StatusUnprocessableEntity)
+	assert.Contains(t, res, `"mode":"must be one of normal, read-only or maintenance"`)
+	assert.Contains(t, res, `"retry_after":"must be a positive duration, e.g. 30s"`)
+
+	status, res = ts.adminDo(t, http.MethodPut, "/admin/mode", "secret", `{"mode": "read-only", "message": "store migration"}`)
+	assert.Equal(t, status, http.StatusOK)
+	assert.Contains(t, res, `"mode":"read-only"`)
+	assert.Contains(t, res, `"retry_after":"1m0s"`)
+	assert.Equal(t, app.currentConfig().service.mode, modeReadOnly)
+	assert.Equal(t, app.currentConfig().service.message, "store migration")
+
+	// The mode set at runtime wins over the configured one on a reload.
+	app.configArgs = []string{"-admin-token", "secret", "-mode", "maintenance", "-mode-retry-after", "2m"}
+
+	_, err := app.reloadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, app.currentConfig().service.mode, modeReadOnly)
+	assert.Equal(t, app.currentConfig().service.message, "store migration")
+	assert.Equal(t, app.currentConfig().service.retryAfter, 2*time.Minute)
+}
+
+func mustParseRule(t *testing.T, s string) ipfilter.Rule {
+	t.Helper()
+
+	rule, err := ipfilter.ParseRule(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rule
+}
+
+func TestAdminKeys(t *testing.T) {
+	_, attestKey, _ := ed25519.GenerateKey(nil)
+	retailerKey, _, _ := ed25519.GenerateKey(nil)
+
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+	app.trustStore = trust.New()
+	app.signingSecrets = map[string][]byte{"partner-2": nil, "partner-1": nil}
+
+	var err error
+	app.attestations, err = newAttestationSigner(attestKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	status, res := ts.adminDo(t, http.MethodPost, "/admin/keys/trust", "secret", `{"retailer": "Target", "public_key": "bm90IGEga2V5"}`)
+	assert.Equal(t, status, http.StatusUnprocessableEntity)
+	assert.Contains(t, res, "must be a base64-encoded Ed25519 public key")
+
+	body := fmt.Sprintf(`{"retailer": "Target", "public_key": %q}`, base64.StdEncoding.EncodeToString(retailerKey))
+	status, _ = ts.adminDo(t, http.MethodPost, "/admin/keys/trust", "secret", body)
+	assert.Equal(t, status, http.StatusCreated)
+	assert.Equal(t, app.trustStore.Retailers(), 1)
+
+	status, res = ts.adminDo(t, http.MethodPost, "/admin/keys/attestation/rotate", "secret", "")
+	assert.Equal(t, status, http.StatusCreated)
+
+	var rotated struct {
+		KeyID string `json:"kid"`
+	}
+	if err := json.Unmarshal([]byte(res), &rotated); err != nil {
+		t.Fatal(err)
+	}
+
+	var keys struct {
+		Keys struct {
+			Attestation []string                           `json:"attestation"`
+			TrustStore  map[string][]attestation.PublicKey `json:"trust_store"`
+			Signing     []string                           `json:"signing"`
+		} `json:"keys"`
+	}
+	status, res = ts.adminGet(t, "/admin/keys", "secret")
+	assert.Equal(t, status, http.StatusOK)
+	if err := json.Unmarshal([]byte(res), &keys); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is active and the old one is still published.
+	assert.Equal(t, strings.Join(keys.Keys.Attestation, ","), rotated.KeyID+","+attestation.KeyID(attestKey.Public().(ed25519.PublicKey)))
+	assert.Equal(t, strings.Join(keys.Keys.Signing, ","), "partner-1,partner-2")
+	assert.Equal(t, keys.Keys.TrustStore["Target"][0].KeyID, attestation.KeyID(retailerKey))
+
+	status, _ = ts.adminDo(t, http.MethodDelete, "/admin/keys/trust?retailer=Target&kid=nope", "secret", "")
+	assert.Equal(t, status, http.StatusNotFound)
+
+	status, _ = ts.adminDo(t, http.MethodDelete, "/admin/keys/trust?retailer=Target&kid="+attestation.KeyID(retailerKey), "secret", "")
+	assert.Equal(t, status, http.StatusOK)
+	assert.Equal(t, app.trustStore.Retailers(), 0)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/pkg/attestation"
+)
+
+// attestationSigner holds the Ed25519 keys used to sign points attestations. The
+// active key signs new attestations. Every key, including retired ones, is published
+// so partners can still verify attestations signed before a rotation.
+type attestationSigner struct {
+	mu     sync.RWMutex
+	active ed25519.PrivateKey
+	keys   []ed25519.PublicKey
+}
+
+// newAttestationSigner returns a signer which signs with the first key and publishes
+// all of them.
+func newAttestationSigner(keys ...ed25519.PrivateKey) (*attestationSigner, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("at least one attestation key is required")
+	}
+
+	s := &attestationSigner{active: keys[0]}
+	for _, key := range keys {
+		public := key.Public().(ed25519.PublicKey)
+		if !s.published(attestation.KeyID(public)) {
+			s.keys = append(s.keys, public)
+		}
+	}
+
+	return s, nil
+}
+
+// published reports whether a key with the given key ID is in the key set.
+func (s *attestationSigner) published(keyID string) bool {
+	for _, key := range s.keys {
+		if attestation.KeyID(key) == keyID {
+			return true
+		}
+	}
+	return false
+}
+
+// loadAttestationKeys reads PKCS #8 PEM-encoded Ed25519 private keys, such as those
+// created by "openssl genpkey -algorithm ed25519". The first file is the active key.
+func loadAttestationKeys(files []string) ([]ed25519.PrivateKey, error) {
+	var keys []ed25519.PrivateKey
+
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		block, _ := pem.Decode(b)
+		if block == nil || block.Type != "PRIVATE KEY" {
+			return nil, fmt.Errorf("%s: expected a PEM-encoded PRIVATE KEY", file)
+		}
+
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+
+		edKey, ok := key.(ed25519.PrivateKey)
+		if !ok {
+			return nil, fmt.Errorf("%s: not an Ed25519 key", file)
+		}
+
+		keys = append(keys, edKey)
+	}
+
+	return keys, nil
+}
+
+// sign signs the statement with the active key.
+func (s *attestationSigner) sign(statement attestation.Statement) (attestation.Attestation, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return attestation.Sign(s.active, statement)
+}
+
+// rotate makes key the active signing key. The previous keys stay published. A key
+// that is already published, such as one rotated back to, moves to the front rather
+// than being listed twice.
+func (s *attestationSigner) rotate(key ed25519.PrivateKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	public := key.Public().(ed25519.PublicKey)
+	keyID := attestation.KeyID(public)
+
+	keys := []ed25519.PublicKey{public}
+	for _, k := range s.keys {
+		if attestation.KeyID(k) != keyID {
+			keys = append(keys, k)
+		}
+	}
+
+	s.active = key
+	s.keys = keys
+}
+
+// keySet returns the published keys, active key first.
+func (s *attestationSigner) keySet() attestation.KeySet {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	set := attestation.KeySet{Keys: []attestation.PublicKey{}}
+	for _, key := range s.keys {
+		set.Keys = append(set.Keys, attestation.NewPublicKey(key))
+	}
+
+	return set
+}
+
+// attestPoints builds and signs an attestation for the points awarded to a receipt.
+func (app *application) attestPoints(receipt *data.Receipt, points int64) (attestation.Attestation, error) {
+	canonical, err := receipt.CanonicalJSON()
+	if err != nil {
+		return attestation.Attestation{}, err
+	}
+
+	return app.attestations.sign(attestation.Statement{
+		ReceiptID:      receipt.ID,
+		ContentHash:    attestation.ContentHash(canonical),
+		Points:         points,
+		RulesetVersion: app.rulesetVersion(),
+		IssuedAt:       time.Now().UTC().Truncate(time.Second),
+	})
+}
+
+// attestationKeysHandler publishes the attestation public keys so partners can verify
+// attestations offline.
+func (app *application) attestationKeysHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"keys": app.attestations.keySet().Keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// splitList splits a comma-separated flag value, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
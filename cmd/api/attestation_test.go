@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/pkg/attestation"
+)
+
+func TestAttestationSignerRotate(t *testing.T) {
+	keyIDs := func(s *attestationSigner) string {
+		var ids []string
+		for _, key := range s.keySet().Keys {
+			ids = append(ids, key.KeyID)
+		}
+		return strings.Join(ids, ",")
+	}
+
+	var keys []ed25519.PrivateKey
+	var ids []string
+	for range 3 {
+		_, key, err := ed25519.GenerateKey(nil)
+		assert.NoError(t, err)
+		keys = append(keys, key)
+		ids = append(ids, attestation.KeyID(key.Public().(ed25519.PublicKey)))
+	}
+
+	// A key configured twice is published once.
+	s, err := newAttestationSigner(keys[0], keys[1], keys[0])
+	assert.NoError(t, err)
+	assert.Equal(t, keyIDs(s), ids[0]+","+ids[1])
+
+	s.rotate(keys[2])
+	assert.Equal(t, keyIDs(s), ids[2]+","+ids[0]+","+ids[1])
+
+	// Rotating back to a published key moves it to the front.
+	s.rotate(keys[1])
+	assert.Equal(t, keyIDs(s), ids[1]+","+ids[2]+","+ids[0])
+
+	att, err := s.sign(attestation.Statement{ReceiptID: "r1"})
+	assert.NoError(t, err)
+	assert.Equal(t, att.KeyID, ids[1])
+
+	_, err = newAttestationSigner()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
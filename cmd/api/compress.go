@@ -0,0 +1,204 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// negotiateEncoding picks the response encoding from an Accept-Encoding header: gzip
+// or deflate, whichever the client prefers, with gzip winning ties. It returns "" if
+// the client accepts neither.
+func negotiateEncoding(acceptEncoding string) string {
+	q := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+
+		weight := 1.0
+		if name, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(name) == "q" {
+			f, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+			if err != nil {
+				continue
+			}
+			weight = f
+		}
+		q[coding] = weight
+	}
+
+	// "*" covers the codings the header doesn't name.
+	for _, coding := range []string{"gzip", "deflate"} {
+		if _, ok := q[coding]; !ok {
+			if weight, ok := q["*"]; ok {
+				q[coding] = weight
+			}
+		}
+	}
+
+	switch {
+	case q["gzip"] > 0 && q["gzip"] >= q["deflate"]:
+		return "gzip"
+	case q["deflate"] > 0:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressible reports whether a response of the given content type is worth
+// compressing. Binary formats such as pprof profiles are usually compressed already.
+func compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+
+	return strings.HasPrefix(mediaType, "text/") ||
+		mediaType == "application/json" ||
+		mediaType == "application/xml" ||
+		mediaType == "application/msgpack" ||
+		strings.HasSuffix(mediaType, "+json") ||
+		strings.HasSuffix(mediaType, "+xml")
+}
+
+// compress is a middleware which compresses responses with gzip or deflate, as
+// negotiated with the Accept-Encoding header. Responses smaller than the minimum size
+// aren't worth the overhead and are sent as they are, so the response is buffered
+// until it reaches that size or the handler returns.
+func (app *application) compress(next http.Handler) http.Handler {
+	if !app.config.compression.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: app.config.compression.minSize, status: http.StatusOK}
+		defer cw.close()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// compressWriter holds back the status and body of a response until it knows whether
+// to compress it.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding    string
+	minSize     int
+	buf         []byte
+	status      int
+	wroteHeader bool
+	started     bool
+	zw          io.WriteCloser // nil if the response isn't compressed
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.started {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+
+	if !cw.started {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+
+		err := cw.start(true)
+		return len(b), err
+	}
+
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// start sends the status and the buffered body, compressed if compress is true and
+// the response is suitable.
+func (cw *compressWriter) start(compress bool) error {
+	cw.started = true
+
+	h := cw.Header()
+	if compress && h.Get("Content-Encoding") == "" && compressible(h.Get("Content-Type")) &&
+		cw.status != http.StatusNoContent && cw.status != http.StatusNotModified {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+
+		// A strong ETag names exact bytes, so the compressed body gets its own tag.
+		if etag := h.Get("ETag"); strings.HasPrefix(etag, `"`) && strings.HasSuffix(etag, `"`) {
+			h.Set("ETag", strings.TrimSuffix(etag, `"`)+"-"+cw.encoding+`"`)
+		}
+
+		if cw.encoding == "gzip" {
+			cw.zw = gzip.NewWriter(cw.ResponseWriter)
+		} else {
+			cw.zw = zlib.NewWriter(cw.ResponseWriter)
+		}
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(cw.buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(cw.buf)
+	}
+	cw.buf = nil
+	return err
+}
+
+// close sends whatever is still buffered, uncompressed since it is under the minimum
+// size, and finishes the compressed stream.
+func (cw *compressWriter) close() {
+	if !cw.started && cw.wroteHeader {
+		cw.start(false)
+	}
+	if cw.zw != nil {
+		cw.zw.Close()
+	}
+}
+
+// Flush sends the response so far, compressed or not depending on its size.
+func (cw *compressWriter) Flush() {
+	if !cw.started && cw.wroteHeader {
+		cw.start(len(cw.buf) >= cw.minSize)
+	}
+	if zw, ok := cw.zw.(interface{ Flush() error }); ok {
+		zw.Flush()
+	}
+	http.NewResponseController(cw.ResponseWriter).Flush()
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
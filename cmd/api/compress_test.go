@@ -0,0 +1,149 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"GZIP", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0.1", "deflate"},
+		{"gzip;q=0", ""},
+		{"br, identity", ""},
+		{"*", "gzip"},
+		{"*;q=0", ""},
+		{"gzip;q=0, *", "deflate"},
+		{"gzip;q=oops, deflate", "deflate"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.acceptEncoding, func(t *testing.T) {
+			assert.Equal(t, negotiateEncoding(tc.acceptEncoding), tc.want)
+		})
+	}
+}
+
+func TestCompress(t *testing.T) {
+	app := newTestApplication()
+	app.config.compression.enabled = true
+	app.config.compression.minSize = 1024
+
+	large := strings.Repeat("receipt ", 512)
+
+	handler := app.compress(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/small":
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"points": 100}`))
+		case "/large":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Length", "4096")
+			w.WriteHeader(http.StatusCreated)
+			// Written in pieces, so the threshold is crossed part way through.
+			for i := 0; i < len(large); i += 100 {
+				w.Write([]byte(large[i:min(i+100, len(large))]))
+			}
+		case "/tagged":
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("ETag", `"v1.abc"`)
+			w.Write([]byte(large))
+		case "/binary":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write([]byte(large))
+		}
+	}))
+
+	do := func(method, path, acceptEncoding string) *http.Response {
+		req := httptest.NewRequest(method, path, nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w.Result()
+	}
+
+	body := func(rs *http.Response) string {
+		b, err := io.ReadAll(rs.Body)
+		assert.NoError(t, err)
+		return string(b)
+	}
+
+	t.Run("Gzip", func(t *testing.T) {
+		rs := do(http.MethodGet, "/large", "gzip, deflate")
+		assert.Equal(t, rs.StatusCode, http.StatusCreated)
+		assert.Equal(t, rs.Header.Get("Content-Encoding"), "gzip")
+		assert.Equal(t, rs.Header.Get("Content-Length"), "")
+		assert.Equal(t, rs.Header.Get("Vary"), "Accept-Encoding")
+
+		zr, err := gzip.NewReader(rs.Body)
+		assert.NoError(t, err)
+		b, err := io.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.Equal(t, string(b), large)
+	})
+
+	t.Run("Deflate", func(t *testing.T) {
+		rs := do(http.MethodGet, "/large", "gzip;q=0.5, deflate")
+		assert.Equal(t, rs.Header.Get("Content-Encoding"), "deflate")
+
+		zr, err := zlib.NewReader(rs.Body)
+		assert.NoError(t, err)
+		b, err := io.ReadAll(zr)
+		assert.NoError(t, err)
+		assert.Equal(t, string(b), large)
+	})
+
+	t.Run("Below Threshold", func(t *testing.T) {
+		rs := do(http.MethodGet, "/small", "gzip")
+		assert.Equal(t, rs.StatusCode, http.StatusOK)
+		assert.Equal(t, rs.Header.Get("Content-Encoding"), "")
+		assert.Equal(t, rs.Header.Get("Vary"), "Accept-Encoding")
+		assert.Equal(t, body(rs), `{"points": 100}`)
+	})
+
+	t.Run("Not Accepted", func(t *testing.T) {
+		rs := do(http.MethodGet, "/large", "")
+		assert.Equal(t, rs.Header.Get("Content-Encoding"), "")
+		assert.Equal(t, rs.Header.Get("Vary"), "Accept-Encoding")
+		assert.Equal(t, body(rs), large)
+	})
+
+	t.Run("ETag", func(t *testing.T) {
+		rs := do(http.MethodGet, "/tagged", "gzip")
+		assert.Equal(t, rs.Header.Get("ETag"), `"v1.abc-gzip"`)
+
+		rs = do(http.MethodGet, "/tagged", "deflate")
+		assert.Equal(t, rs.Header.Get("ETag"), `"v1.abc-deflate"`)
+
+		rs = do(http.MethodGet, "/tagged", "")
+		assert.Equal(t, rs.Header.Get("ETag"), `"v1.abc"`)
+	})
+
+	t.Run("Binary", func(t *testing.T) {
+		rs := do(http.MethodGet, "/binary", "gzip")
+		assert.Equal(t, rs.Header.Get("Content-Encoding"), "")
+		assert.Equal(t, body(rs), large)
+	})
+
+	t.Run("Head", func(t *testing.T) {
+		rs := do(http.MethodHead, "/large", "gzip")
+		assert.Equal(t, rs.Header.Get("Content-Encoding"), "")
+	})
+}
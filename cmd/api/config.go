@@ -0,0 +1,358 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"fetch.trungnng.github.io/internal/settings"
+	"fetch.trungnng.github.io/internal/validator"
+)
+
+// envPrefix is the prefix of environment variables that set flags. FETCH_LIMITER_RPS
+// sets -limiter-rps.
+const envPrefix = "FETCH_"
+
+// redactedSettings are the flags whose values -print-config hides.
+var redactedSettings = map[string]bool{
+	"admin-token": true,
+}
+
+// registerFlags defines the command-line flags that fill cfg. Flag names are also the
+// keys of the config file and, upper-cased with a FETCH_ prefix, the environment
+// variables.
+func (cfg *config) registerFlags(fs *flag.FlagSet) {
+	// Default port number 4000 and the environment "development"
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+
+	// Sidecar proxies can reach the API over a unix socket instead of the TCP port, and
+	// over HTTP/2 without TLS. A stale socket left by a crashed process is replaced.
+	fs.StringVar(&cfg.listen.socket, "socket", "", "Path of a unix socket to serve the API on instead of the TCP port")
+	fs.StringVar(&cfg.listen.socketMode, "socket-mode", "0660", "Permissions of the unix socket (octal)")
+	fs.BoolVar(&cfg.listen.h2c, "h2c", false, "Accept HTTP/2 cleartext (h2c) connections on the API listener")
+
+	// Browsers on the trusted origins may call the API. An origin can be a wildcard
+	// subdomain pattern such as https://*.example.com. Without trusted origins no CORS
+	// headers are sent.
+	fs.StringVar(&cfg.cors.trustedOrigins, "cors-trusted-origins", "", "Comma-separated origins allowed to call the API from a browser (e.g. https://app.example.com,https://*.example.com)")
+	fs.StringVar(&cfg.cors.allowedMethods, "cors-allowed-methods", "GET,POST,PUT,DELETE", "Comma-separated methods allowed in cross-origin requests")
+	fs.StringVar(&cfg.cors.allowedHeaders, "cors-allowed-headers", "Content-Type,X-Request-ID,If-Match,If-None-Match", "Comma-separated request headers allowed in cross-origin requests")
+	fs.BoolVar(&cfg.cors.allowCredentials, "cors-allow-credentials", false, "Allow cross-origin requests with cookies or client certificates")
+	fs.DurationVar(&cfg.cors.maxAge, "cors-max-age", 10*time.Minute, "How long browsers may cache a preflight response (0 leaves it to the browser)")
+
+	// Responses over TLS tell browsers to use HTTPS for the API's host from then on.
+	fs.DurationVar(&cfg.hstsMaxAge, "hsts-max-age", 365*24*time.Hour, "Strict-Transport-Security max-age sent over TLS (0 disables the header)")
+
+	// Text responses are compressed for clients that accept gzip or deflate, unless
+	// they are too small to be worth it.
+	fs.BoolVar(&cfg.compression.enabled, "compression-enabled", true, "Compress responses for clients that accept gzip or deflate")
+	fs.IntVar(&cfg.compression.minSize, "compression-min-size", 1024, "Smallest response, in bytes, that is compressed")
+
+	// Create command line flags to read the setting values into the config struct.
+	// Notice that we use true as the default for the 'enabled' setting?
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+
+	// Every receipt route has a deadline. Work on a request stops when it passes, and
+	// the client gets a 504.
+	fs.DurationVar(&cfg.timeout.read, "timeout-read", 2*time.Second, "Deadline of requests to read receipts and keys")
+	fs.DurationVar(&cfg.timeout.write, "timeout-write", 5*time.Second, "Deadline of receipt submissions")
+
+	// Each route class has a limit on requests in flight which adapts to latency.
+	// Requests over the limit wait in a short queue, reads ahead of writes, and are shed
+	// with a 503 if no slot frees up in time.
+	fs.BoolVar(&cfg.shed.enabled, "shed-enabled", true, "Enable adaptive concurrency limiting and load shedding")
+	fs.IntVar(&cfg.shed.initialLimit, "shed-initial-limit", 100, "Requests in flight allowed per route class before the limit adapts")
+	fs.IntVar(&cfg.shed.minLimit, "shed-min-limit", 10, "Lowest limit on requests in flight per route class")
+	fs.IntVar(&cfg.shed.maxLimit, "shed-max-limit", 1000, "Highest limit on requests in flight per route class")
+	fs.IntVar(&cfg.shed.queueSize, "shed-queue-size", 50, "Requests per route class that can wait for a slot (0 sheds straight away)")
+	fs.DurationVar(&cfg.shed.queueTimeout, "shed-queue-timeout", 100*time.Millisecond, "Longest a request waits for a slot before it is shed")
+	fs.DurationVar(&cfg.shed.retryAfter, "shed-retry-after", time.Second, "Retry-After sent with shed requests")
+
+	// IP allow/deny rules are optional. When no file is given every network is allowed.
+	fs.StringVar(&cfg.ipRules.file, "ip-rules-file", "", "Path to the JSON IP allow/deny rules file")
+	fs.DurationVar(&cfg.ipRules.reloadInterval, "ip-rules-reload-interval", 30*time.Second, "How often to check the IP rules file for changes (0 disables)")
+
+	// Adaptive abuse throttling lowers the rate limit of clients that keep submitting
+	// invalid receipts, and bans them once the rejection ratio passes the threshold.
+	fs.BoolVar(&cfg.abuse.enabled, "abuse-enabled", true, "Enable adaptive abuse throttling")
+	fs.Float64Var(&cfg.abuse.threshold, "abuse-threshold", 0.5, "Rejected/total submission ratio at which a client is banned")
+	fs.Float64Var(&cfg.abuse.minSamples, "abuse-min-samples", 10, "Submissions required before a client can be throttled")
+	fs.DurationVar(&cfg.abuse.banDuration, "abuse-ban-duration", 5*time.Minute, "Duration of a client's first ban")
+	fs.DurationVar(&cfg.abuse.halfLife, "abuse-half-life", 10*time.Minute, "Time for a client's penalty counts to decay by half")
+
+	// Operational endpoints (metrics, pprof, config reload, store stats, rule and key
+	// management) are served on a separate admin listener. Every admin route needs a
+	// bearer token: the admin token grants all scopes, the tokens in the tokens file
+	// only the scopes listed for them.
+	fs.StringVar(&cfg.admin.addr, "admin-addr", "localhost:4001", "Address of the admin listener (empty disables it)")
+	fs.StringVar(&cfg.admin.token, "admin-token", "", "Bearer token granting every admin scope")
+	fs.StringVar(&cfg.admin.tokensFile, "admin-tokens-file", "", "Path to the JSON file of scoped admin tokens")
+	fs.BoolVar(&cfg.admin.debug, "admin-debug", false, "Serve /debug/vars and /debug/pprof on the admin listener")
+
+	// TLS is enabled when a certificate and key are given. Setting a client CA bundle
+	// and a client auth mode turns on mutual TLS.
+	fs.StringVar(&cfg.tls.certFile, "tls-cert", "", "Path to the TLS certificate (PEM)")
+	fs.StringVar(&cfg.tls.keyFile, "tls-key", "", "Path to the TLS private key (PEM)")
+	fs.StringVar(&cfg.tls.minVersion, "tls-min-version", "1.2", "Minimum TLS version (1.0|1.1|1.2|1.3)")
+	fs.StringVar(&cfg.tls.cipherSuites, "tls-ciphers", "", "Comma-separated TLS 1.2 cipher suites in order of preference (default: Go's defaults)")
+	fs.StringVar(&cfg.tls.clientCAFile, "tls-client-ca", "", "Path to the CA bundle used to verify client certificates (PEM)")
+	fs.StringVar(&cfg.tls.clientAuth, "tls-client-auth", "none", "Client certificate policy (none|request|require)")
+	fs.DurationVar(&cfg.tls.reloadInterval, "tls-reload-interval", time.Minute, "How often to check the certificate files for changes (0 disables)")
+
+	// Partners that push receipts server-to-server sign their requests with a shared
+	// HMAC secret. See package reqsign.
+	fs.StringVar(&cfg.signing.secretsFile, "signing-secrets-file", "", "Path to the JSON file of partner signing secrets")
+	fs.BoolVar(&cfg.signing.required, "signing-required", false, "Reject receipt submissions without a valid request signature")
+	fs.DurationVar(&cfg.signing.tolerance, "signing-tolerance", 5*time.Minute, "Maximum clock difference allowed for signed request timestamps")
+
+	// Retailers can sign receipts with Ed25519. The trust store holds their public keys
+	// and the rules decide what a verified signature is worth.
+	fs.StringVar(&cfg.trustStoreFile, "trust-store-file", "", "Path to the JSON file of retailer Ed25519 public keys")
+	fs.Int64Var(&cfg.rules.verifiedBonus, "rules-verified-bonus", 0, "Bonus points awarded to receipts with a verified retailer signature")
+	fs.BoolVar(&cfg.rules.requireVerified, "rules-require-verified", false, "Reject receipts without a verified retailer signature")
+
+	// Read-only mode refuses changes to the store while reads keep working; maintenance
+	// mode serves only the health endpoints. The mode can also be switched through the
+	// admin API.
+	fs.StringVar(&cfg.service.mode, "mode", modeNormal, "Service mode (normal|read-only|maintenance)")
+	fs.StringVar(&cfg.service.message, "mode-message", "", "Explanation sent with requests refused by the service mode")
+	fs.DurationVar(&cfg.service.retryAfter, "mode-retry-after", time.Minute, "Retry-After sent with requests refused by the service mode")
+
+	// Points attestations are signed with the first key; the others are still
+	// published so attestations signed before a key rotation can be verified.
+	fs.StringVar(&cfg.attestKeyFiles, "attest-key-files", "", "Comma-separated Ed25519 PEM private keys for points attestations, active key first")
+
+	// Every receipt mutation is recorded in a hash-chained audit log. Without a file
+	// the log is only kept in memory.
+	fs.StringVar(&cfg.auditLogFile, "audit-log-file", "", "Path to the append-only audit log file (JSON Lines)")
+
+	// Spans are exported as OTLP/JSON, one line per span, for a collector to pick up.
+	fs.StringVar(&cfg.trace.exporter, "trace-exporter", "none", "Trace exporter (none|stdout|file)")
+	fs.StringVar(&cfg.trace.file, "trace-file", "", "Path to the trace output file for the file exporter")
+
+	// Logs go to stdout as text by default. A file output is rotated once it reaches
+	// the maximum size. Redacted attributes keep their key but lose their value.
+	fs.StringVar(&cfg.log.format, "log-format", "text", "Log format (text|json)")
+	fs.StringVar(&cfg.log.level, "log-level", "info", "Minimum log level (debug|info|warn|error)")
+	fs.StringVar(&cfg.log.output, "log-output", "stdout", "Log destination (stdout|stderr|path to a file)")
+	fs.IntVar(&cfg.log.maxSize, "log-max-size", 100, "Size in megabytes at which the log file is rotated (0 disables rotation)")
+	fs.IntVar(&cfg.log.maxBackups, "log-max-backups", 5, "Number of rotated log files to keep")
+	fs.StringVar(&cfg.log.redact, "log-redact", "", "Comma-separated log attribute keys whose values are redacted (e.g. client_ip,identity)")
+
+	// /readyz runs dependency checks. On shutdown it reports not ready for the drain
+	// delay before the server stops accepting connections, so load balancers have time
+	// to take the instance out of rotation.
+	fs.DurationVar(&cfg.health.checkTimeout, "health-check-timeout", 2*time.Second, "Timeout of each readiness check")
+	fs.Int64Var(&cfg.health.maxInFlight, "health-max-in-flight", 1000, "Requests in flight at which the instance reports not ready (0 disables)")
+	fs.DurationVar(&cfg.shutdown.drainDelay, "shutdown-drain-delay", 5*time.Second, "Time to report not ready before shutting down")
+
+	// On SIGUSR2 the server starts a new copy of itself with the same arguments and
+	// hands over its sockets. It shuts down only once the new process is serving.
+	fs.DurationVar(&cfg.shutdown.upgradeTimeout, "upgrade-timeout", 30*time.Second, "Time to wait for the new process to be ready during an upgrade")
+
+	fs.StringVar(&cfg.file, "config", "", "Path to a JSON or TOML config file (also FETCH_CONFIG)")
+}
+
+// loadConfig builds the config from, in increasing order of precedence: the flag
+// defaults, the config file, FETCH_* environment variables and the command-line
+// flags, then validates it.
+//
+// The config file maps flag names to values. Sections are joined to their keys with a
+// dash, so these are equivalent:
+//
+//	{"limiter": {"rps": 10}, "tls": {"cert": "server.crt"}}
+//	{"limiter-rps": 10, "tls-cert": "server.crt"}
+//
+// In TOML:
+//
+//	[limiter]
+//	rps = 10
+func loadConfig(fs *flag.FlagSet, args, environ []string) (config, error) {
+	var cfg config
+	cfg.registerFlags(fs)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return cfg, err
+	}
+
+	explicit := settings.Explicit(fs)
+	env := settings.FromEnv(environ, envPrefix)
+
+	// Other software sets FETCH_* variables too: Kubernetes adds FETCH_PORT,
+	// FETCH_SERVICE_HOST and others for a service named fetch. Those are skipped, and
+	// reported once the logger is up. The config file and flags stay strict.
+	// Kubernetes' FETCH_PORT is a URL such as tcp://10.0.0.1:80, never a port number.
+	ignored := settings.Unknown(fs, env)
+	if strings.Contains(env["port"], "://") {
+		delete(env, "port")
+		ignored = append(ignored, "port")
+	}
+	for _, name := range ignored {
+		cfg.ignoredEnv = append(cfg.ignoredEnv, envPrefix+strings.ToUpper(strings.ReplaceAll(name, "-", "_")))
+	}
+
+	file := cfg.file
+	if file == "" {
+		file = env["config"]
+	}
+
+	if file != "" {
+		fileSettings, err := settings.ParseFile(file)
+		if err != nil {
+			return cfg, err
+		}
+
+		// The file can't point at another file.
+		delete(fileSettings, "config")
+
+		err = settings.Apply(fs, fileSettings, file, explicit)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	err = settings.Apply(fs, env, "environment", explicit)
+	if err != nil {
+		return cfg, err
+	}
+
+	v := validator.New()
+	validateConfig(v, cfg)
+	if !v.Valid() {
+		return cfg, configError(v)
+	}
+
+	return cfg, nil
+}
+
+// validateConfig checks the settings that can be checked without touching the
+// network or the files they point at. Keys are the dotted paths of the config fields.
+func validateConfig(v *validator.Validator, cfg config) {
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be one of development, staging or production")
+
+	_, err := parseSocketMode(cfg.listen.socketMode)
+	v.Check(err == nil, "listen.socketMode", "must be octal permissions, e.g. 0660")
+	v.Check(!cfg.listen.h2c || cfg.tls.certFile == "", "listen.h2c", "can't be used with TLS")
+
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter.rps", "must be positive")
+		v.Check(cfg.limiter.burst > 0, "limiter.burst", "must be positive")
+	}
+
+	if cfg.abuse.enabled {
+		v.Check(cfg.abuse.threshold > 0 && cfg.abuse.threshold <= 1, "abuse.threshold", "must be greater than 0 and at most 1")
+		v.Check(cfg.abuse.minSamples >= 0, "abuse.minSamples", "must not be negative")
+		v.Check(cfg.abuse.banDuration > 0, "abuse.banDuration", "must be positive")
+		v.Check(cfg.abuse.halfLife > 0, "abuse.halfLife", "must be positive")
+	}
+
+	for _, origin := range splitList(cfg.cors.trustedOrigins) {
+		v.Check(origin == "*" || strings.Contains(origin, "://"), "cors.trustedOrigins", "must be origins such as https://app.example.com, wildcard patterns such as https://*.example.com, or *")
+	}
+	v.Check(!cfg.cors.allowCredentials || !slices.Contains(splitList(cfg.cors.trustedOrigins), "*"), "cors.trustedOrigins", "must not contain * when cors.allowCredentials is true")
+	for _, method := range splitList(cfg.cors.allowedMethods) {
+		v.Check(validator.PermittedValue(method, http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete), "cors.allowedMethods", "must be upper-case HTTP methods, e.g. GET,POST")
+	}
+	v.Check(cfg.cors.maxAge >= 0, "cors.maxAge", "must not be negative")
+	v.Check(cfg.hstsMaxAge >= 0, "hstsMaxAge", "must not be negative")
+	v.Check(cfg.compression.minSize >= 0, "compression.minSize", "must not be negative")
+
+	// A deadline past the server's write timeout would never be reported to the client.
+	v.Check(cfg.timeout.read > 0 && cfg.timeout.read < writeTimeout, "timeout.read", fmt.Sprintf("must be positive and less than %s", writeTimeout))
+	v.Check(cfg.timeout.write > 0 && cfg.timeout.write < writeTimeout, "timeout.write", fmt.Sprintf("must be positive and less than %s", writeTimeout))
+
+	if cfg.shed.enabled {
+		v.Check(cfg.shed.minLimit > 0, "shed.minLimit", "must be positive")
+		v.Check(cfg.shed.maxLimit >= cfg.shed.minLimit, "shed.maxLimit", "must not be less than shed.minLimit")
+		v.Check(cfg.shed.initialLimit >= cfg.shed.minLimit && cfg.shed.initialLimit <= cfg.shed.maxLimit, "shed.initialLimit", "must be between shed.minLimit and shed.maxLimit")
+		v.Check(cfg.shed.queueSize >= 0, "shed.queueSize", "must not be negative")
+		v.Check(cfg.shed.queueTimeout > 0, "shed.queueTimeout", "must be positive")
+		v.Check(cfg.shed.retryAfter > 0, "shed.retryAfter", "must be positive")
+	}
+
+	v.Check(cfg.ipRules.reloadInterval >= 0, "ipRules.reloadInterval", "must not be negative")
+
+	v.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls", "tls.certFile and tls.keyFile must be set together")
+	v.Check(tlsVersions[cfg.tls.minVersion] != 0, "tls.minVersion", "must be one of 1.0, 1.1, 1.2 or 1.3")
+	_, ok := tlsClientAuthModes[cfg.tls.clientAuth]
+	v.Check(ok, "tls.clientAuth", "must be one of none, request or require")
+	v.Check(cfg.tls.reloadInterval >= 0, "tls.reloadInterval", "must not be negative")
+
+	v.Check(cfg.signing.tolerance > 0, "signing.tolerance", "must be positive")
+	v.Check(!cfg.signing.required || cfg.signing.secretsFile != "", "signing.secretsFile", "must be set when signing.required is true")
+	v.Check(cfg.rules.verifiedBonus >= 0, "rules.verifiedBonus", "must not be negative")
+
+	v.Check(validator.PermittedValue(cfg.service.mode, modeNormal, modeReadOnly, modeMaintenance), "service.mode", "must be one of normal, read-only or maintenance")
+	v.Check(cfg.service.retryAfter > 0, "service.retryAfter", "must be positive")
+
+	v.Check(validator.PermittedValue(cfg.trace.exporter, "none", "stdout", "file"), "trace.exporter", "must be one of none, stdout or file")
+	v.Check(cfg.trace.exporter != "file" || cfg.trace.file != "", "trace.file", "must be set when trace.exporter is file")
+
+	v.Check(validator.PermittedValue(cfg.log.format, "text", "json"), "log.format", "must be one of text or json")
+	v.Check(validator.PermittedValue(strings.ToLower(cfg.log.level), "debug", "info", "warn", "error"), "log.level", "must be one of debug, info, warn or error")
+	v.Check(cfg.log.maxSize >= 0, "log.maxSize", "must not be negative")
+	v.Check(cfg.log.maxBackups >= 0, "log.maxBackups", "must not be negative")
+
+	v.Check(cfg.health.checkTimeout > 0, "health.checkTimeout", "must be positive")
+	v.Check(cfg.health.maxInFlight >= 0, "health.maxInFlight", "must not be negative")
+	v.Check(cfg.shutdown.drainDelay >= 0, "shutdown.drainDelay", "must not be negative")
+	v.Check(cfg.shutdown.upgradeTimeout > 0, "shutdown.upgradeTimeout", "must be positive")
+}
+
+// configError turns the validator's errors into a single error with one line per
+// setting, in a stable order.
+func configError(v *validator.Validator) error {
+	keys := make([]string, 0, len(v.Errors))
+	for key := range v.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	lines := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lines = append(lines, fmt.Sprintf("  %s: %s", key, v.Errors[key]))
+	}
+
+	return errors.New("invalid configuration:\n" + strings.Join(lines, "\n"))
+}
+
+// writeConfig writes the effective configuration as a flat JSON object keyed on flag
+// name, which is itself a valid config file. Secrets are redacted.
+func writeConfig(w io.Writer, fs *flag.FlagSet) error {
+	values := make(map[string]any)
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || f.Name == "print-config" {
+			return
+		}
+
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			value = getter.Get()
+		}
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		if redactedSettings[f.Name] && f.Value.String() != "" {
+			value = "[REDACTED]"
+		}
+
+		values[f.Name] = value
+	})
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(values)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func newTestFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("api", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+
+	jsonFile := filepath.Join(dir, "config.json")
+	err := os.WriteFile(jsonFile, []byte(`{
+		"env": "staging",
+		"port": 5000,
+		"limiter": {"rps": 10, "burst": 20},
+		"log": {"redact": ["client_ip", "identity"]},
+		"abuse_ban_duration": "1m"
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tomlFile := filepath.Join(dir, "config.toml")
+	err = os.WriteFile(tomlFile, []byte(`
+# Staging settings
+env = "staging"
+port = 5000
+
+[limiter]
+rps = 10.0
+burst = 20 # per client
+
+[log]
+redact = ["client_ip", "identity"]
+
+[abuse]
+ban-duration = '1m'
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{jsonFile, tomlFile} {
+		t.Run(filepath.Ext(file), func(t *testing.T) {
+			environ := []string{"FETCH_LIMITER_BURST=30", "FETCH_PORT=6000", "PATH=/usr/bin"}
+			args := []string{"-config", file, "-port", "7000"}
+
+			cfg, err := loadConfig(newTestFlagSet(), args, environ)
+			assert.NoError(t, err)
+
+			// Defaults
+			assert.Equal(t, cfg.limiter.enabled, true)
+			assert.Equal(t, cfg.tls.minVersion, "1.2")
+
+			// File
+			assert.Equal(t, cfg.env, "staging")
+			assert.Equal(t, cfg.limiter.rps, 10)
+			assert.Equal(t, cfg.log.redact, "client_ip,identity")
+			assert.Equal(t, cfg.abuse.banDuration, time.Minute)
+
+			// Environment over file, flags over environment
+			assert.Equal(t, cfg.limiter.burst, 30)
+			assert.Equal(t, cfg.port, 7000)
+		})
+	}
+
+	// The config file can also come from the environment.
+	cfg, err := loadConfig(newTestFlagSet(), nil, []string{"FETCH_CONFIG=" + jsonFile})
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.port, 5000)
+}
+
+func TestLoadConfigIgnoredEnvironment(t *testing.T) {
+	// The variables Kubernetes sets for a service named fetch.
+	environ := []string{
+		"FETCH_PORT=tcp://10.0.0.1:80",
+		"FETCH_PORT_80_TCP=tcp://10.0.0.1:80",
+		"FETCH_SERVICE_HOST=10.0.0.1",
+		"FETCH_LIMITER_RPS=3",
+	}
+
+	cfg, err := loadConfig(newTestFlagSet(), nil, environ)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.port, 4000)
+	assert.Equal(t, cfg.limiter.rps, 3)
+	assert.Equal(t, strings.Join(cfg.ignoredEnv, ","), "FETCH_PORT_80_TCP,FETCH_SERVICE_HOST,FETCH_PORT")
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	badKey := filepath.Join(dir, "bad-key.json")
+	os.WriteFile(badKey, []byte(`{"limiter": {"rsp": 10}}`), 0o600)
+
+	badTOML := filepath.Join(dir, "bad.toml")
+	os.WriteFile(badTOML, []byte("[limiter\nrps = 10\n"), 0o600)
+
+	tests := []struct {
+		name     string
+		args     []string
+		environ  []string
+		expected string
+	}{
+		{"Unknown file key", []string{"-config", badKey}, nil, `unknown setting "limiter-rsp"`},
+		{"Invalid TOML", []string{"-config", badTOML}, nil, "line 1: invalid table header"},
+		{"Invalid environment value", nil, []string{"FETCH_PORT=abc"}, `invalid value "abc" for port`},
+		{"Non-positive rps", []string{"-limiter-rps", "0"}, nil, "limiter.rps: must be positive"},
+		{"Unknown env", nil, []string{"FETCH_ENV=prod"}, "env: must be one of development, staging or production"},
+		{"Trace file missing", []string{"-trace-exporter", "file"}, nil, "trace.file: must be set when trace.exporter is file"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := loadConfig(newTestFlagSet(), tc.args, tc.environ)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	fs := newTestFlagSet()
+
+	_, err := loadConfig(fs, []string{"-admin-token", "secret", "-limiter-rps", "3.5"}, nil)
+	assert.NoError(t, err)
+
+	var buf bytes.Buffer
+	assert.NoError(t, writeConfig(&buf, fs))
+
+	out := buf.String()
+	assert.Contains(t, out, `"admin-token": "[REDACTED]"`)
+	assert.Contains(t, out, `"limiter-rps": 3.5`)
+	assert.Contains(t, out, `"limiter-enabled": true`)
+	assert.Contains(t, out, `"abuse-half-life": "10m0s"`)
+
+	// The output is a valid config file.
+	file := filepath.Join(t.TempDir(), "config.json")
+	assert.NoError(t, os.WriteFile(file, bytes.Replace(buf.Bytes(), []byte("[REDACTED]"), []byte("secret"), 1), 0o600))
+
+	cfg, err := loadConfig(newTestFlagSet(), []string{"-config", file}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, cfg.limiter.rps, 3.5)
+	assert.Equal(t, cfg.admin.token, "secret")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// contextKey is a custom type for keys stored in the request context, to avoid
+// collisions with keys set by other packages.
+type contextKey string
+
+const (
+	clientCertSubjectContextKey = contextKey("clientCertSubject")
+	partnerContextKey           = contextKey("partner")
+	requestIDContextKey         = contextKey("requestID")
+	requestMetaContextKey       = contextKey("requestMeta")
+)
+
+// requestMeta holds values that handlers and inner middleware fill in for the benefit
+// of outer middleware, which can't see context values added further down the chain.
+type requestMeta struct {
+	mu       sync.Mutex
+	identity string
+}
+
+// contextSetClientCertSubject returns a copy of the request with the subject of the
+// verified client certificate added to its context.
+func (app *application) contextSetClientCertSubject(r *http.Request, subject string) *http.Request {
+	app.setIdentity(r, "cert:"+subject)
+
+	ctx := context.WithValue(r.Context(), clientCertSubjectContextKey, subject)
+	return r.WithContext(ctx)
+}
+
+// contextGetClientCertSubject returns the subject of the client certificate presented
+// over mutual TLS, or an empty string if the client did not present one.
+func (app *application) contextGetClientCertSubject(r *http.Request) string {
+	subject, ok := r.Context().Value(clientCertSubjectContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return subject
+}
+
+// contextSetPartner returns a copy of the request with the key ID of the partner whose
+// signature was verified added to its context.
+func (app *application) contextSetPartner(r *http.Request, keyID string) *http.Request {
+	app.setIdentity(r, "partner:"+keyID)
+
+	ctx := context.WithValue(r.Context(), partnerContextKey, keyID)
+	return r.WithContext(ctx)
+}
+
+// contextGetPartner returns the key ID of the partner that signed the request, or an
+// empty string for unsigned requests.
+func (app *application) contextGetPartner(r *http.Request) string {
+	keyID, ok := r.Context().Value(partnerContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return keyID
+}
+
+// contextSetRequestID returns a copy of the request with the request ID added to its
+// context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID returns the request ID, or an empty string if the request didn't
+// pass through the requestID middleware.
+func contextGetRequestID(ctx context.Context) string {
+	id, ok := ctx.Value(requestIDContextKey).(string)
+	if !ok {
+		return ""
+	}
+	return id
+}
+
+// contextSetRequestMeta returns a copy of the request with an empty requestMeta added
+// to its context, and the requestMeta itself.
+func (app *application) contextSetRequestMeta(r *http.Request) (*http.Request, *requestMeta) {
+	meta := &requestMeta{}
+	ctx := context.WithValue(r.Context(), requestMetaContextKey, meta)
+	return r.WithContext(ctx), meta
+}
+
+// setIdentity records the authenticated identity of the client for the access log.
+// The most recently verified identity wins.
+func (app *application) setIdentity(r *http.Request, identity string) {
+	meta, ok := r.Context().Value(requestMetaContextKey).(*requestMeta)
+	if !ok {
+		return
+	}
+
+	meta.mu.Lock()
+	meta.identity = identity
+	meta.mu.Unlock()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestOriginAllowed(t *testing.T) {
+	patterns := []string{"https://app.example.com", "https://*.example.org", "http://*.localhost:3000"}
+
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"https://app.example.com", true},
+		{"https://APP.example.com", true},
+		{"http://app.example.com", false},
+		{"https://evil.example.com", false},
+		{"https://shop.example.org", true},
+		{"https://eu.shop.example.org", true},
+		{"https://example.org", false},
+		{"https://shop.example.org.evil.com", false},
+		{"https://evil.com/.example.org", false},
+		{"https://shop.example.org:8443", false},
+		{"http://web.localhost:3000", true},
+		{"http://web.localhost:4000", false},
+		{"null", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.origin, func(t *testing.T) {
+			assert.Equal(t, originAllowed(tc.origin, patterns), tc.want)
+		})
+	}
+
+	assert.Equal(t, originAllowed("https://anything.test", []string{"*"}), true)
+}
+
+func TestCORS(t *testing.T) {
+	// The default methods cover every route that can be called cross-origin.
+	defaults, err := loadConfig(newTestFlagSet(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApplication()
+	app.config.cors.trustedOrigins = "https://*.example.com"
+	app.config.cors.allowedMethods = defaults.cors.allowedMethods
+	app.config.cors.allowedHeaders = "Content-Type,X-Request-ID"
+	app.config.cors.allowCredentials = true
+	app.config.cors.maxAge = 10 * time.Minute
+	app.config.hstsMaxAge = 24 * time.Hour
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	do := func(method, path string, header map[string]string) *http.Response {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+		return rs
+	}
+
+	// Trusted origins can read responses, including errors.
+	rs := do(http.MethodGet, "/livez", map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Credentials"), "true")
+	assert.Equal(t, rs.Header.Get("Access-Control-Expose-Headers"), "ETag, X-Request-ID")
+	assert.Equal(t, rs.Header.Get("Vary"), "Origin")
+
+	rs = do(http.MethodDelete, "/livez", map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, rs.StatusCode, http.StatusMethodNotAllowed)
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Origin"), "https://app.example.com")
+
+	rs = do(http.MethodGet, "/livez", map[string]string{"Origin": "https://evil.test"})
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Origin"), "")
+
+	// Preflights get the methods both configured and served by the route.
+	rs = do(http.MethodOptions, "/receipts/process", map[string]string{
+		"Origin":                         "https://app.example.com",
+		"Access-Control-Request-Method":  "POST",
+		"Access-Control-Request-Headers": "content-type",
+	})
+	assert.Equal(t, rs.StatusCode, http.StatusNoContent)
+	assert.Equal(t, rs.Header.Get("Allow"), "DELETE, OPTIONS, POST, PUT")
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Origin"), "https://app.example.com")
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Methods"), "POST, PUT, DELETE")
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Headers"), "Content-Type, X-Request-ID")
+	assert.Equal(t, rs.Header.Get("Access-Control-Max-Age"), "600")
+
+	for _, method := range []string{http.MethodPut, http.MethodDelete} {
+		rs = do(http.MethodOptions, "/receipts/abc", map[string]string{
+			"Origin":                        "https://app.example.com",
+			"Access-Control-Request-Method": method,
+		})
+		assert.Equal(t, rs.StatusCode, http.StatusNoContent)
+		assert.Equal(t, rs.Header.Get("Access-Control-Allow-Methods"), "PUT, DELETE")
+	}
+
+	rs = do(http.MethodOptions, "/receipts/abc", map[string]string{
+		"Origin":                        "https://app.example.com",
+		"Access-Control-Request-Method": "PATCH",
+	})
+	assert.Equal(t, rs.StatusCode, http.StatusNoContent)
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Methods"), "")
+
+	rs = do(http.MethodOptions, "/receipts/process", map[string]string{
+		"Origin":                        "https://evil.test",
+		"Access-Control-Request-Method": "POST",
+	})
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Origin"), "")
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Methods"), "")
+
+	rs = do(http.MethodOptions, "/unknown", map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, rs.StatusCode, http.StatusNotFound)
+
+	// Without trusted origins no CORS headers are sent at all.
+	app.configMu.Lock()
+	app.config.cors.trustedOrigins = ""
+	app.configMu.Unlock()
+
+	rs = do(http.MethodGet, "/livez", map[string]string{"Origin": "https://app.example.com"})
+	assert.Equal(t, rs.Header.Get("Access-Control-Allow-Origin"), "")
+	assert.Equal(t, strings.Join(rs.Header.Values("Vary"), ", "), "Accept")
+}
+
+func TestSecureHeaders(t *testing.T) {
+	app := newTestApplication()
+	app.config.hstsMaxAge = 24 * time.Hour
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	_, header, _ := ts.get(t, "/livez")
+	assert.Equal(t, header.Get("X-Content-Type-Options"), "nosniff")
+	assert.Equal(t, header.Get("Cache-Control"), "no-store")
+	assert.Equal(t, header.Get("Strict-Transport-Security"), "max-age=86400; includeSubDomains")
+}
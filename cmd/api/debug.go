@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// background runs fn in a new goroutine which is counted under subsystem in the
+// "goroutines" debug variable while it runs. The context passed to fn is cancelled
+// once the server has shut down, so periodic work stops with it.
+func (app *application) background(subsystem string, fn func(ctx context.Context)) {
+	app.goroutines.Add(subsystem, 1)
+
+	go func() {
+		defer app.goroutines.Add(subsystem, -1)
+		fn(app.backgroundCtx)
+	}()
+}
+
+// sleep waits for d to pass or ctx to be cancelled, and reports whether d passed.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// debugVarsHandler serves the expvar variables as JSON. It writes the process-wide
+// variables published with package expvar (cmdline and memstats) followed by the
+// application's own:
+//
+//   - goroutines: background goroutines per subsystem, plus the process total.
+//   - receipts_stored: entries in the receipt store.
+//   - limiter_clients: clients tracked by the rate limiter.
+func (app *application) debugVarsHandler(w http.ResponseWriter, r *http.Request) {
+	receipts := 0
+	if app.model != nil {
+		receipts = app.model.Receipts.Len()
+	}
+
+	vars := new(expvar.Map)
+	goroutines := new(expvar.Map)
+	app.goroutines.Do(func(kv expvar.KeyValue) {
+		goroutines.Set(kv.Key, kv.Value)
+	})
+	goroutines.Add("total", int64(runtime.NumGoroutine()))
+	vars.Set("goroutines", goroutines)
+	vars.Add("receipts_stored", int64(receipts))
+	vars.Add("limiter_clients", app.limiterClients.Load())
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	fmt.Fprint(w, "{\n")
+	first := true
+	write := func(kv expvar.KeyValue) {
+		if !first {
+			fmt.Fprint(w, ",\n")
+		}
+		first = false
+		fmt.Fprintf(w, "%q: %s", kv.Key, kv.Value)
+	}
+	expvar.Do(write)
+	vars.Do(write)
+	fmt.Fprint(w, "\n}\n")
+}
+
+// pprofHandler serves the net/http/pprof handlers under /debug/pprof/. Importing the
+// package also registers them on http.DefaultServeMux, but no server here uses it, so
+// they are only reachable through this handler, on the admin listener and only when
+// -admin-debug is set.
+func (app *application) pprofHandler(w http.ResponseWriter, r *http.Request) {
+	switch httprouter.ParamsFromContext(r.Context()).ByName("profile") {
+	case "/cmdline":
+		pprof.Cmdline(w, r)
+	case "/profile":
+		pprof.Profile(w, r)
+	case "/symbol":
+		pprof.Symbol(w, r)
+	case "/trace":
+		pprof.Trace(w, r)
+	default:
+		// Index also serves the named profiles, such as /debug/pprof/heap.
+		pprof.Index(w, r)
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/data"
+)
+
+func TestDebugRoutes(t *testing.T) {
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+	app.config.admin.debug = true
+	app.model = data.NewModels()
+	app.limiterClients.Store(3)
+
+	assert.NoError(t, app.model.Receipts.Insert(t.Context(), "test", app.model.Receipts.NewReceipt()))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	app.background("test", func(context.Context) { <-stop })
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	code, _, _ := ts.get(t, "/debug/vars")
+	assert.Equal(t, code, http.StatusUnauthorized)
+
+	code, body := ts.adminGet(t, "/debug/vars", "secret")
+	assert.Equal(t, code, http.StatusOK)
+
+	var vars struct {
+		Goroutines     map[string]int64 `json:"goroutines"`
+		ReceiptsStored int64            `json:"receipts_stored"`
+		LimiterClients int64            `json:"limiter_clients"`
+		Memstats       map[string]any   `json:"memstats"`
+	}
+	if err := json.Unmarshal([]byte(body), &vars); err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, vars.Goroutines["test"], 1)
+	assert.Equal(t, vars.Goroutines["total"] > 1, true)
+	assert.Equal(t, vars.ReceiptsStored, 1)
+	assert.Equal(t, vars.LimiterClients, 3)
+	assert.Equal(t, vars.Memstats != nil, true)
+
+	code, body = ts.adminGet(t, "/debug/pprof/", "secret")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Contains(t, body, "goroutine")
+
+	code, _ = ts.adminGet(t, "/debug/pprof/heap?debug=1", "secret")
+	assert.Equal(t, code, http.StatusOK)
+}
+
+func TestDebugRoutesDisabled(t *testing.T) {
+	app := newTestApplication()
+	app.config.admin.token = "secret"
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	for _, path := range []string{"/debug/vars", "/debug/pprof/", "/debug/pprof/heap"} {
+		code, _ := ts.adminGet(t, path, "secret")
+		assert.Equal(t, code, http.StatusNotFound)
+	}
+}
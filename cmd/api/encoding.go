@@ -0,0 +1,564 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"fetch.trungnng.github.io/internal/msgpack"
+)
+
+// errNotList is returned by encoders that can only write list responses, such as CSV,
+// for any other envelope.
+var errNotList = errors.New("response is not a list")
+
+// An encoder writes response envelopes in one media type and, if decode is set, reads
+// request bodies in it. decode returns the body as the generic values encoding/json
+// decodes into, so the request can go through the same checks as a JSON one.
+type encoder struct {
+	mediaType string
+	aliases   []string
+	marshal   func(env envelope) ([]byte, error)
+	decode    func(body io.Reader) (any, error)
+}
+
+// encoders is the registry of response formats, in order of preference when the
+// Accept header leaves the choice to the server. JSON comes first and is the default.
+var encoders = []*encoder{
+	{mediaType: "application/json", marshal: marshalJSON},
+	{mediaType: "application/xml", aliases: []string{"text/xml"}, marshal: marshalXML, decode: decodeXML},
+	{mediaType: "text/csv", marshal: marshalCSV},
+	{mediaType: "application/msgpack", aliases: []string{"application/x-msgpack", "application/vnd.msgpack"}, marshal: marshalMsgpack, decode: decodeMsgpack},
+}
+
+// name returns the short name of the encoder's format, such as "json" or "msgpack".
+func (e *encoder) name() string {
+	_, subtype, _ := strings.Cut(e.mediaType, "/")
+	return subtype
+}
+
+// matches reports whether mediaType names the encoder's format.
+func (e *encoder) matches(mediaType string) bool {
+	return mediaType == e.mediaType || slices.Contains(e.aliases, mediaType)
+}
+
+// negotiateEncoders returns the encoders acceptable under an Accept header, most
+// preferred first, with JSON added at the end if the header doesn't accept it. A media range such as "application/*" or
+// "*/*" covers the formats the header doesn't name, and the most specific range
+// decides each format's quality. Formats of equal quality keep their registry order.
+func negotiateEncoders(accept string) []*encoder {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+
+	var ranges []mediaRange
+	for _, part := range splitList(accept) {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				continue
+			}
+		}
+		ranges = append(ranges, mediaRange{mediaType, q})
+	}
+
+	type candidate struct {
+		enc *encoder
+		q   float64
+	}
+
+	var candidates []candidate
+	for _, enc := range encoders {
+		q, specificity := 0.0, -1
+		for _, mr := range ranges {
+			major, _, _ := strings.Cut(enc.mediaType, "/")
+
+			s := -1
+			switch {
+			case enc.matches(mr.mediaType):
+				s = 2
+			case mr.mediaType == major+"/*":
+				s = 1
+			case mr.mediaType == "*/*":
+				s = 0
+			}
+			if s > specificity {
+				q, specificity = mr.q, s
+			}
+		}
+
+		if q > 0 {
+			candidates = append(candidates, candidate{enc, q})
+		}
+	}
+
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		switch {
+		case a.q > b.q:
+			return -1
+		case a.q < b.q:
+			return 1
+		default:
+			return 0
+		}
+	})
+
+	var result []*encoder
+	for _, c := range candidates {
+		result = append(result, c.enc)
+	}
+	if !slices.Contains(result, encoders[0]) {
+		result = append(result, encoders[0])
+	}
+	return result
+}
+
+// requestEncoder returns the encoder that reads a request body of the given
+// Content-Type, or nil if the body is to be read as JSON. Requests without a
+// recognised Content-Type have always been read as JSON, and still are.
+func requestEncoder(contentType string) *encoder {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil
+	}
+
+	for _, enc := range encoders {
+		if enc.decode != nil && enc.matches(mediaType) {
+			return enc
+		}
+	}
+	return nil
+}
+
+// genericValue converts v to the generic values encoding/json decodes into, so the
+// other formats see the same field names and values as JSON clients do. Numbers are
+// kept as json.Number, so integers stay integers.
+func genericValue(v any) (any, error) {
+	js, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(js))
+	dec.UseNumber()
+
+	var generic any
+	err = dec.Decode(&generic)
+	return generic, err
+}
+
+func marshalJSON(env envelope) ([]byte, error) {
+	return json.Marshal(env)
+}
+
+func marshalMsgpack(env envelope) ([]byte, error) {
+	generic, err := genericValue(env)
+	if err != nil {
+		return nil, err
+	}
+	return msgpack.Marshal(generic)
+}
+
+func decodeMsgpack(body io.Reader) (any, error) {
+	b, err := io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, io.EOF
+	}
+
+	v, err := msgpack.Unmarshal(b)
+	if err != nil {
+		return nil, errors.New("body contains badly-formed MessagePack")
+	}
+	return v, nil
+}
+
+// marshalXML writes an envelope as XML under a <response> root. Each key becomes an
+// element, or an <entry key="..."> element if it isn't a valid element name, list
+// elements become <item> elements, and null values empty elements. For example:
+//
+//	<response><points>28</points><request_id>...</request_id></response>
+func marshalXML(env envelope) ([]byte, error) {
+	generic, err := genericValue(env)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+
+	enc := xml.NewEncoder(&buf)
+	err = encodeXMLElement(enc, "response", generic)
+	if err != nil {
+		return nil, err
+	}
+
+	err = enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeXMLElement(enc *xml.Encoder, name string, v any) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if !isXMLName(name) {
+		start = xml.StartElement{
+			Name: xml.Name{Local: "entry"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "key"}, Value: name}},
+		}
+	}
+
+	err := enc.EncodeToken(start)
+	if err != nil {
+		return err
+	}
+
+	switch v := v.(type) {
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			err = encodeXMLElement(enc, k, v[k])
+			if err != nil {
+				return err
+			}
+		}
+	case []any:
+		for _, e := range v {
+			err = encodeXMLElement(enc, "item", e)
+			if err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		err = enc.EncodeToken(xml.CharData(fmt.Sprint(v)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+// isXMLName reports whether s can be used as an element name as it is: letters,
+// digits, "_", "-" and ".", not starting with a digit, "-", "." or "xml".
+func isXMLName(s string) bool {
+	if s == "" || strings.HasPrefix(strings.ToLower(s), "xml") {
+		return false
+	}
+
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// maxXMLDepth bounds the nesting of XML request bodies.
+const maxXMLDepth = 32
+
+// decodeXML reads an XML request body in the shape marshalXML writes. The root
+// element's name doesn't matter. An element with child elements is an object, unless
+// its children are all <item> elements, which make a list; repeated child elements
+// also make a list. Any other element is a string. For example:
+//
+//	<receipt><retailer>Target</retailer><items><item><price>6.49</price></item></items></receipt>
+func decodeXML(body io.Reader) (any, error) {
+	dec := xml.NewDecoder(body)
+
+	var v any
+	found := false
+	for {
+		tok, err := dec.Token()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, xmlError(err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			if found {
+				return nil, errors.New("body must only contain a single XML element")
+			}
+			v, err = decodeXMLElement(dec, 0)
+			if err != nil {
+				return nil, err
+			}
+			found = true
+		case xml.CharData:
+			if len(bytes.TrimSpace(tok)) > 0 {
+				return nil, errors.New("body contains badly-formed XML")
+			}
+		}
+	}
+
+	if !found {
+		return nil, io.EOF
+	}
+	return v, nil
+}
+
+func decodeXMLElement(dec *xml.Decoder, depth int) (any, error) {
+	if depth > maxXMLDepth {
+		return nil, fmt.Errorf("body must not be nested more than %d levels deep", maxXMLDepth)
+	}
+
+	type child struct {
+		name  string
+		value any
+	}
+
+	var text bytes.Buffer
+	var children []child
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, xmlError(err)
+		}
+
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name := tok.Name.Local
+			if name == "entry" {
+				for _, attr := range tok.Attr {
+					if attr.Name.Local == "key" {
+						name = attr.Value
+					}
+				}
+			}
+
+			v, err := decodeXMLElement(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			children = append(children, child{name, v})
+		case xml.CharData:
+			text.Write(tok)
+		case xml.EndElement:
+			if len(children) == 0 {
+				return text.String(), nil
+			}
+
+			if !slices.ContainsFunc(children, func(c child) bool { return c.name != "item" }) {
+				list := make([]any, 0, len(children))
+				for _, c := range children {
+					list = append(list, c.value)
+				}
+				return list, nil
+			}
+
+			obj := make(map[string]any, len(children))
+			for _, c := range children {
+				switch existing := obj[c.name].(type) {
+				case nil:
+					obj[c.name] = c.value
+				case []any:
+					obj[c.name] = append(existing, c.value)
+				default:
+					obj[c.name] = []any{existing, c.value}
+				}
+			}
+			return obj, nil
+		}
+	}
+}
+
+// xmlError maps errors from the XML decoder to messages for the client, leaving
+// errors reading the body for readRequest to report.
+func xmlError(err error) error {
+	var syntaxError *xml.SyntaxError
+	switch {
+	case errors.As(err, &syntaxError):
+		return fmt.Errorf("body contains badly-formed XML (on line %d)", syntaxError.Line)
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return errors.New("body contains badly-formed XML")
+	default:
+		return err
+	}
+}
+
+// marshalCSV writes a list envelope, one with a single key holding a list, as CSV
+// with a header row. The columns are the union of the list elements' keys in sorted
+// order. Nested values are written as JSON, and null values as empty cells.
+func marshalCSV(env envelope) ([]byte, error) {
+	if len(env) != 1 {
+		return nil, errNotList
+	}
+
+	var list []any
+	for _, v := range env {
+		generic, err := genericValue(v)
+		if err != nil {
+			return nil, err
+		}
+
+		var ok bool
+		list, ok = generic.([]any)
+		if !ok {
+			return nil, errNotList
+		}
+	}
+
+	rows := make([]map[string]any, 0, len(list))
+	var columns []string
+	for _, e := range list {
+		row, ok := e.(map[string]any)
+		if !ok {
+			row = map[string]any{"value": e}
+		}
+		for k := range row {
+			if !slices.Contains(columns, k) {
+				columns = append(columns, k)
+			}
+		}
+		rows = append(rows, row)
+	}
+	slices.Sort(columns)
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+
+	err := w.Write(columns)
+	if err != nil {
+		return nil, err
+	}
+
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for i, column := range columns {
+			record[i], err = csvCell(row[column])
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		err = w.Write(record)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func csvCell(v any) (string, error) {
+	switch v := v.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case json.Number:
+		return v.String(), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		js, err := json.Marshal(v)
+		return string(js), err
+	}
+}
+
+// writeResponse sends a response envelope in the format the client asks for in its
+// Accept header, JSON by default. Formats that can't represent the envelope, such as
+// CSV for anything but a list, are skipped.
+// responseEncoder returns the encoder writeResponse uses for env. The choice depends
+// only on the Accept header and the shape of env, so an envelope with placeholder
+// values gives the format before the real values are known.
+func responseEncoder(r *http.Request, env envelope) *encoder {
+	for _, enc := range negotiateEncoders(r.Header.Get("Accept")) {
+		_, err := enc.marshal(env)
+		if !errors.Is(err, errNotList) {
+			return enc
+		}
+	}
+	return encoders[0]
+}
+
+func (app *application) writeResponse(w http.ResponseWriter, r *http.Request, status int, data envelope, headers http.Header) error {
+	w.Header().Add("Vary", "Accept")
+
+	for _, enc := range negotiateEncoders(r.Header.Get("Accept")) {
+		body, err := enc.marshal(data)
+		if errors.Is(err, errNotList) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		writeBody(w, status, enc.mediaType, body, headers)
+		return nil
+	}
+
+	// Not reached: negotiateEncoders always ends with JSON, which can write any
+	// envelope.
+	return errNotList
+}
+
+// readRequest decodes a request body in the format named by its Content-Type header
+// into dst. XML and MessagePack bodies are converted to JSON and then go through the
+// same checks as JSON bodies (see readJSON); anything else is read as JSON.
+func (app *application) readRequest(w http.ResponseWriter, r *http.Request, dst any) error {
+	enc := requestEncoder(r.Header.Get("Content-Type"))
+	if enc == nil {
+		return app.readJSON(w, r, dst)
+	}
+
+	body, err := app.requestBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	v, err := enc.decode(body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		switch {
+		case errors.As(err, &maxBytesError):
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+		case isGzipError(err):
+			return errors.New("body is not valid gzip")
+		default:
+			return err
+		}
+	}
+
+	js, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return decodeJSON(bytes.NewReader(js), dst)
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/msgpack"
+)
+
+func TestNegotiateEncoders(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json, application/xml, text/csv, application/msgpack"},
+		{"application/xml", "application/xml, application/json"},
+		{"text/xml", "application/xml, application/json"},
+		{"application/x-msgpack", "application/msgpack, application/json"},
+		{"text/html", "application/json"},
+		{"text/*", "text/csv, application/json"},
+		{"application/json;q=0.5, application/xml", "application/xml, application/json"},
+		{"application/*;q=0.1, application/msgpack", "application/msgpack, application/json, application/xml"},
+		{"*/*, application/xml;q=0", "application/json, text/csv, application/msgpack"},
+		{"application/xml;q=oops", "application/json"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.accept, func(t *testing.T) {
+			var got []string
+			for _, enc := range negotiateEncoders(tc.accept) {
+				got = append(got, enc.mediaType)
+			}
+			assert.Equal(t, strings.Join(got, ", "), tc.want)
+		})
+	}
+}
+
+func TestMsgpack(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+		hex   string
+	}{
+		{"nil", nil, "c0"},
+		{"bool", true, "c3"},
+		{"fixint", json.Number("5"), "05"},
+		{"negative fixint", json.Number("-1"), "ff"},
+		{"uint8", json.Number("200"), "ccc8"},
+		{"int16", json.Number("-300"), "d1fed4"},
+		{"uint32", json.Number("70000"), "ce00011170"},
+		{"float", json.Number("1.5"), "cb3ff8000000000000"},
+		{"fixstr", "hi", "a26869"},
+		{"str8", strings.Repeat("a", 32), "d920" + strings.Repeat("61", 32)},
+		{"array", []any{json.Number("1"), "a"}, "9201a161"},
+		{"map", map[string]any{"b": json.Number("2"), "a": json.Number("1")}, "82a16101a16202"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := msgpack.Marshal(tc.value)
+			assert.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(b), tc.hex)
+
+			v, err := msgpack.Unmarshal(b)
+			assert.NoError(t, err)
+
+			want, _ := json.Marshal(tc.value)
+			got, _ := json.Marshal(v)
+			assert.Equal(t, string(got), string(want))
+		})
+	}
+
+	for _, invalid := range []string{"", "92", "dc", "c1", "81a16101ff", "0101", "dd7fffffff", strings.Repeat("91", 200) + "c0"} {
+		b, _ := hex.DecodeString(invalid)
+		_, err := msgpack.Unmarshal(b)
+		if err == nil {
+			t.Errorf("Unmarshal(%s): expected an error", invalid)
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	app := newTestApplication()
+
+	list := envelope{"clients": []map[string]any{
+		{"ip": "192.0.2.1", "tokens": 3.5, "banned": false},
+		{"ip": "192.0.2.2", "tokens": 1, "note": "a, \"quoted\" value"},
+	}}
+
+	write := func(accept string, env envelope) (http.Header, string) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept", accept)
+		w := httptest.NewRecorder()
+
+		err := app.writeResponse(w, r, http.StatusOK, env, nil)
+		assert.NoError(t, err)
+		return w.Header(), w.Body.String()
+	}
+
+	header, body := write("", envelope{"points": 28})
+	assert.Equal(t, header.Get("Content-Type"), "application/json")
+	assert.Equal(t, header.Get("Vary"), "Accept")
+	assert.Equal(t, body, `{"points":28}`)
+
+	header, body = write("application/xml", envelope{"points": 28, "request_id": "abc", "errors": map[string]string{"total": "must be provided", "1st": "<bad>"}})
+	assert.Equal(t, header.Get("Content-Type"), "application/xml")
+	assert.Equal(t, body, `<?xml version="1.0" encoding="UTF-8"?>`+"\n"+
+		`<response><errors><entry key="1st">&lt;bad&gt;</entry><total>must be provided</total></errors><points>28</points><request_id>abc</request_id></response>`)
+
+	header, body = write("text/csv", list)
+	assert.Equal(t, header.Get("Content-Type"), "text/csv")
+	assert.Equal(t, body, "banned,ip,note,tokens\nfalse,192.0.2.1,,3.5\n,192.0.2.2,\"a, \"\"quoted\"\" value\",1\n")
+
+	// CSV can only hold lists, so anything else falls back to the next choice.
+	header, body = write("text/csv, application/xml;q=0.5", envelope{"points": 28})
+	assert.Equal(t, header.Get("Content-Type"), "application/xml")
+
+	header, body = write("text/csv", envelope{"points": 28})
+	assert.Equal(t, header.Get("Content-Type"), "application/json")
+	assert.Equal(t, body, `{"points":28}`)
+
+	header, body = write("application/msgpack", envelope{"points": 28})
+	assert.Equal(t, header.Get("Content-Type"), "application/msgpack")
+	assert.Equal(t, hex.EncodeToString([]byte(body)), "81a6706f696e7473"+"1c")
+}
+
+func TestContentNegotiation(t *testing.T) {
+	app := newTestApplication()
+	app.model = data.NewModels()
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	do := func(method, path string, header map[string]string, body []byte) (*http.Response, []byte) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		b, err := io.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs, b
+	}
+
+	xmlReceipt := `<?xml version="1.0"?>
+<receipt>
+	<retailer>Target</retailer>
+	<purchaseDate>2022-01-01</purchaseDate>
+	<purchaseTime>13:01</purchaseTime>
+	<items>
+		<item><shortDescription>Mountain Dew 12PK</shortDescription><price>6.49</price></item>
+	</items>
+	<total>6.49</total>
+</receipt>`
+
+	// An XML receipt, with the ID sent back as XML.
+	rs, body := do(http.MethodPost, "/receipts/process", map[string]string{"Content-Type": "application/xml", "Accept": "application/xml"}, []byte(xmlReceipt))
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.Header.Get("Content-Type"), "application/xml")
+	assert.Contains(t, string(body), "<response><id>")
+
+	// The same receipt in MessagePack.
+	receipt, err := msgpack.Marshal(map[string]any{
+		"retailer":     "Target",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "13:01",
+		"items":        []any{map[string]any{"shortDescription": "Mountain Dew 12PK", "price": "6.49"}},
+		"total":        "6.49",
+	})
+	assert.NoError(t, err)
+
+	rs, body = do(http.MethodPost, "/receipts/process", map[string]string{"Content-Type": "application/msgpack", "Accept": "application/msgpack"}, receipt)
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.Header.Get("Content-Type"), "application/msgpack")
+
+	v, err := msgpack.Unmarshal(body)
+	assert.NoError(t, err)
+	id, _ := v.(map[string]any)["id"].(string)
+
+	rs, body = do(http.MethodGet, "/receipts/"+id+"/points", map[string]string{"Accept": "application/xml"}, nil)
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Contains(t, string(body), "<points>")
+
+	// Error envelopes follow the Accept header too.
+	rs, body = do(http.MethodPost, "/receipts/process", map[string]string{"Content-Type": "application/xml", "Accept": "application/xml"}, []byte("<receipt><retailer>"))
+	assert.Equal(t, rs.StatusCode, http.StatusBadRequest)
+	assert.Equal(t, rs.Header.Get("Content-Type"), "application/xml")
+	assert.Contains(t, string(body), "<description>The receipt is invalid</description>")
+}
+
+func TestReadRequest(t *testing.T) {
+	type TestStruct struct {
+		Name  string   `json:"name"`
+		Tags  []string `json:"tags"`
+		Count int      `json:"count"`
+	}
+
+	app := newTestApplication()
+
+	read := func(contentType string, body []byte) (TestStruct, error) {
+		r := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+
+		var dst TestStruct
+		err := app.readRequest(httptest.NewRecorder(), r, &dst)
+		return dst, err
+	}
+
+	got, err := read("application/xml; charset=utf-8", []byte(`<x><name>test</name><tags><item>a</item></tags></x>`))
+	assert.NoError(t, err)
+	assert.Equal(t, got.Name, "test")
+	assert.Equal(t, strings.Join(got.Tags, ","), "a")
+
+	got, err = read("text/xml", []byte(`<x><name>test</name><tags>a</tags><tags>b</tags></x>`))
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(got.Tags, ","), "a,b")
+
+	b, _ := msgpack.Marshal(map[string]any{"name": "test", "count": json.Number("3")})
+	got, err = read("application/msgpack", b)
+	assert.NoError(t, err)
+	assert.Equal(t, got.Count, 3)
+
+	// Requests without a recognised Content-Type are read as JSON.
+	got, err = read("text/plain", []byte(`{"name": "test"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, got.Name, "test")
+
+	failures := []struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		{"application/xml", ``, "body must not be empty"},
+		{"application/xml", `<x><name>test</x>`, "body contains badly-formed XML (on line 1)"},
+		{"application/xml", `<x><name>test</name>`, "body contains badly-formed XML (on line 1)"},
+		{"application/xml", `<x/><y/>`, "body must only contain a single XML element"},
+		{"application/xml", `<x><extra>1</extra></x>`, `body contains unknown key "extra"`},
+		{"application/xml", strings.Repeat("<x>", 40), "body must not be nested more than 32 levels deep"},
+		{"application/xml", `<x><name>` + strings.Repeat("a", 1_048_577) + `</name></x>`, "body must not be larger than 1048576 bytes"},
+		{"application/msgpack", ``, "body must not be empty"},
+		{"application/msgpack", "\x81\xa4name", "body contains badly-formed MessagePack"},
+	}
+
+	for _, tc := range failures {
+		_, err := read(tc.contentType, []byte(tc.body))
+		if err == nil {
+			t.Errorf("%s %.20q: expected an error", tc.contentType, tc.body)
+			continue
+		}
+		assert.Equal(t, err.Error(), tc.want)
+	}
+}
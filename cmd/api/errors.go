@@ -1,8 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 )
 
 // logError logs an error message along with details of the current HTTP request.
@@ -11,7 +15,7 @@ func (app *application) logError(r *http.Request, err error) {
 		method = r.Method
 		uri    = r.URL.RequestURI()
 	)
-	app.logger.Error(err.Error(), "method", method, "uri", uri)
+	app.logger.ErrorContext(r.Context(), err.Error(), "method", method, "uri", uri)
 }
 
 // errorResponse is a helper method for sending JSON-formatted error messages to the client.
@@ -23,9 +27,16 @@ func (app *application) logError(r *http.Request, err error) {
 //   - message: The error message to include in the response. This uses the `any` type
 //     for flexibility, allowing various data types to be included in the error message.
 func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message any) {
-	// If writeJSON failed, fall back to sending the client empty response with 500 Internal
+	// If writeResponse failed, fall back to sending the client empty response with 500 Internal
 	// Server Error status code.
-	err := app.writeJSON(w, status, envelope{"description": message}, nil)
+	env := envelope{"description": message}
+
+	// Include the request ID so a client's report can be matched to the server logs.
+	if id := contextGetRequestID(r.Context()); id != "" {
+		env["request_id"] = id
+	}
+
+	err := app.writeResponse(w, r, status, env, nil)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
@@ -66,3 +77,115 @@ func (app *application) rateLimitExceededResponse(w http.ResponseWriter, r *http
 	message := "rate limit exceeded"
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
+
+// 403 Forbidden response for clients whose network is not allowed by the IP rules
+func (app *application) forbiddenNetworkResponse(w http.ResponseWriter, r *http.Request) {
+	message := "access to this resource is not allowed from your network"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// 429 Too Many Requests response for clients temporarily banned by the abuse tracker
+func (app *application) clientBannedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+
+	message := "too many invalid submissions, please retry later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
+// 401 Unauthorized response for missing or invalid admin credentials
+func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+
+	message := "invalid or missing authentication token"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// 401 Unauthorized response for partner requests with a missing or invalid signature
+func (app *application) invalidSignatureResponse(w http.ResponseWriter, r *http.Request, err error) {
+	app.errorResponse(w, r, http.StatusUnauthorized, err.Error())
+}
+
+// reloadFailedResponse reports a config reload that failed and was rolled back.
+func (app *application) reloadFailedResponse(w http.ResponseWriter, r *http.Request, err error) {
+	message := fmt.Sprintf("the configuration was not reloaded: %s", err.Error())
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, message)
+}
+
+// insufficientScopeResponse is sent when an admin token is valid but doesn't grant the
+// scope the route needs.
+func (app *application) insufficientScopeResponse(w http.ResponseWriter, r *http.Request, scope string) {
+	w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, scope))
+
+	message := fmt.Sprintf("this token does not grant the %q scope", scope)
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+// failedValidationResponse is sent with the validator's errors when a request body is
+// well formed but holds invalid values.
+func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+}
+
+// contextErrorResponse is sent when a request's context ends before its handler is
+// done: 504 Gateway Timeout if the route's deadline passed, and 503 Service Unavailable
+// if the request was cancelled.
+func (app *application) contextErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, context.DeadlineExceeded) {
+		message := "the server did not finish processing the request in time"
+		app.errorResponse(w, r, http.StatusGatewayTimeout, message)
+		return
+	}
+
+	message := "the request was cancelled before it could be processed"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// isContextError reports whether err means the request's context ended.
+func isContextError(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled)
+}
+
+// 409 Conflict response for an update that lost a race with another update of the
+// same record
+func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
+	message := "unable to update the record due to an edit conflict, please try again"
+	app.errorResponse(w, r, http.StatusConflict, message)
+}
+
+// 412 Precondition Failed response for a change conditional on an If-Match header
+// that no longer matches the record
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the record has changed since it was read, please fetch it again"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, message)
+}
+
+// 503 Service Unavailable response for requests shed by the concurrency limiter
+func (app *application) overloadedResponse(w http.ResponseWriter, r *http.Request, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+
+	message := "the server is overloaded, please retry later"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// 503 Service Unavailable response for requests the service mode doesn't allow. The
+// operator's message, if any, says why.
+func (app *application) serviceUnavailableResponse(w http.ResponseWriter, r *http.Request, mode, reason string, retryAfter time.Duration) {
+	setRetryAfter(w, retryAfter)
+
+	message := "the service is down for maintenance"
+	if mode == modeReadOnly {
+		message = "the service is in read-only mode and is not accepting changes"
+	}
+	if reason != "" {
+		message += ": " + reason
+	}
+
+	app.errorResponse(w, r, http.StatusServiceUnavailable, message)
+}
+
+// setRetryAfter sets the Retry-After header in whole seconds, rounded up so clients
+// never retry a fraction of a second too early.
+func setRetryAfter(w http.ResponseWriter, d time.Duration) {
+	seconds := int((d + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+}
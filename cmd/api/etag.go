@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"fetch.trungnng.github.io/internal/data"
+)
+
+// receiptETag returns the strong entity tag of a receipt's points as written by enc.
+// The points change only when the receipt is updated or the scoring rules change, so
+// the tag is made of the receipt version and the ruleset version, followed by the
+// format, as each format's body differs byte for byte. Version 3 of a receipt scored
+// by ruleset "1+a1b2c3d4" and sent as XML is tagged "v3.1+a1b2c3d4.xml".
+func (app *application) receiptETag(receipt *data.Receipt, enc *encoder) string {
+	return fmt.Sprintf(`"v%d.%s.%s"`, receipt.Version, app.rulesetVersion(), enc.name())
+}
+
+// identityETag strips the suffix the compress middleware adds to the tag of a
+// compressed response, such as "v3.1+a1b2c3d4.xml-gzip", giving the tag receiptETag
+// made.
+func identityETag(tag string) string {
+	for _, encoding := range []string{"gzip", "deflate"} {
+		if t, ok := strings.CutSuffix(tag, "-"+encoding+`"`); ok {
+			return t + `"`
+		}
+	}
+	return tag
+}
+
+// etagVersion returns the receipt version in an entity tag made by receiptETag, with
+// or without a compression suffix. Weak tags are rejected, as If-Match uses strong
+// comparison.
+func etagVersion(tag string) (int64, bool) {
+	tag, ok := strings.CutPrefix(identityETag(tag), `"v`)
+	if !ok {
+		return 0, false
+	}
+
+	version, _, ok := strings.Cut(tag, ".")
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(version, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+// noneMatch reports whether the request's If-None-Match header lets the response go
+// ahead, i.e. the client has no copy tagged etag. Weak tags match their strong
+// counterpart, and so do the tags of its compressed forms. A copy in another format
+// has another tag, so it doesn't match.
+func noneMatch(r *http.Request, etag string) bool {
+	for _, tag := range splitList(r.Header.Get("If-None-Match")) {
+		if tag == "*" || identityETag(strings.TrimPrefix(tag, "W/")) == etag {
+			return false
+		}
+	}
+	return true
+}
+
+// matchVersion checks the request's If-Match header against a stored receipt. It
+// returns the receipt version the request is conditional on, zero if it has no If-Match
+// header, and false if the header names none of the receipt's tags. Only the receipt
+// version is compared: a change to the scoring rules doesn't make an edit conflict.
+func matchVersion(r *http.Request, receipt *data.Receipt) (int64, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, true
+	}
+
+	for _, tag := range splitList(header) {
+		if tag == "*" {
+			return receipt.Version, true
+		}
+		if version, ok := etagVersion(tag); ok && version == receipt.Version {
+			return version, true
+		}
+	}
+	return 0, false
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net/http"
+
+	"fetch.trungnng.github.io/internal/health"
 )
 
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
@@ -13,9 +18,86 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		},
 	}
 
-	err := app.writeJSON(w, http.StatusOK, env, nil)
+	err := app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.logger.Error(err.Error())
 		http.Error(w, "The server encountered a problem and could not process your request", http.StatusInternalServerError)
 	}
 }
+
+// livezHandler reports that the process is up and able to serve requests. It doesn't
+// look at dependencies: a failing liveness probe gets the process restarted, which
+// won't fix an unreachable store.
+func (app *application) livezHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeResponse(w, r, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readyzHandler runs the readiness checks and responds with 503 Service Unavailable if
+// any of them fail or the server is shutting down.
+func (app *application) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ready, checks := app.health.Run(r.Context())
+
+	status := "ready"
+	if app.shuttingDown.Load() {
+		ready = false
+		status = "shutting_down"
+	} else if !ready {
+		status = "not_ready"
+	}
+
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	err := app.writeResponse(w, r, code, envelope{"status": status, "checks": checks}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// registerHealthChecks sets up the readiness checks:
+//
+//   - store: the receipt store answers.
+//   - rules: the configured IP rules, signing secrets and trust store are loaded.
+//   - queue: fewer than -health-max-in-flight requests are being served.
+func (app *application) registerHealthChecks() {
+	timeout := app.config.health.checkTimeout
+
+	app.health = health.New()
+
+	app.health.Register("store", timeout, func(ctx context.Context) error {
+		if app.model == nil || app.model.Receipts == nil {
+			return errors.New("receipt store not initialized")
+		}
+		app.model.Receipts.Len()
+		return nil
+	})
+
+	app.health.Register("rules", timeout, func(ctx context.Context) error {
+		if app.config.ipRules.file != "" && app.ipRules == nil {
+			return errors.New("IP rules not loaded")
+		}
+		if app.config.signing.secretsFile != "" && len(app.signingSecrets) == 0 {
+			return errors.New("no signing secrets loaded")
+		}
+		if app.config.trustStoreFile != "" && (app.trustStore == nil || app.trustStore.Retailers() == 0) {
+			return errors.New("trust store not loaded")
+		}
+		if app.attestations == nil {
+			return errors.New("no attestation keys loaded")
+		}
+		return nil
+	})
+
+	app.health.Register("queue", timeout, func(ctx context.Context) error {
+		limit := app.config.health.maxInFlight
+		if n := app.inFlight.Load(); limit > 0 && n >= limit {
+			return fmt.Errorf("%d requests in flight (limit %d)", n, limit)
+		}
+		return nil
+	})
+}
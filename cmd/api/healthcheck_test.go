@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/health"
+)
+
+func TestLivez(t *testing.T) {
+	app := newTestApplication()
+	app.shuttingDown.Store(true)
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	// Liveness doesn't depend on readiness.
+	code, _, body := ts.get(t, "/livez")
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, body, `{"status":"alive"}`)
+}
+
+func TestReadyz(t *testing.T) {
+	_, key, _ := ed25519.GenerateKey(nil)
+
+	app := newTestApplication()
+	app.config.health.checkTimeout = 50 * time.Millisecond
+	app.config.health.maxInFlight = 10
+
+	var err error
+	app.attestations, err = newAttestationSigner(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app.registerHealthChecks()
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	type response struct {
+		Status string          `json:"status"`
+		Checks []health.Result `json:"checks"`
+	}
+
+	readyz := func() (int, response) {
+		code, _, body := ts.get(t, "/readyz")
+
+		var res response
+		if err := json.Unmarshal([]byte(body), &res); err != nil {
+			t.Fatal(err)
+		}
+		return code, res
+	}
+
+	// The store isn't set up yet.
+	code, res := readyz()
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, res.Status, "not_ready")
+	assert.Equal(t, len(res.Checks), 3)
+	assert.Equal(t, res.Checks[2].Name, "store")
+	assert.Equal(t, res.Checks[2].Status, health.StatusFail)
+	assert.Equal(t, res.Checks[2].Error, "receipt store not initialized")
+
+	app.model = data.NewModels()
+
+	code, res = readyz()
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, res.Status, "ready")
+
+	// A check that hangs is cut off by its timeout.
+	app.health.Register("slow", app.config.health.checkTimeout, func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	code, res = readyz()
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, res.Checks[2].Name, "slow")
+	assert.Equal(t, res.Checks[2].Error, health.ErrTimeout.Error())
+
+	// Once shutdown starts, readiness fails regardless of the checks.
+	app.health = nil
+	app.shuttingDown.Store(true)
+
+	code, res = readyz()
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, res.Status, "shutting_down")
+}
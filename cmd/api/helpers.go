@@ -1,16 +1,22 @@
 package main
 
 import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"net"
 	"net/http"
 	"regexp"
 	"strings"
 
 	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/trust"
 	"github.com/julienschmidt/httprouter"
 )
 
@@ -53,18 +59,21 @@ func (app *application) writeJSON(
 		return err
 	}
 
+	writeBody(w, status, "application/json", js, headers)
+	return nil
+}
+
+// writeBody sends an encoded response body of the given content type.
+func writeBody(w http.ResponseWriter, status int, contentType string, body []byte, headers http.Header) {
 	// Add response's headers
 	for key, value := range headers {
 		w.Header()[key] = value
 	}
 
-	// Add the "Content-Type: application/json" header, then write the status code and
-	// JSON response.
-	w.Header().Set("Content-Type", "application/json")
+	// Add the Content-Type header, then write the status code and response.
+	w.Header().Set("Content-Type", contentType)
 	w.WriteHeader(status)
-	w.Write(js)
-
-	return nil
+	w.Write(body)
 }
 
 // readJSON reads and decodes a JSON request body into the specified destination `dst`.
@@ -83,15 +92,54 @@ func (app *application) writeJSON(
 //   - Unexpected data types in the JSON.
 //   - Unknown JSON fields.
 //   - Empty request bodies.
-//   - Oversized bodies
+//   - Oversized bodies, measured after decompression for gzip bodies.
+//   - Corrupt gzip bodies and unsupported content encodings.
 //   - Multiple JSON values.
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any) error {
+	body, err := app.requestBody(w, r)
+	if err != nil {
+		return err
+	}
+
+	return decodeJSON(body, dst)
+}
+
+// requestBody returns the request body, limited to 1MB and decompressed if it was
+// sent with Content-Encoding: gzip.
+func (app *application) requestBody(w http.ResponseWriter, r *http.Request) (io.Reader, error) {
 	// Limit the size of the request body to 1MB.
 	maxBytes := 1_048_576
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
 
+	// A gzip body is decompressed as it is decoded. The limit applies again to the
+	// decompressed stream, so a small body can't expand into an unbounded one.
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errors.New("body must not be empty")
+			}
+			return nil, errors.New("body is not valid gzip")
+		}
+		return http.MaxBytesReader(w, zr, int64(maxBytes)), nil
+	default:
+		return nil, fmt.Errorf("body has unsupported content encoding %q", encoding)
+	}
+}
+
+// isGzipError reports whether err means a gzip request body is corrupt.
+func isGzipError(err error) bool {
+	return errors.Is(err, gzip.ErrHeader) || errors.Is(err, gzip.ErrChecksum) || errors.As(err, new(flate.CorruptInputError))
+}
+
+// decodeJSON decodes a single JSON value from body into dst, mapping decoding errors
+// to messages for the client.
+func decodeJSON(body io.Reader, dst any) error {
 	// Initialize json.Decoder.
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 
 	// Decode() will now return error if JSON has unknown fields.
 	dec.DisallowUnknownFields()
@@ -127,6 +175,9 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 		case errors.As(err, &maxBytesError):
 			return fmt.Errorf("body must not be larger than %d bytes", maxBytesError.Limit)
 
+		case isGzipError(err):
+			return errors.New("body is not valid gzip")
+
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
 
@@ -140,6 +191,9 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	// return an io.EOF error. If we get any other error or nil then there is extra data
 	// so we return our own custom error message.
 	err = dec.Decode(&struct{}{})
+	if isGzipError(err) {
+		return errors.New("body is not valid gzip")
+	}
 	if !errors.Is(err, io.EOF) {
 		return errors.New("body must only contain a single JSON value")
 	}
@@ -147,8 +201,36 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst any
 	return nil
 }
 
-// calculatePoints calculates the total points for a given receipt
-func (app *application) calculatePoints(receipt *data.Receipt) int64 {
+// rulesetBaseVersion must be bumped whenever calculatePoints changes.
+const rulesetBaseVersion = "1"
+
+// actor identifies who is making the request, for the audit log. Verified identities
+// are preferred: a partner's signing key, then a client certificate, and finally the
+// client's IP address.
+func (app *application) actor(r *http.Request) string {
+	if partner := app.contextGetPartner(r); partner != "" {
+		return "partner:" + partner
+	}
+
+	if subject := app.contextGetClientCertSubject(r); subject != "" {
+		return "cert:" + subject
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	return "ip:" + ip
+}
+
+// calculatePoints calculates the total points for a given receipt. It stops early
+// with the context's error if the request is cancelled or past its deadline.
+func (app *application) calculatePoints(ctx context.Context, receipt *data.Receipt) (int64, error) {
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
 	var totalPoints int64
 
 	// One point for every alphanumeric character in the retailer name.
@@ -174,6 +256,11 @@ func (app *application) calculatePoints(receipt *data.Receipt) int64 {
 
 	// Points for items with descriptions that are multiples of 3 in length.
 	for _, item := range receipt.Items {
+		err := ctx.Err()
+		if err != nil {
+			return 0, err
+		}
+
 		trimmedDesc := strings.TrimSpace(item.ShortDescription)
 		if len(trimmedDesc)%3 == 0 {
 			points := math.Ceil(float64(item.Price) * 0.2)
@@ -192,7 +279,23 @@ func (app *application) calculatePoints(receipt *data.Receipt) int64 {
 		totalPoints += 10
 	}
 
-	return totalPoints
+	// Bonus points if the retailer's signature on the receipt was verified.
+	if receipt.SignatureStatus == string(trust.Verified) {
+		totalPoints += app.currentConfig().rules.verifiedBonus
+	}
+
+	return totalPoints, nil
+}
+
+// rulesetVersion identifies the scoring rules in effect. It changes whenever the
+// scoring logic (rulesetBaseVersion) or any rule parameter changes, so a points value
+// can always be tied to the rules that produced it.
+func (app *application) rulesetVersion() string {
+	rules := app.currentConfig().rules
+	params := fmt.Sprintf("verifiedBonus=%d;requireVerified=%t", rules.verifiedBonus, rules.requireVerified)
+	sum := sha256.Sum256([]byte(params))
+
+	return fmt.Sprintf("%s+%x", rulesetBaseVersion, sum[:4])
 }
 
 // isAlphanumeric checks if a rune is an alphanumeric character.
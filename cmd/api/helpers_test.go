@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/json"
 	"io"
 	"net/http"
@@ -127,6 +128,59 @@ func TestReadJSON(t *testing.T) {
 	}
 }
 
+func TestReadJSONCompressed(t *testing.T) {
+	type TestStruct struct {
+		Name string `json:"name"`
+	}
+
+	gzipped := func(body string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(body))
+		zw.Close()
+		return buf.String()
+	}
+
+	// Two megabytes of JSON compress to a few kilobytes.
+	bomb := gzipped(`{"name": "` + strings.Repeat("a", 2_097_152) + `"}`)
+
+	tests := []struct {
+		name        string
+		encoding    string
+		body        string
+		expectedErr string
+	}{
+		{"Gzip", "gzip", gzipped(`{"name": "test"}`), ""},
+		{"Identity", "identity", `{"name": "test"}`, ""},
+		{"Decompression Bomb", "gzip", bomb, "body must not be larger than 1048576 bytes"},
+		{"Not Gzip", "gzip", `{"name": "test"}`, "body is not valid gzip"},
+		{"Empty Gzip", "gzip", "", "body must not be empty"},
+		{"Unsupported Encoding", "br", `{"name": "test"}`, `body has unsupported content encoding "br"`},
+	}
+
+	app := newTestApplication()
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(tc.body))
+			req.Header.Set("Content-Encoding", tc.encoding)
+			w := httptest.NewRecorder()
+
+			var result TestStruct
+			err := app.readJSON(w, req, &result)
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+				assert.Equal(t, result.Name, "test")
+			} else {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				assert.Equal(t, err.Error(), tc.expectedErr)
+			}
+		})
+	}
+}
+
 func TestCalculatePoints(t *testing.T) {
 	// Create a test app with a reciept model dependency.
 	app := newTestApplication()
@@ -180,7 +234,8 @@ func TestCalculatePoints(t *testing.T) {
 
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
-			actual := app.calculatePoints(tc.receipt)
+			actual, err := app.calculatePoints(t.Context(), tc.receipt)
+			assert.NoError(t, err)
 			assert.Equal(t, tc.expected, actual)
 		})
 	}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+)
+
+// IP rule groups. Each route is assigned to one group in routes() and the rules file
+// holds a separate policy per group.
+const (
+	ipGroupReceiptsWrite = "receipts.write"
+	ipGroupReceiptsRead  = "receipts.read"
+	ipGroupSystem        = "system"
+)
+
+// watchIPRules starts a background goroutine which polls the IP rules file and reloads
+// it when its modification time changes. A file that fails to parse is logged and the
+// previous rules stay in effect.
+func (app *application) watchIPRules() {
+	if app.ipRules == nil || app.config.ipRules.reloadInterval <= 0 {
+		return
+	}
+
+	app.background("ip_rules", func(ctx context.Context) {
+		for sleep(ctx, app.config.ipRules.reloadInterval) {
+			reloaded, err := app.ipRules.ReloadIfChanged()
+			if err != nil {
+				app.logger.Error("failed to reload IP rules", "file", app.config.ipRules.file, "error", err.Error())
+				continue
+			}
+
+			if reloaded {
+				app.logger.Info("reloaded IP rules", "file", app.config.ipRules.file)
+			}
+		}
+	})
+}
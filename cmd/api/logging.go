@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"fetch.trungnng.github.io/internal/logging"
+	"fetch.trungnng.github.io/internal/tracing"
+)
+
+// newLogger builds the application logger from the -log-* settings. The returned
+// LevelVar changes the minimum level at runtime, and the closer releases the log file
+// (it is a no-op for stdout and stderr).
+func newLogger(cfg config) (*slog.Logger, *slog.LevelVar, io.Closer, error) {
+	level := new(slog.LevelVar)
+
+	err := level.UnmarshalText([]byte(cfg.log.level))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("invalid log level %q (must be debug, info, warn or error)", cfg.log.level)
+	}
+
+	var out io.Writer
+	var closer io.Closer = io.NopCloser(nil)
+
+	switch cfg.log.output {
+	case "", "stdout":
+		out = os.Stdout
+	case "stderr":
+		out = os.Stderr
+	default:
+		f, err := logging.OpenRotatingFile(cfg.log.output, int64(cfg.log.maxSize)<<20, cfg.log.maxBackups)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		out, closer = f, f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+
+	var handler slog.Handler
+	switch cfg.log.format {
+	case "text":
+		handler = slog.NewTextHandler(out, opts)
+	case "json":
+		handler = slog.NewJSONHandler(out, opts)
+	default:
+		closer.Close()
+		return nil, nil, nil, fmt.Errorf("invalid log format %q (must be text or json)", cfg.log.format)
+	}
+
+	// Redaction sits below the context handler so it also sees the attributes that
+	// handler adds.
+	handler = logging.NewRedactHandler(handler, splitList(cfg.log.redact))
+
+	return slog.New(newContextHandler(handler)), level, closer, nil
+}
+
+// contextHandler is a slog.Handler which adds request-scoped attributes from the
+// context, such as the request ID and the trace and span IDs, to every record logged
+// with one of the logger's *Context methods.
+type contextHandler struct {
+	slog.Handler
+}
+
+func newContextHandler(h slog.Handler) *contextHandler {
+	return &contextHandler{Handler: h}
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := contextGetRequestID(ctx); id != "" {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+
+	if span := tracing.SpanFromContext(ctx); span != nil {
+		sc := span.SpanContext()
+		record.AddAttrs(
+			slog.String("trace_id", sc.TraceID.String()),
+			slog.String("span_id", sc.SpanID.String()),
+		)
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
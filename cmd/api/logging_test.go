@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/logging"
+)
+
+func TestNewLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	var cfg config
+	cfg.log.format = "json"
+	cfg.log.level = "warn"
+	cfg.log.output = path
+	cfg.log.redact = "client_ip,Receipt"
+
+	logger, level, closer, err := newLogger(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	logger.Info("dropped")
+	logger.With("receipt", "{...}").Warn("kept", "client_ip", "192.0.2.1", "status", 400)
+
+	level.Set(slog.LevelDebug)
+	logger.Debug("debug", slog.Group("request", "client_ip", "192.0.2.2"))
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Equal(t, len(lines), 2)
+
+	var line map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &line); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal[any](t, line["msg"], "kept")
+	assert.Equal[any](t, line["receipt"], logging.RedactedValue)
+	assert.Equal[any](t, line["client_ip"], logging.RedactedValue)
+	assert.Equal[any](t, line["status"], 400.0)
+
+	assert.Contains(t, lines[1], `"request":{"client_ip":"[REDACTED]"}`)
+}
+
+func TestNewLoggerValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		format   string
+		level    string
+		expected string
+	}{
+		{"Invalid format", "xml", "info", "invalid log format"},
+		{"Invalid level", "text", "verbose", "invalid log level"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var cfg config
+			cfg.log.format = tc.format
+			cfg.log.level = tc.level
+
+			_, _, _, err := newLogger(cfg)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.log")
+
+	rf, err := logging.OpenRotatingFile(path, 20, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	// Each write is 10 bytes, so every second write rotates the file.
+	for i := range 7 {
+		fmt.Fprintf(rf, "line %04d\n", i)
+	}
+
+	read := func(name string) string {
+		b, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	assert.Equal(t, read(path), "line 0006\n")
+	assert.Equal(t, read(path+".1"), "line 0004\nline 0005\n")
+	assert.Equal(t, read(path+".2"), "line 0002\nline 0003\n")
+
+	_, err = os.Stat(path + ".3")
+	assert.Equal(t, os.IsNotExist(err), true)
+}
@@ -1,11 +1,25 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"expvar"
 	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"fetch.trungnng.github.io/internal/abuse"
+	"fetch.trungnng.github.io/internal/audit"
+	"fetch.trungnng.github.io/internal/concurrency"
 	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/health"
+	"fetch.trungnng.github.io/internal/ipfilter"
+	"fetch.trungnng.github.io/internal/tracing"
+	"fetch.trungnng.github.io/internal/trust"
 )
 
 // Application version number
@@ -13,50 +27,341 @@ const version = "1.0.0"
 
 // Configuration settings for application.
 type config struct {
-	port    int
-	env     string
+	file string
+	// ignoredEnv lists the FETCH_* environment variables that match no setting.
+	ignoredEnv []string
+	port       int
+	env        string
+	listen     struct {
+		socket     string
+		socketMode string
+		h2c        bool
+	}
+	cors struct {
+		trustedOrigins   string
+		allowedMethods   string
+		allowedHeaders   string
+		allowCredentials bool
+		maxAge           time.Duration
+	}
+	hstsMaxAge  time.Duration
+	compression struct {
+		enabled bool
+		minSize int
+	}
 	limiter struct {
 		rps     float64
 		burst   int
 		enabled bool
 	}
+	ipRules struct {
+		file           string
+		reloadInterval time.Duration
+	}
+	abuse struct {
+		enabled     bool
+		threshold   float64
+		minSamples  float64
+		banDuration time.Duration
+		halfLife    time.Duration
+	}
+	timeout struct {
+		read  time.Duration
+		write time.Duration
+	}
+	shed struct {
+		enabled      bool
+		initialLimit int
+		minLimit     int
+		maxLimit     int
+		queueSize    int
+		queueTimeout time.Duration
+		retryAfter   time.Duration
+	}
+	admin struct {
+		addr       string
+		token      string
+		tokensFile string
+		debug      bool
+	}
+	tls struct {
+		certFile       string
+		keyFile        string
+		minVersion     string
+		cipherSuites   string
+		clientCAFile   string
+		clientAuth     string
+		reloadInterval time.Duration
+	}
+	signing struct {
+		secretsFile string
+		required    bool
+		tolerance   time.Duration
+	}
+	trustStoreFile string
+	attestKeyFiles string
+	auditLogFile   string
+	trace          struct {
+		exporter string
+		file     string
+	}
+	rules struct {
+		verifiedBonus   int64
+		requireVerified bool
+	}
+	service struct {
+		mode       string
+		message    string
+		retryAfter time.Duration
+	}
+	log struct {
+		format     string
+		level      string
+		output     string
+		maxSize    int
+		maxBackups int
+		redact     string
+	}
+	health struct {
+		checkTimeout time.Duration
+		maxInFlight  int64
+	}
+	shutdown struct {
+		drainDelay     time.Duration
+		upgradeTimeout time.Duration
+	}
 }
 
 // Hold the dependencies for HTTP handlers, helpers, middleware
 type application struct {
-	config config
-	logger *slog.Logger
-	model  *data.Models
+	// config is read without locking except for the settings a reload can change,
+	// which go through currentConfig. configArgs and configFlags are what the server
+	// was started with, for reloadConfig. overrides are the settings changed through
+	// the admin API, which a reload keeps; they are guarded by configMu too.
+	configMu    sync.RWMutex
+	config      config
+	configArgs  []string
+	configFlags *flag.FlagSet
+	overrides   configOverrides
+
+	logger   *slog.Logger
+	logLevel *slog.LevelVar
+	model    *data.Models
+	ipRules  *ipfilter.Filter
+	abuse    *abuse.Tracker
+
+	// Adaptive concurrency limiters, keyed on route class. Nil when load shedding is
+	// disabled.
+	shedders map[string]*concurrency.Limiter
+
+	// Scoped bearer tokens for the admin listener, in addition to the admin token.
+	adminTokens []adminToken
+
+	// Shared HMAC secrets of partners that sign their requests, keyed on key ID, and
+	// the nonces they have used. Nonces are shared by all signed routes, so a request
+	// can't be replayed against another route.
+	signingSecrets map[string][]byte
+	nonces         *nonceCache
+
+	// Public keys used to check retailers' digitally signed receipts.
+	trustStore *trust.Store
+
+	// Keys used to sign points attestations.
+	attestations *attestationSigner
+
+	metrics *appMetrics
+	tracer  *tracing.Tracer
+
+	// Readiness checks, and the state they look at. shuttingDown is set as soon as a
+	// termination signal arrives.
+	health       *health.Registry
+	shuttingDown atomic.Bool
+	inFlight     atomic.Int64
+
+	// Debug variables: background goroutines per subsystem and the number of clients
+	// tracked by the rate limiter.
+	goroutines     expvar.Map
+	limiterClients atomic.Int64
+
+	// Background goroutines get backgroundCtx, which stopBackground cancels once the
+	// server has shut down.
+	backgroundCtx  context.Context
+	stopBackground context.CancelFunc
 }
 
 func main() {
-	var cfg config
+	// Settings come from defaults, an optional config file, FETCH_* environment
+	// variables and command-line flags, in increasing order of precedence.
+	fs := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
+	printConfig := fs.Bool("print-config", false, "Print the effective configuration, with secrets redacted, and exit")
+
+	cfg, err := loadConfig(fs, os.Args[1:], os.Environ())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *printConfig {
+		err = writeConfig(os.Stdout, fs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Create new structured logger from the -log-* flags.
+	// The context handler adds trace IDs to lines logged with a request context.
+	logger, logLevel, logCloser, err := newLogger(cfg)
+	if err != nil {
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+	defer logCloser.Close()
 
-	// Default port number 4000 and the environment "development"
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+	if len(cfg.ignoredEnv) > 0 {
+		logger.Warn("ignoring environment variables that match no setting", "variables", cfg.ignoredEnv)
+	}
+
+	var ipRules *ipfilter.Filter
+	if cfg.ipRules.file != "" {
+		f, err := ipfilter.Load(cfg.ipRules.file)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		ipRules = f
+	}
+
+	var adminTokens []adminToken
+	if cfg.admin.tokensFile != "" {
+		tokens, err := loadAdminTokens(cfg.admin.tokensFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		adminTokens = tokens
+	}
+
+	var signingSecrets map[string][]byte
+	if cfg.signing.secretsFile != "" {
+		secrets, err := loadSigningSecrets(cfg.signing.secretsFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		signingSecrets = secrets
+	}
+
+	trustStore := trust.New()
+	if cfg.trustStoreFile != "" {
+		store, err := trust.Load(cfg.trustStoreFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		trustStore = store
+	}
 
-	// Create command line flags to read the setting values into the config struct.
-	// Notice that we use true as the default for the 'enabled' setting?
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+	attestKeys, err := loadAttestationKeys(splitList(cfg.attestKeyFiles))
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+	if len(attestKeys) == 0 {
+		// Without configured keys, sign with a key that only lives as long as the
+		// process. Attestations can't be verified after a restart.
+		_, key, err := ed25519.GenerateKey(nil)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		attestKeys = append(attestKeys, key)
+		logger.Warn("no attestation keys configured, using an ephemeral key")
+	}
 
-	flag.Parse()
+	attestations, err := newAttestationSigner(attestKeys...)
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
 
-	// Create new structured logger to standard out
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	models := data.NewModels()
+	models.Receipts.AuditLog = audit.New()
+	if cfg.auditLogFile != "" {
+		auditLog, err := audit.Open(cfg.auditLogFile)
+		if err != nil {
+			logger.Error(err.Error())
+			os.Exit(1)
+		}
+		defer auditLog.Close()
+		models.Receipts.AuditLog = auditLog
+	}
 
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		model:  data.NewModels(),
+		config:      cfg,
+		configArgs:  os.Args[1:],
+		configFlags: fs,
+		logger:      logger,
+		logLevel:    logLevel,
+		model:       models,
+		ipRules:     ipRules,
+
+		adminTokens:    adminTokens,
+		signingSecrets: signingSecrets,
+		trustStore:     trustStore,
+		attestations:   attestations,
+	}
+	app.backgroundCtx, app.stopBackground = context.WithCancel(context.Background())
+
+	if cfg.abuse.enabled {
+		app.abuse = abuse.New(abuse.Config{
+			Threshold:   cfg.abuse.threshold,
+			MinSamples:  cfg.abuse.minSamples,
+			BanDuration: cfg.abuse.banDuration,
+			HalfLife:    cfg.abuse.halfLife,
+		})
+
+		// Periodically drop clients whose penalties have decayed away.
+		app.background("abuse", func(ctx context.Context) {
+			for sleep(ctx, time.Minute) {
+				app.abuse.Sweep()
+			}
+		})
+	}
+
+	if signingSecrets != nil {
+		app.nonces = newNonceCache()
+
+		// Remove expired nonces once every minute.
+		app.background("signing", func(ctx context.Context) {
+			for sleep(ctx, time.Minute) {
+				app.nonces.sweep()
+			}
+		})
+	}
+
+	if cfg.shed.enabled {
+		app.shedders = newShedders(cfg)
 	}
 
+	app.metrics = app.newMetrics()
+
+	app.tracer, err = app.newTracer()
+	if err != nil {
+		logger.Error(err.Error())
+		os.Exit(1)
+	}
+
+	app.registerHealthChecks()
+
+	// Pick up edits to the IP rules file without a restart.
+	app.watchIPRules()
+
 	// Call app.serve() to start the server.
-	err := app.serve()
+	err = app.serve()
 	if err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"fetch.trungnng.github.io/internal/metrics"
+	"github.com/julienschmidt/httprouter"
+)
+
+// appMetrics holds the application's Prometheus metrics.
+type appMetrics struct {
+	registry *metrics.Registry
+
+	requests           *metrics.CounterVec
+	requestDuration    *metrics.HistogramVec
+	rateLimitRejected  *metrics.CounterVec
+	validationFailures *metrics.CounterVec
+	pointsAwarded      *metrics.HistogramVec
+	concurrencyLimit   *metrics.GaugeVec
+	concurrencyActive  *metrics.GaugeVec
+	queueLength        *metrics.GaugeVec
+	queueWait          *metrics.HistogramVec
+	shed               *metrics.CounterVec
+}
+
+// newMetrics creates and registers the application's metrics.
+func (app *application) newMetrics() *appMetrics {
+	registry := metrics.NewRegistry()
+
+	m := &appMetrics{
+		registry: registry,
+		requests: registry.NewCounterVec("http_requests_total",
+			"Total number of HTTP requests by method, route and status code.",
+			"method", "route", "status"),
+		requestDuration: registry.NewHistogramVec("http_request_duration_seconds",
+			"HTTP request latency in seconds by method and route.",
+			metrics.DefaultBuckets, "method", "route"),
+		rateLimitRejected: registry.NewCounterVec("rate_limit_rejections_total",
+			"Requests rejected by the rate limiter or the abuse tracker, by reason.",
+			"reason"),
+		validationFailures: registry.NewCounterVec("receipt_validation_failures_total",
+			"Receipt submissions that failed validation, by field.",
+			"field"),
+		pointsAwarded: registry.NewHistogramVec("receipt_points_awarded",
+			"Distribution of points awarded per receipt.",
+			[]float64{0, 10, 25, 50, 75, 100, 150, 250, 500, 1000}),
+		concurrencyLimit: registry.NewGaugeVec("concurrency_limit",
+			"Current adaptive limit on requests in flight, by route class.",
+			"class"),
+		concurrencyActive: registry.NewGaugeVec("concurrency_in_flight",
+			"Requests holding a concurrency slot, by route class.",
+			"class"),
+		queueLength: registry.NewGaugeVec("concurrency_queue_length",
+			"Requests waiting for a concurrency slot, by route class.",
+			"class"),
+		queueWait: registry.NewHistogramVec("concurrency_queue_wait_seconds",
+			"Time requests waited for a concurrency slot, by route class.",
+			metrics.DefaultBuckets, "class"),
+		shed: registry.NewCounterVec("load_shed_total",
+			"Requests shed by the concurrency limiter, by route class and priority.",
+			"class", "priority"),
+	}
+
+	registry.NewGaugeFunc("receipts_stored", "Number of receipts in the store.", func() float64 {
+		if app.model == nil {
+			return 0
+		}
+		return float64(app.model.Receipts.Len())
+	})
+
+	return m
+}
+
+// routePattern returns the route pattern matched by the request, such as
+// "/receipts/:id/points", so metrics aren't labelled with every receipt ID. Requests
+// that don't match a route are reported as "unmatched".
+func routePattern(router *httprouter.Router, r *http.Request) string {
+	handle, params, _ := router.Lookup(r.Method, r.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+
+	pattern := r.URL.Path
+	for _, p := range params {
+		pattern = strings.Replace(pattern, "/"+p.Value, "/:"+p.Key, 1)
+	}
+	return pattern
+}
+
+// metricMethods are the methods requests are labelled with in metrics. Any other is
+// reported as "other", so clients can't add label values by sending made-up methods.
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// metricMethod returns the method label for a request.
+func metricMethod(r *http.Request) string {
+	if metricMethods[r.Method] {
+		return r.Method
+	}
+	return "other"
+}
+
+// instrument is a middleware which records the count and latency of every request by
+// route and status code. It also tracks the number of requests in flight for the
+// readiness check.
+func (app *application) instrument(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.inFlight.Add(1)
+		defer app.inFlight.Add(-1)
+
+		start := time.Now()
+		route := routePattern(router, r)
+
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r)
+
+		method := metricMethod(r)
+		app.metrics.requests.With(method, route, strconv.Itoa(cw.status)).Inc()
+		app.metrics.requestDuration.With(method, route).Observe(time.Since(start).Seconds())
+	})
+}
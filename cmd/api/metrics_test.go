@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/metrics"
+)
+
+func TestMetricsRegistry(t *testing.T) {
+	registry := metrics.NewRegistry()
+
+	counter := registry.NewCounterVec("test_total", "A test counter.", "path")
+	counter.With(`/a"b`).Add(2)
+	counter.With("/c").Inc()
+
+	registry.NewGaugeFunc("test_gauge", "A test gauge.\nSecond line.", func() float64 { return 1.5 })
+
+	histogram := registry.NewHistogramVec("test_seconds", "A test histogram.", []float64{0.1, 1}, "route")
+	histogram.With("/x").Observe(0.05)
+	histogram.With("/x").Observe(0.5)
+	histogram.With("/x").Observe(5)
+
+	var b strings.Builder
+	assert.NoError(t, registry.WriteText(&b))
+
+	expected := `# HELP test_total A test counter.
+# TYPE test_total counter
+test_total{path="/a\"b"} 2
+test_total{path="/c"} 1
+# HELP test_gauge A test gauge.\nSecond line.
+# TYPE test_gauge gauge
+test_gauge 1.5
+# HELP test_seconds A test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{route="/x",le="0.1"} 1
+test_seconds_bucket{route="/x",le="1"} 2
+test_seconds_bucket{route="/x",le="+Inf"} 3
+test_seconds_sum{route="/x"} 5.55
+test_seconds_count{route="/x"} 3
+`
+	assert.Equal(t, b.String(), expected)
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	app := newTestApplication()
+	app.model = data.NewModels()
+
+	receipt := &data.Receipt{
+		ID:           "7fb1377b-b223-49d9-a31a-5a02701dd310",
+		Retailer:     "Target",
+		PurchaseDate: time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		PurchaseTime: time.Date(1, time.January, 1, 13, 1, 0, 0, time.UTC),
+		Items:        []*data.Item{{ShortDescription: "Mountain Dew 12PK", Price: 6.49}},
+		Total:        6.49,
+	}
+	if err := app.model.Receipts.Insert(t.Context(), "test", receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	app.config.admin.token = "secret"
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	admin := newTestServer(app.adminRoutes())
+	defer admin.Close()
+
+	ts.get(t, "/healthcheck")
+	ts.get(t, "/receipts/"+receipt.ID+"/points")
+	ts.get(t, "/nope")
+	ts.post(t, "/receipts/process", strings.NewReader(`{"retailer": "Target"}`))
+
+	req, err := http.NewRequest("BREW", ts.URL+"/healthcheck", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := ts.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs.Body.Close()
+
+	req, err = http.NewRequest(http.MethodGet, admin.URL+"/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer secret")
+
+	rs, err = admin.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	b, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := string(b)
+
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Contains(t, rs.Header.Get("Content-Type"), "text/plain; version=0.0.4")
+
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/healthcheck",status="200"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="/receipts/:id/points",status="200"} 1`)
+	assert.Contains(t, body, `http_requests_total{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="GET",route="/healthcheck"} 1`)
+	assert.Equal(t, strings.Contains(body, "BREW"), false)
+	assert.Contains(t, body, `http_request_duration_seconds_count{method="other",route="unmatched"} 1`)
+	assert.Contains(t, body, `receipt_validation_failures_total{field="total"} 1`)
+	assert.Contains(t, body, "receipts_stored 1")
+
+	// Metrics are only served on the admin listener.
+	status, _, _ := ts.get(t, "/metrics")
+	assert.Equal(t, status, http.StatusNotFound)
+}
@@ -1,12 +1,19 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"maps"
 	"net"
 	"net/http"
+	"net/netip"
+	"regexp"
 	"sync"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
 	"golang.org/x/time/rate"
 )
 
@@ -55,9 +62,8 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 	// Launch a background goroutine which removes old entries from the clients map once
 	// every minute.
-	go func() {
-		for {
-			time.Sleep(time.Minute)
+	app.background("rate_limiter", func(ctx context.Context) {
+		for sleep(ctx, time.Minute) {
 			mu.Lock()
 
 			// Loop through all clients. If they haven't been seen within the last three
@@ -67,35 +73,56 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 					delete(clients, ip)
 				}
 			}
+			app.limiterClients.Store(int64(len(clients)))
 
 			mu.Unlock()
 		}
-	}()
+	})
 
 	// Closure capture mu sync.Mutex and clients map[string]*client which are
 	// reference types which refer to the same mutex and clients map for
 	// all requests.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Only carry out the check if rate limiting is enabled.
-		if app.config.limiter.enabled {
+		// Only carry out the check if rate limiting is enabled. The limiter settings can
+		// change on a config reload, so they are read for every request. Unix socket
+		// peers can't be told apart, so they aren't limited.
+		limiter := app.currentConfig().limiter
+		if limiter.enabled && !fromUnixSocket(r) {
 			ip, _, err := net.SplitHostPort(r.RemoteAddr)
 			if err != nil {
 				app.serverErrorResponse(w, r, err)
 				return
 			}
 
+			limit := rate.Limit(limiter.rps)
+			burst := limiter.burst
+
+			// Clients with a history of invalid submissions get a reduced allowance.
+			if app.abuse != nil {
+				factor, _ := app.abuse.Check(ip)
+				limit *= rate.Limit(factor)
+				burst = max(1, int(float64(burst)*factor))
+			}
+
 			mu.Lock()
 
 			if _, found := clients[ip]; !found {
 				clients[ip] = &client{
-					limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst),
+					limiter: rate.NewLimiter(limit, burst),
 				}
+				app.limiterClients.Store(int64(len(clients)))
 			}
 
 			clients[ip].lastSeen = time.Now()
 
+			if clients[ip].limiter.Limit() != limit || clients[ip].limiter.Burst() != burst {
+				clients[ip].limiter.SetLimit(limit)
+				clients[ip].limiter.SetBurst(burst)
+			}
+
 			if !clients[ip].limiter.Allow() {
 				mu.Unlock()
+				app.metrics.rateLimitRejected.With("rate_limit").Inc()
 				app.rateLimitExceededResponse(w, r)
 				return
 			}
@@ -106,3 +133,315 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// ipFilter is a middleware that restricts a route group to the networks allowed by the
+// IP rules file. Rules are evaluated in order and the first match wins, so a narrow
+// deny can be placed before a broad allow. Blocked clients receive a 403 response.
+//
+// If no rules file is configured, or the group has no policy, all clients are allowed.
+func (app *application) ipFilter(group string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.ipRules == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		// Strip any IPv6 zone (fe80::1%eth0) before parsing.
+		addr, err := netip.ParseAddr(host)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !app.ipRules.Allowed(group, addr.WithZone("")) {
+			app.forbiddenNetworkResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// captureWriter wraps a http.ResponseWriter to record the status code and the number
+// of body bytes written by the next handler.
+type captureWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (cw *captureWriter) WriteHeader(status int) {
+	if !cw.wroteHeader {
+		cw.status = status
+		cw.wroteHeader = true
+	}
+	cw.ResponseWriter.WriteHeader(status)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.WriteHeader(http.StatusOK)
+	}
+	n, err := cw.ResponseWriter.Write(b)
+	cw.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// secureHeaders is a middleware which sets the security headers every response gets.
+// Responses are never cached, as they are specific to the client and the moment.
+// Handlers can still set their own Cache-Control. Over TLS, browsers are told to only
+// use HTTPS for this host.
+func (app *application) secureHeaders(next http.Handler) http.Handler {
+	hsts := ""
+	if app.config.hstsMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d; includeSubDomains", int(app.config.hstsMaxAge.Seconds()))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Cache-Control", "no-store")
+
+		if r.TLS != nil && hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// timeout is a middleware which gives the request a deadline. The handler runs with a
+// context that expires at the deadline, so the store and the points computation stop
+// early, and its response is buffered. If the deadline passes first, the buffered
+// response is dropped and the client gets a 504 Gateway Timeout instead. A zero
+// duration sets no deadline.
+func (app *application) timeout(d time.Duration, next http.Handler) http.Handler {
+	if d <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+		r = r.WithContext(ctx)
+
+		tw := &timeoutWriter{ctx: ctx, header: make(http.Header), status: http.StatusOK}
+		done := make(chan struct{})
+		panicked := make(chan any, 1)
+
+		go func() {
+			defer func() {
+				if err := recover(); err != nil {
+					panicked <- err
+				}
+			}()
+			next.ServeHTTP(tw, r)
+			close(done)
+		}()
+
+		select {
+		case err := <-panicked:
+			// Raise the panic again on this goroutine, where recoverPanic can catch it.
+			panic(err)
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			if tw.timedOut {
+				app.contextErrorResponse(w, r, ctx.Err())
+				return
+			}
+
+			maps.Copy(w.Header(), tw.header)
+			w.WriteHeader(tw.status)
+			w.Write(tw.buf.Bytes())
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+			app.contextErrorResponse(w, r, ctx.Err())
+
+			// The client has its response, so a panic from here on can only be logged.
+			go func() {
+				select {
+				case err := <-panicked:
+					app.logError(r, fmt.Errorf("panic after the request timed out: %s", err))
+				case <-done:
+				}
+			}()
+		}
+	})
+}
+
+// timeoutWriter buffers a response for the timeout middleware. Writes after the
+// deadline fail with http.ErrHandlerTimeout.
+type timeoutWriter struct {
+	ctx         context.Context
+	mu          sync.Mutex
+	header      http.Header
+	buf         bytes.Buffer
+	status      int
+	wroteHeader bool
+	timedOut    bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() || tw.wroteHeader {
+		return
+	}
+	tw.status = status
+	tw.wroteHeader = true
+}
+
+func (tw *timeoutWriter) Write(b []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.wroteHeader = true
+	return tw.buf.Write(b)
+}
+
+// expired reports whether the deadline has passed, and marks the response as timed
+// out if so. Must be called with tw.mu held.
+func (tw *timeoutWriter) expired() bool {
+	if tw.ctx.Err() != nil {
+		tw.timedOut = true
+	}
+	return tw.timedOut
+}
+
+// abuseGuard is a middleware for submission routes. It rejects clients that are
+// currently banned with a 429 and a Retry-After header, and records whether each
+// submission was accepted or rejected so the abuse tracker can adjust the client's
+// allowance in rateLimit.
+//
+// Only 400 responses count as rejections. Server errors and rate limit responses are
+// not the client's fault as far as receipt validity goes, so they are not recorded.
+func (app *application) abuseGuard(next http.Handler) http.Handler {
+	if app.abuse == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Banning the shared address of unix socket peers would lock out all of them.
+		if fromUnixSocket(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if _, retryAfter := app.abuse.Check(ip); retryAfter > 0 {
+			app.metrics.rateLimitRejected.With("abuse_ban").Inc()
+			app.clientBannedResponse(w, r, retryAfter)
+			return
+		}
+
+		cw := &captureWriter{ResponseWriter: w}
+		next.ServeHTTP(cw, r)
+
+		switch {
+		case cw.status == http.StatusBadRequest:
+			app.abuse.Record(ip, true)
+		case cw.status >= 200 && cw.status < 300:
+			app.abuse.Record(ip, false)
+		}
+	})
+}
+
+// clientCertificate is a middleware which adds the subject of a verified client
+// certificate to the request context, so handlers can identify mTLS clients with
+// contextGetClientCertSubject.
+func (app *application) clientCertificate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// VerifiedChains is only populated when the certificate was checked against the
+		// client CA bundle, so unverified certificates are never trusted.
+		if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+			r = app.contextSetClientCertSubject(r, r.TLS.VerifiedChains[0][0].Subject.String())
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// requestIDRX matches the client-supplied request IDs we accept. Anything else is
+// replaced so clients can't inject arbitrary text into the logs.
+var requestIDRX = regexp.MustCompile(`^[A-Za-z0-9._:\-]{1,128}$`)
+
+// requestID is a middleware which gives every request an ID. A valid X-Request-ID
+// header from the client (or a proxy in front of us) is kept, otherwise a new UUID is
+// generated. The ID is stored in the request context, which adds it to log lines and
+// error responses, and is echoed in the X-Request-ID response header.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDRX.MatchString(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
+	})
+}
+
+// logAccess is a middleware which writes a structured access log entry for every
+// request once the response has been written.
+func (app *application) logAccess(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		r, meta := app.contextSetRequestMeta(r)
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(cw, r)
+
+		clientIP, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			clientIP = r.RemoteAddr
+		}
+
+		meta.mu.Lock()
+		identity := meta.identity
+		meta.mu.Unlock()
+		if identity == "" {
+			identity = "anonymous"
+		}
+
+		app.logger.InfoContext(r.Context(), "request",
+			"method", r.Method,
+			"route", routePattern(router, r),
+			"status", cw.status,
+			"bytes", cw.bytes,
+			"duration", time.Since(start),
+			"client_ip", clientIP,
+			"identity", identity,
+		)
+	})
+}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
+
+	"fetch.trungnng.github.io/internal/abuse"
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/ipfilter"
 )
 
 func TestRecoverPanic(t *testing.T) {
@@ -40,6 +49,73 @@ func TestRecoverPanic(t *testing.T) {
 	}
 }
 
+func TestTimeout(t *testing.T) {
+	app := newTestApplication()
+
+	// A handler that finishes in time has its response passed through.
+	handler := app.timeout(time.Second, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "ok")
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte("done"))
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, rr.Code, http.StatusCreated)
+	assert.Equal(t, rr.Header().Get("X-Test"), "ok")
+	assert.Equal(t, rr.Body.String(), "done")
+
+	// A handler past its deadline sees its context expire, and the client gets a 504.
+	stopped := make(chan error, 1)
+	handler = app.timeout(10*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := w.Write([]byte("too late"))
+		stopped <- err
+	}))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, rr.Code, http.StatusGatewayTimeout)
+	assert.Contains(t, rr.Body.String(), "the server did not finish processing the request in time")
+	assert.Equal(t, <-stopped, http.ErrHandlerTimeout)
+
+	// A panic reaches recoverPanic.
+	handler = app.recoverPanic(app.timeout(time.Second, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, rr.Code, http.StatusInternalServerError)
+
+	// A panic after the deadline is logged.
+	logs := make(logChan, 1)
+	app.logger = slog.New(slog.NewTextHandler(logs, nil))
+	handler = app.timeout(10*time.Millisecond, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		panic("late boom")
+	}))
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, rr.Code, http.StatusGatewayTimeout)
+
+	select {
+	case line := <-logs:
+		assert.Contains(t, line, "panic after the request timed out: late boom")
+	case <-time.After(time.Second):
+		t.Fatal("panic after the deadline was not logged")
+	}
+}
+
+// logChan is a log destination that passes each line on a channel.
+type logChan chan string
+
+func (c logChan) Write(b []byte) (int, error) {
+	c <- string(b)
+	return len(b), nil
+}
+
 func TestRateLimit(t *testing.T) {
 	app := newTestApplication()
 
@@ -93,3 +169,241 @@ func TestRateLimit(t *testing.T) {
 		t.Errorf("expected status %d, got %d", http.StatusOK, rec.Code)
 	}
 }
+
+func TestIPFilter(t *testing.T) {
+	app := newTestApplication()
+
+	policies, err := ipfilter.Parse([]byte(`{
+		"receipts.write": {
+			"default": "deny",
+			"rules": ["deny 10.1.2.0/24", "allow 10.0.0.0/8", "allow 2001:db8::/32", "allow 203.0.113.7"]
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.ipRules = ipfilter.New(policies)
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		group      string
+		remoteAddr string
+		expected   int
+	}{
+		{"Allowed IPv4 CIDR", ipGroupReceiptsWrite, "10.9.8.7:1234", http.StatusOK},
+		{"Denied before broader allow", ipGroupReceiptsWrite, "10.1.2.3:1234", http.StatusForbidden},
+		{"Allowed single IP", ipGroupReceiptsWrite, "203.0.113.7:1234", http.StatusOK},
+		{"Allowed IPv6 CIDR", ipGroupReceiptsWrite, "[2001:db8::1]:1234", http.StatusOK},
+		{"IPv4-mapped IPv6", ipGroupReceiptsWrite, "[::ffff:10.9.8.7]:1234", http.StatusOK},
+		{"Default deny", ipGroupReceiptsWrite, "192.0.2.1:1234", http.StatusForbidden},
+		{"Group without policy", ipGroupReceiptsRead, "192.0.2.1:1234", http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/receipts/process", nil)
+			r.RemoteAddr = tc.remoteAddr
+
+			app.ipFilter(tc.group, next).ServeHTTP(rr, r)
+
+			assert.Equal(t, rr.Code, tc.expected)
+			if tc.expected == http.StatusForbidden {
+				assert.Equal(t, rr.Header().Get("Content-Type"), "application/json")
+				assert.Contains(t, rr.Body.String(), "not allowed from your network")
+			}
+		})
+	}
+}
+
+func TestIPFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ip-rules.json")
+
+	err := os.WriteFile(path, []byte(`{"system": {"rules": ["deny 192.0.2.0/24"]}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApplication()
+	app.ipRules, err = ipfilter.Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
+	r.RemoteAddr = "192.0.2.10:1234"
+
+	rr := httptest.NewRecorder()
+	app.ipFilter(ipGroupSystem, next).ServeHTTP(rr, r)
+	assert.Equal(t, rr.Code, http.StatusForbidden)
+
+	// A broken file must keep the previous rules in place.
+	err = os.WriteFile(path, []byte(`{"system": {"rules": ["block everything"]}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := app.ipRules.Reload(); err == nil {
+		t.Fatal("expected an error for an invalid rule")
+	}
+
+	rr = httptest.NewRecorder()
+	app.ipFilter(ipGroupSystem, next).ServeHTTP(rr, r)
+	assert.Equal(t, rr.Code, http.StatusForbidden)
+
+	err = os.WriteFile(path, []byte(`{"system": {"rules": ["allow 192.0.2.0/24"]}}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, app.ipRules.Reload())
+
+	rr = httptest.NewRecorder()
+	app.ipFilter(ipGroupSystem, next).ServeHTTP(rr, r)
+	assert.Equal(t, rr.Code, http.StatusOK)
+}
+
+func TestAbuseGuard(t *testing.T) {
+	app := newTestApplication()
+	app.abuse = abuse.New(abuse.Config{
+		Threshold:   0.5,
+		MinSamples:  3,
+		BanDuration: time.Minute,
+		HalfLife:    time.Hour,
+	})
+
+	// The handler rejects every submission after the first one.
+	var calls int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := app.abuseGuard(next)
+
+	submit := func() *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/receipts/process", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	// 1 accepted + 1 rejected: below the sample minimum, full allowance.
+	assert.Equal(t, submit().Code, http.StatusOK)
+	assert.Equal(t, submit().Code, http.StatusBadRequest)
+	factor, _ := app.abuse.Check("192.0.2.1")
+	assert.Equal(t, factor, 1.0)
+
+	// The third submission makes the ratio 2/3 which is over the threshold.
+	assert.Equal(t, submit().Code, http.StatusBadRequest)
+
+	rr := submit()
+	assert.Equal(t, rr.Code, http.StatusTooManyRequests)
+	assert.Equal(t, rr.Header().Get("Retry-After"), "60")
+	assert.Equal(t, calls, 3)
+
+	// Other clients are unaffected.
+	factor, retryAfter := app.abuse.Check("192.0.2.2")
+	assert.Equal(t, factor, 1.0)
+	assert.Equal(t, retryAfter, time.Duration(0))
+}
+
+func TestRequireScope(t *testing.T) {
+	app := newTestApplication()
+	app.adminTokens = []adminToken{{
+		name:   "prometheus",
+		token:  []byte("metrics-token-0123456789abcdef0123"),
+		scopes: map[string]bool{adminScopeMetrics: true},
+	}}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		name     string
+		token    string
+		header   string
+		scope    string
+		expected int
+	}{
+		{"No token configured", "", "Bearer ", adminScopeRules, http.StatusUnauthorized},
+		{"Missing header", "secret", "", adminScopeRules, http.StatusUnauthorized},
+		{"Wrong token", "secret", "Bearer nope", adminScopeRules, http.StatusUnauthorized},
+		{"Valid token", "secret", "Bearer secret", adminScopeRules, http.StatusOK},
+		{"Scoped token", "", "Bearer metrics-token-0123456789abcdef0123", adminScopeMetrics, http.StatusOK},
+		{"Scoped token without scope", "", "Bearer metrics-token-0123456789abcdef0123", adminScopeRules, http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app.config.admin.token = tc.token
+
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/admin/abuse", nil)
+			if tc.header != "" {
+				r.Header.Set("Authorization", tc.header)
+			}
+
+			app.requireScope(tc.scope, next).ServeHTTP(rr, r)
+			assert.Equal(t, rr.Code, tc.expected)
+		})
+	}
+}
+
+func TestRequestIDAndAccessLog(t *testing.T) {
+	var logs bytes.Buffer
+
+	app := newTestApplication()
+	app.logger = slog.New(newContextHandler(slog.NewTextHandler(&logs, nil)))
+	app.config.admin.token = "secret"
+
+	handler := app.adminRoutes()
+
+	// A valid client-supplied ID is kept and appears in the error envelope.
+	r := httptest.NewRequest(http.MethodGet, "/admin/abuse", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("X-Request-ID", "client-req-42")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	assert.Equal(t, rr.Code, http.StatusUnauthorized)
+	assert.Equal(t, rr.Header().Get("X-Request-ID"), "client-req-42")
+	assert.Contains(t, rr.Body.String(), `"request_id":"client-req-42"`)
+
+	line := logs.String()
+	for _, field := range []string{
+		"msg=request", "request_id=client-req-42", "method=GET", "route=/admin/abuse",
+		"status=401", "client_ip=192.0.2.1", "identity=anonymous",
+	} {
+		assert.Contains(t, line, field)
+	}
+
+	// An invalid ID is replaced with a generated one, and the admin identity is logged.
+	logs.Reset()
+	r = httptest.NewRequest(http.MethodGet, "/admin/abuse", nil)
+	r.Header.Set("X-Request-ID", "bad id\nforged=1")
+	r.Header.Set("Authorization", "Bearer secret")
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, r)
+
+	assert.Equal(t, rr.Code, http.StatusOK)
+	id := rr.Header().Get("X-Request-ID")
+	assert.Equal(t, requestIDRX.MatchString(id), true)
+	assert.Equal(t, strings.Contains(id, "forged"), false)
+	assert.Contains(t, logs.String(), "request_id="+id)
+	assert.Contains(t, logs.String(), "identity=admin")
+	assert.Contains(t, logs.String(), "bytes="+strconv.Itoa(rr.Body.Len()))
+}
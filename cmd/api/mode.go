@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Service modes. In read-only mode requests that would change the store are refused
+// and reads keep working, so the store can be migrated without an outage. In
+// maintenance mode only the health endpoints are served.
+const (
+	modeNormal      = "normal"
+	modeReadOnly    = "read-only"
+	modeMaintenance = "maintenance"
+)
+
+// healthPaths are the routes served in maintenance mode, so orchestrators and load
+// balancers keep seeing the instance.
+var healthPaths = map[string]bool{
+	"/healthcheck": true,
+	"/livez":       true,
+	"/readyz":      true,
+}
+
+// serviceMode refuses the requests the current service mode doesn't allow with 503
+// Service Unavailable. The mode can change at runtime, so it is read for every
+// request.
+func (app *application) serviceMode(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		service := app.currentConfig().service
+
+		switch service.mode {
+		case modeReadOnly:
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				app.serviceUnavailableResponse(w, r, service.mode, service.message, service.retryAfter)
+				return
+			}
+		case modeMaintenance:
+			if !healthPaths[r.URL.Path] {
+				app.serviceUnavailableResponse(w, r, service.mode, service.message, service.retryAfter)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// modeEnvelope describes the service mode in effect.
+func (app *application) modeEnvelope() envelope {
+	service := app.currentConfig().service
+
+	return envelope{
+		"mode":        service.mode,
+		"message":     service.message,
+		"retry_after": service.retryAfter.String(),
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/data"
+)
+
+func TestServiceMode(t *testing.T) {
+	app := newTestApplication()
+	app.model = data.NewModels()
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	setMode := func(mode string) {
+		app.configMu.Lock()
+		app.config.service.mode = mode
+		app.config.service.message = "store migration"
+		app.config.service.retryAfter = 90 * time.Second
+		app.configMu.Unlock()
+	}
+
+	// Read-only mode refuses submissions and keeps serving reads.
+	setMode(modeReadOnly)
+
+	code, header, body := ts.post(t, "/receipts/process", strings.NewReader(`{}`))
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, header.Get("Retry-After"), "90")
+	assert.Contains(t, body, "the service is in read-only mode and is not accepting changes: store migration")
+
+	code, _, body = ts.get(t, "/receipts/unknown/points")
+	assert.Equal(t, code, http.StatusBadRequest)
+	assert.Contains(t, body, "No receipt found for that id")
+
+	// Maintenance mode only serves the health endpoints.
+	setMode(modeMaintenance)
+
+	code, header, body = ts.get(t, "/receipts/unknown/points")
+	assert.Equal(t, code, http.StatusServiceUnavailable)
+	assert.Equal(t, header.Get("Retry-After"), "90")
+	assert.Contains(t, body, "the service is down for maintenance: store migration")
+
+	code, _, _ = ts.get(t, "/livez")
+	assert.Equal(t, code, http.StatusOK)
+
+	code, _, _ = ts.get(t, "/healthcheck")
+	assert.Equal(t, code, http.StatusOK)
+
+	// Back to normal, submissions reach the handler again.
+	setMode(modeNormal)
+
+	code, _, _ = ts.post(t, "/receipts/process", strings.NewReader(`{}`))
+	assert.Equal(t, code, http.StatusBadRequest)
+}
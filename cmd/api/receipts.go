@@ -1,16 +1,59 @@
 package main
 
 import (
-	"fmt"
+	"encoding/base64"
+	"errors"
 	"net/http"
 	"time"
 
 	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/trust"
 	"fetch.trungnng.github.io/internal/validator"
 )
 
 // Submits a receipt for processing
 func (app *application) processReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	receipt := app.model.Receipts.NewReceipt()
+	if !app.readReceipt(w, r, receipt) {
+		return
+	}
+
+	// Save to DB
+	ctx, span := app.tracer.Start(r.Context(), "store.Insert")
+	err := app.model.Receipts.Insert(ctx, app.actor(r), receipt)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		if isContextError(err) {
+			app.contextErrorResponse(w, r, err)
+			return
+		}
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The receipt is stored, so a request cancelled from here on only misses the
+	// points metric.
+	ctx, span = app.tracer.Start(r.Context(), "calculatePoints")
+	points, err := app.calculatePoints(ctx, receipt)
+	span.SetError(err)
+	span.End()
+	if err == nil {
+		app.metrics.pointsAwarded.With().Observe(float64(points))
+	}
+
+	// Response to client
+	err = app.writeResponse(w, r, 200, envelope{"id": receipt.ID}, nil)
+	if err != nil {
+		app.logger.Error(err.Error())
+		http.Error(w, "The server encountered a problem and could not process your request", http.StatusInternalServerError)
+	}
+}
+
+// readReceipt reads a receipt from the request body into receipt, validates it and
+// checks the retailer's signature. If the receipt is rejected it sends the error
+// response and returns false.
+func (app *application) readReceipt(w http.ResponseWriter, r *http.Request, receipt *data.Receipt) bool {
 	errorMessage := "The receipt is invalid"
 
 	// The Price and Total fields are defined as pointers to allow distinguishing between
@@ -27,29 +70,34 @@ func (app *application) processReceiptHandler(w http.ResponseWriter, r *http.Req
 		Total *data.ReceiptAmount `json:"total"`
 	}
 
-	err := app.readJSON(w, r, &input)
+	_, span := app.tracer.Start(r.Context(), "readRequest")
+	err := app.readRequest(w, r, &input)
+	span.SetError(err)
+	span.End()
 	if err != nil {
-		fmt.Println(err.Error())
+		app.logger.DebugContext(r.Context(), "invalid receipt body", "error", err.Error())
+		app.metrics.validationFailures.With("body").Inc()
 		app.badRequestResponse(w, r, errorMessage)
-		return
+		return false
 	}
 
 	// Check if the receipt has a total field.
 	if input.Total == nil {
+		app.metrics.validationFailures.With("total").Inc()
 		app.badRequestResponse(w, r, errorMessage)
-		return
+		return false
 	}
 
 	// Check if all items in the receipt have a price field.
 	for _, item := range input.Items {
 		if item.Price == nil {
+			app.metrics.validationFailures.With("price").Inc()
 			app.badRequestResponse(w, r, errorMessage)
-			return
+			return false
 		}
 	}
 
-	// Copy the values from the input struct to a new Receipt struct.
-	receipt := app.model.Receipts.NewReceipt()
+	// Copy the values from the input struct to the Receipt struct.
 	receipt.Retailer = string(input.Retailer)
 	receipt.PurchaseDate = time.Time(input.PurchaseDate)
 	receipt.PurchaseTime = time.Time(input.PurchaseTime)
@@ -64,31 +112,71 @@ func (app *application) processReceiptHandler(w http.ResponseWriter, r *http.Req
 	// Validate reciept data
 	v := validator.New()
 
-	if data.ValidateReceipt(v, receipt); !v.Valid() {
+	_, span = app.tracer.Start(r.Context(), "ValidateReceipt")
+	data.ValidateReceipt(v, receipt)
+	span.SetAttribute("receipt.valid", v.Valid())
+	span.End()
+
+	if !v.Valid() {
+		for field := range v.Errors {
+			app.metrics.validationFailures.With(field).Inc()
+		}
 		app.badRequestResponse(w, r, errorMessage)
-		return
+		return false
 	}
 
-	// Save to DB
-	err = app.model.Receipts.Insert(receipt)
+	// Check the retailer's detached signature over the canonical receipt, if any. A
+	// signature that doesn't match a known retailer key means the receipt was altered.
+	status, err := app.verifyReceiptSignature(r, receipt)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
+		return false
 	}
 
-	// Response to client
-	err = app.writeJSON(w, 200, envelope{"id": receipt.ID}, nil)
+	if status == trust.Invalid || (app.currentConfig().rules.requireVerified && status != trust.Verified) {
+		app.metrics.validationFailures.With("signature").Inc()
+		app.badRequestResponse(w, r, errorMessage)
+		return false
+	}
+	receipt.SignatureStatus = string(status)
+
+	return true
+}
+
+// verifyReceiptSignature checks the base64-encoded Ed25519 signature in the
+// X-Receipt-Signature header against the retailer's keys in the trust store. The
+// signature is over the receipt's canonical JSON (see data.Receipt.CanonicalJSON).
+// A malformed header is treated as an invalid signature.
+func (app *application) verifyReceiptSignature(r *http.Request, receipt *data.Receipt) (trust.Status, error) {
+	header := r.Header.Get("X-Receipt-Signature")
+	if header == "" {
+		return trust.Unsigned, nil
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(header)
 	if err != nil {
-		app.logger.Error(err.Error())
-		http.Error(w, "The server encountered a problem and could not process your request", http.StatusInternalServerError)
+		return trust.Invalid, nil
+	}
+
+	msg, err := receipt.CanonicalJSON()
+	if err != nil {
+		return "", err
 	}
+
+	if app.trustStore == nil {
+		return trust.Untrusted, nil
+	}
+
+	return app.trustStore.Verify(receipt.Retailer, msg, signature), nil
 }
 
 // getPointsHandler handles the HTTP request to retrieve the points for a specific receipt by ID.
 // 1. Extracts the `id` from the URL path parameters.
 // 2. Attempts to retrieve the receipt from the database using the provided `id`.
-// 3. Calculates the total points for the retrieved receipt.
-// 4. Responds with the calculated points in JSON format.
+// 3. Answers 304 Not Modified if the client's copy, named in If-None-Match, is current.
+// 4. Calculates the total points for the retrieved receipt.
+// 5. Responds with the calculated points in JSON format, with a signed attestation if
+// the client asked for one.
 func (app *application) getPointsHandler(w http.ResponseWriter, r *http.Request) {
 	errorMessage := "No receipt found for that id"
 
@@ -106,19 +194,188 @@ func (app *application) getPointsHandler(w http.ResponseWriter, r *http.Request)
 	}
 
 	// Retrieve the receipt from the database by ID.
-	receipt, err := app.model.Receipts.Get(id)
+	ctx, span := app.tracer.Start(r.Context(), "store.Get")
+	receipt, err := app.model.Receipts.Get(ctx, id)
+	span.SetError(err)
+	span.End()
 	if err != nil {
+		if isContextError(err) {
+			app.contextErrorResponse(w, r, err)
+			return
+		}
 		app.receiptIDNotFoundResponse(w, r, errorMessage)
 		return
 	}
 
+	// Without an attestation, which is signed afresh each time, the response only
+	// changes with the receipt, the rules and the format. Clients that poll can
+	// revalidate their copy with If-None-Match instead of having the points
+	// recalculated.
+	attest := r.URL.Query().Get("attest") == "true"
+	if !attest {
+		etag := app.receiptETag(receipt, responseEncoder(r, envelope{"points": 0}))
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "private, no-cache")
+
+		if !noneMatch(r, etag) {
+			// A 304 carries the Vary header the full response would have.
+			w.Header().Add("Vary", "Accept")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
 	// Calculate the points for the retrieved receipt.
-	points := app.calculatePoints(receipt)
+	ctx, span = app.tracer.Start(r.Context(), "calculatePoints")
+	points, err := app.calculatePoints(ctx, receipt)
+	span.SetAttribute("receipt.points", points)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		app.contextErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"points": points}
+
+	// Partners can ask for a signed attestation of the points with ?attest=true.
+	if attest {
+		att, err := app.attestPoints(receipt, points)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		env["attestation"] = att
+	}
 
 	// Send the response with the calculated points in JSON format.
-	err = app.writeJSON(w, http.StatusOK, envelope{"points": points}, nil)
+	err = app.writeResponse(w, r, http.StatusOK, env, nil)
 	if err != nil {
 		app.logger.Error(err.Error())
 		http.Error(w, "The server encountered a problem and could not process your request", http.StatusInternalServerError)
 	}
 }
+
+// updateReceiptHandler replaces a stored receipt with the one in the request body. An
+// If-Match header makes the update conditional on the receipt not having changed since
+// the client read its points. Without one, an update that races with another still
+// fails with 409 Conflict rather than overwriting it.
+func (app *application) updateReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	errorMessage := "No receipt found for that id"
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.receiptIDNotFoundResponse(w, r, errorMessage)
+		return
+	}
+
+	ctx, span := app.tracer.Start(r.Context(), "store.Get")
+	existing, err := app.model.Receipts.Get(ctx, id)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		if isContextError(err) {
+			app.contextErrorResponse(w, r, err)
+			return
+		}
+		app.receiptIDNotFoundResponse(w, r, errorMessage)
+		return
+	}
+
+	version, ok := matchVersion(r, existing)
+	if !ok {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	receipt := app.model.Receipts.NewReceipt()
+	if !app.readReceipt(w, r, receipt) {
+		return
+	}
+	receipt.ID = existing.ID
+	receipt.CreatedAt = existing.CreatedAt
+	receipt.Version = existing.Version
+
+	ctx, span = app.tracer.Start(r.Context(), "store.Update")
+	err = app.model.Receipts.Update(ctx, app.actor(r), receipt)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict) && version != 0:
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.receiptIDNotFoundResponse(w, r, errorMessage)
+		case isContextError(err):
+			app.contextErrorResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{"id": receipt.ID}
+	headers := make(http.Header)
+	headers.Set("ETag", app.receiptETag(receipt, responseEncoder(r, env)))
+
+	err = app.writeResponse(w, r, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// deleteReceiptHandler deletes a stored receipt, only if it hasn't changed when the
+// request has an If-Match header.
+func (app *application) deleteReceiptHandler(w http.ResponseWriter, r *http.Request) {
+	errorMessage := "No receipt found for that id"
+
+	id, err := app.readIDParam(r)
+	if err != nil {
+		app.receiptIDNotFoundResponse(w, r, errorMessage)
+		return
+	}
+
+	ctx, span := app.tracer.Start(r.Context(), "store.Get")
+	existing, err := app.model.Receipts.Get(ctx, id)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		if isContextError(err) {
+			app.contextErrorResponse(w, r, err)
+			return
+		}
+		app.receiptIDNotFoundResponse(w, r, errorMessage)
+		return
+	}
+
+	version, ok := matchVersion(r, existing)
+	if !ok {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
+
+	ctx, span = app.tracer.Start(r.Context(), "store.Delete")
+	err = app.model.Receipts.Delete(ctx, app.actor(r), id, version)
+	span.SetError(err)
+	span.End()
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrEditConflict):
+			app.preconditionFailedResponse(w, r)
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.receiptIDNotFoundResponse(w, r, errorMessage)
+		case isContextError(err):
+			app.contextErrorResponse(w, r, err)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"message": "receipt successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
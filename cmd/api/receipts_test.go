@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"io"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
 	"fetch.trungnng.github.io/internal/assert"
 	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/trust"
+	"fetch.trungnng.github.io/pkg/attestation"
+	"github.com/julienschmidt/httprouter"
 )
 
 func TestProcessReceiptHandler(t *testing.T) {
@@ -69,7 +78,7 @@ func TestGetPointsHandler(t *testing.T) {
 	defer ts.Close()
 
 	app.model = data.NewModels()
-	err := app.model.Receipts.Insert(&receipt)
+	err := app.model.Receipts.Insert(t.Context(), "test", &receipt)
 	if err != nil {
 		t.Fatal("Unable to insert receipt")
 	}
@@ -78,3 +87,355 @@ func TestGetPointsHandler(t *testing.T) {
 	assert.Equal(t, status, 200)
 	assert.Contains(t, res, "28")
 }
+
+func TestCancelledRequests(t *testing.T) {
+	app := newTestApplication()
+	app.model = data.NewModels()
+
+	receipt := app.model.Receipts.NewReceipt()
+	receipt.Items = []*data.Item{{ShortDescription: "Gatorade", Price: 2.25}}
+	assert.NoError(t, app.model.Receipts.Insert(t.Context(), "test", receipt))
+
+	cancelled, cancel := context.WithCancel(t.Context())
+	cancel()
+
+	// The store makes no change for a cancelled request.
+	err := app.model.Receipts.Insert(cancelled, "test", app.model.Receipts.NewReceipt())
+	assert.Equal(t, err, context.Canceled)
+	assert.Equal(t, app.model.Receipts.Len(), 1)
+
+	err = app.model.Receipts.Delete(cancelled, "test", receipt.ID, 0)
+	assert.Equal(t, err, context.Canceled)
+	assert.Equal(t, app.model.Receipts.Len(), 1)
+
+	_, err = app.model.Receipts.Get(cancelled, receipt.ID)
+	assert.Equal(t, err, context.Canceled)
+
+	_, err = app.calculatePoints(cancelled, receipt)
+	assert.Equal(t, err, context.Canceled)
+
+	// Handlers report how the request's context ended.
+	ctx, cancel := context.WithTimeout(t.Context(), -time.Second)
+	defer cancel()
+
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+	}{
+		{"Cancelled", cancelled, http.StatusServiceUnavailable},
+		{"Deadline exceeded", ctx, http.StatusGatewayTimeout},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequestWithContext(tc.ctx, http.MethodGet, "/receipts/"+receipt.ID+"/points", nil)
+			r = r.WithContext(context.WithValue(r.Context(), httprouter.ParamsKey, httprouter.Params{{Key: "id", Value: receipt.ID}}))
+
+			rr := httptest.NewRecorder()
+			app.getPointsHandler(rr, r)
+			assert.Equal(t, rr.Code, tc.status)
+		})
+	}
+}
+
+func TestProcessSignedReceipt(t *testing.T) {
+	publicKey, privateKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := newTestApplication()
+	app.model = data.NewModels()
+	app.trustStore = trust.New()
+	app.trustStore.Add("M&M Corner Market", publicKey)
+	app.config.rules.verifiedBonus = 100
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	body := `{
+		"retailer": "M&M Corner Market",
+		"purchaseDate": "2022-03-20",
+		"purchaseTime": "14:33",
+		"items": [{"shortDescription": " Gatorade ", "price": "2.25"}],
+		"total": "2.25"
+	}`
+
+	// The signature is over the canonical form of the receipt, not the raw body.
+	canonical := `{"items":[{"price":"2.25","shortDescription":"Gatorade"}],"purchaseDate":"2022-03-20","purchaseTime":"14:33","retailer":"M&M Corner Market","total":"2.25"}`
+	validSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(canonical)))
+	otherSignature := base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, []byte(canonical+" ")))
+
+	post := func(signature string) (int, string) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/receipts/process", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if signature != "" {
+			req.Header.Set("X-Receipt-Signature", signature)
+		}
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		var res struct {
+			ID string `json:"id"`
+		}
+		json.NewDecoder(rs.Body).Decode(&res)
+
+		return rs.StatusCode, res.ID
+	}
+
+	status, id := post(validSignature)
+	assert.Equal(t, status, http.StatusOK)
+
+	receipt, err := app.model.Receipts.Get(t.Context(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, receipt.SignatureStatus, string(trust.Verified))
+
+	// 14 for the retailer, 25 for the multiple of 0.25, 10 for the time of purchase
+	// and 100 for the verified signature.
+	points, err := app.calculatePoints(t.Context(), receipt)
+	assert.NoError(t, err)
+	assert.Equal(t, points, int64(149))
+
+	status, _ = post(otherSignature)
+	assert.Equal(t, status, http.StatusBadRequest)
+
+	status, _ = post("not base64!")
+	assert.Equal(t, status, http.StatusBadRequest)
+
+	status, id = post("")
+	assert.Equal(t, status, http.StatusOK)
+	receipt, _ = app.model.Receipts.Get(t.Context(), id)
+	assert.Equal(t, receipt.SignatureStatus, string(trust.Unsigned))
+
+	app.config.rules.requireVerified = true
+	status, _ = post("")
+	assert.Equal(t, status, http.StatusBadRequest)
+}
+
+func TestGetPointsAttestation(t *testing.T) {
+	_, oldKey, _ := ed25519.GenerateKey(nil)
+	_, activeKey, _ := ed25519.GenerateKey(nil)
+
+	app := newTestApplication()
+	app.model = data.NewModels()
+
+	var err error
+	app.attestations, err = newAttestationSigner(activeKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt := &data.Receipt{
+		ID:           "7fb1377b-b223-49d9-a31a-5a02701dd310",
+		Retailer:     "Target",
+		PurchaseDate: time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC),
+		PurchaseTime: time.Date(1, time.January, 1, 13, 1, 0, 0, time.UTC),
+		Items:        []*data.Item{{ShortDescription: "Mountain Dew 12PK", Price: 6.49}},
+		Total:        6.49,
+	}
+	if err := app.model.Receipts.Insert(t.Context(), "test", receipt); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	// Without ?attest=true there is no attestation.
+	_, _, res := ts.get(t, "/receipts/"+receipt.ID+"/points")
+	if strings.Contains(res, "attestation") {
+		t.Errorf("unexpected attestation in %s", res)
+	}
+
+	status, _, res := ts.get(t, "/receipts/"+receipt.ID+"/points?attest=true")
+	assert.Equal(t, status, http.StatusOK)
+
+	var body struct {
+		Points      int64                   `json:"points"`
+		Attestation attestation.Attestation `json:"attestation"`
+	}
+	if err := json.Unmarshal([]byte(res), &body); err != nil {
+		t.Fatal(err)
+	}
+
+	status, _, res = ts.get(t, "/.well-known/fetch-attestation-keys")
+	assert.Equal(t, status, http.StatusOK)
+
+	var keys attestation.KeySet
+	if err := json.Unmarshal([]byte(res), &keys); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(keys.Keys), 2)
+	assert.Equal(t, keys.Keys[0].KeyID, body.Attestation.KeyID)
+
+	statement, err := attestation.Verify(body.Attestation, keys)
+	assert.NoError(t, err)
+
+	canonical, _ := receipt.CanonicalJSON()
+	assert.Equal(t, statement.ReceiptID, receipt.ID)
+	assert.Equal(t, statement.ContentHash, attestation.ContentHash(canonical))
+	assert.Equal(t, statement.Points, body.Points)
+	assert.Equal(t, statement.RulesetVersion, app.rulesetVersion())
+
+	// Any change to the payload breaks the signature.
+	body.Attestation.Payload = strings.Replace(body.Attestation.Payload, "a", "b", 1)
+	_, err = attestation.Verify(body.Attestation, keys)
+	if err == nil {
+		t.Fatal("expected verification of a modified attestation to fail")
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	app := newTestApplication()
+	app.model = data.NewModels()
+	app.attestations, err = newAttestationSigner(key)
+	assert.NoError(t, err)
+
+	receipt := app.model.Receipts.NewReceipt()
+	receipt.Retailer = "Target"
+	receipt.PurchaseDate = time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC)
+	receipt.PurchaseTime = time.Date(1, time.January, 1, 13, 1, 0, 0, time.UTC)
+	receipt.Items = []*data.Item{{ShortDescription: "Mountain Dew 12PK", Price: 6.49}}
+	receipt.Total = 6.49
+	assert.NoError(t, app.model.Receipts.Insert(t.Context(), "test", receipt))
+
+	ts := newTestServer(app.routes())
+	defer ts.Close()
+
+	do := func(method, path string, header map[string]string, body string) (*http.Response, string) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		b, err := io.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs, string(b)
+	}
+
+	pointsPath := "/receipts/" + receipt.ID + "/points"
+	receiptPath := "/receipts/" + receipt.ID
+	update := `{"retailer": "Walmart", "purchaseDate": "2022-01-01", "purchaseTime": "13:01", "items": [{"shortDescription": "Pepsi", "price": "1.00"}], "total": "1.00"}`
+
+	// The points carry an ETag made of the receipt and ruleset versions and the
+	// format.
+	rs, _ := do(http.MethodGet, pointsPath, nil, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	etag := rs.Header.Get("ETag")
+	assert.Equal(t, etag, `"v1.`+app.rulesetVersion()+`.json"`)
+	assert.Equal(t, rs.Header.Get("Cache-Control"), "private, no-cache")
+
+	rs, body := do(http.MethodGet, pointsPath, map[string]string{"If-None-Match": etag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusNotModified)
+	assert.Equal(t, rs.Header.Get("ETag"), etag)
+	assert.Equal(t, body, "")
+
+	rs, _ = do(http.MethodGet, pointsPath, map[string]string{"If-None-Match": `"v0.stale", W/` + etag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusNotModified)
+
+	rs, _ = do(http.MethodGet, pointsPath, map[string]string{"If-None-Match": `"v0.stale"`}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+
+	// The tag of a compressed copy stands for the same points.
+	rs, _ = do(http.MethodGet, pointsPath, map[string]string{"If-None-Match": strings.TrimSuffix(etag, `"`) + `-gzip"`}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusNotModified)
+
+	// A copy in another format has another tag, so it isn't taken for the JSON one.
+	rs, _ = do(http.MethodGet, pointsPath, map[string]string{"Accept": "application/xml", "If-None-Match": etag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.Header.Get("ETag"), `"v1.`+app.rulesetVersion()+`.xml"`)
+
+	rs, _ = do(http.MethodGet, pointsPath, map[string]string{"Accept": "application/msgpack", "If-None-Match": etag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.Header.Get("ETag"), `"v1.`+app.rulesetVersion()+`.msgpack"`)
+
+	// Attestations are signed afresh, so they are never cached.
+	rs, _ = do(http.MethodGet, pointsPath+"?attest=true", map[string]string{"If-None-Match": etag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.Header.Get("ETag"), "")
+
+	// An update based on a stale version fails, a current one succeeds and changes
+	// the ETag.
+	rs, _ = do(http.MethodPut, receiptPath, map[string]string{"If-Match": `"v7.` + app.rulesetVersion() + `"`}, update)
+	assert.Equal(t, rs.StatusCode, http.StatusPreconditionFailed)
+
+	rs, _ = do(http.MethodPut, receiptPath, map[string]string{"If-Match": etag}, update)
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	newETag := rs.Header.Get("ETag")
+	assert.Equal(t, newETag, `"v2.`+app.rulesetVersion()+`.json"`)
+
+	stored, err := app.model.Receipts.Get(t.Context(), receipt.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, stored.Retailer, "Walmart")
+	assert.Equal(t, stored.CreatedAt, receipt.CreatedAt)
+
+	// The second editor still holds the first ETag.
+	rs, _ = do(http.MethodPut, receiptPath, map[string]string{"If-Match": etag}, update)
+	assert.Equal(t, rs.StatusCode, http.StatusPreconditionFailed)
+
+	rs, _ = do(http.MethodGet, pointsPath, map[string]string{"If-None-Match": etag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+
+	// A weak tag doesn't satisfy If-Match.
+	rs, _ = do(http.MethodDelete, receiptPath, map[string]string{"If-Match": "W/" + newETag}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusPreconditionFailed)
+
+	rs, _ = do(http.MethodDelete, receiptPath, map[string]string{"If-Match": strings.TrimSuffix(newETag, `"`) + `-deflate"`}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+
+	rs, _ = do(http.MethodDelete, receiptPath, map[string]string{"If-Match": "*"}, "")
+	assert.Equal(t, rs.StatusCode, http.StatusBadRequest)
+}
+
+func TestEditConflict(t *testing.T) {
+	models := data.NewModels()
+
+	receipt := models.Receipts.NewReceipt()
+	receipt.Retailer = "Target"
+	assert.NoError(t, models.Receipts.Insert(t.Context(), "test", receipt))
+	assert.Equal(t, receipt.Version, int64(1))
+
+	// Two editors read version 1. The first update wins.
+	first, second := *receipt, *receipt
+	first.Retailer = "Walmart"
+	second.Retailer = "Costco"
+
+	assert.NoError(t, models.Receipts.Update(t.Context(), "test", &first))
+	assert.Equal(t, first.Version, int64(2))
+
+	err := models.Receipts.Update(t.Context(), "test", &second)
+	assert.Equal(t, err, data.ErrEditConflict)
+
+	err = models.Receipts.Delete(t.Context(), "test", receipt.ID, 1)
+	assert.Equal(t, err, data.ErrEditConflict)
+
+	stored, err := models.Receipts.Get(t.Context(), receipt.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, stored.Retailer, "Walmart")
+
+	assert.NoError(t, models.Receipts.Delete(t.Context(), "test", receipt.ID, 2))
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// currentConfig returns a copy of the configuration. Code that reads settings which
+// can change on a reload (see reloadConfig) must go through it rather than reading
+// app.config directly.
+func (app *application) currentConfig() config {
+	app.configMu.RLock()
+	defer app.configMu.RUnlock()
+
+	return app.config
+}
+
+// reloadConfig re-reads the configuration from the same file, environment and
+// arguments the server was started with, and swaps in the parts that can change at
+// runtime:
+//
+//   - limiter settings
+//   - log level
+//   - rule parameters
+//   - service mode
+//   - CORS settings
+//   - IP policies, re-read from the rules file
+//
+// Everything is loaded and checked before anything is swapped, so a failed reload
+// keeps the old configuration. Other settings that changed are reported in the
+// returned list and only take effect after a restart. Settings changed through the
+// admin API keep their runtime value; see configOverrides.
+func (app *application) reloadConfig() ([]string, error) {
+	fs := flag.NewFlagSet("reload", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Bool("print-config", false, "")
+
+	cfg, err := loadConfig(fs, app.configArgs, os.Environ())
+	if err != nil {
+		return nil, err
+	}
+
+	var level slog.Level
+	err = level.UnmarshalText([]byte(cfg.log.level))
+	if err != nil {
+		return nil, err
+	}
+
+	app.configMu.Lock()
+	defer app.configMu.Unlock()
+
+	// The IP rules filter keeps its current policies if the file fails to load.
+	if app.ipRules != nil && cfg.ipRules.file == app.config.ipRules.file {
+		err = app.ipRules.Reload()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Compare against the flags the server started with, so a setting stays listed
+	// until the restart that applies it.
+	var restartRequired []string
+	if app.configFlags != nil {
+		fs.VisitAll(func(f *flag.Flag) {
+			if f.Name == "print-config" || reloadableSettings[f.Name] {
+				return
+			}
+			if old := app.configFlags.Lookup(f.Name); old != nil && old.Value.String() != f.Value.String() {
+				restartRequired = append(restartRequired, f.Name)
+			}
+		})
+	}
+
+	// Only the reloadable fields are written. Everything else in app.config is read
+	// without the lock and must not change.
+	app.config.limiter = cfg.limiter
+	app.config.log.level = cfg.log.level
+	app.config.rules = cfg.rules
+	app.config.service = cfg.service
+	app.config.cors = cfg.cors
+
+	if kept := app.overrides.apply(&app.config); len(kept) > 0 {
+		app.logger.Warn("keeping settings changed through the admin API over the reloaded config", "settings", kept)
+	}
+	if app.overrides.logLevel != nil {
+		level = *app.overrides.logLevel
+	}
+	app.logLevel.Set(level)
+
+	return restartRequired, nil
+}
+
+// configOverrides are the reloadable settings changed through the admin API. They are
+// usually a deliberate reaction to something the config file doesn't know about, so a
+// reload applies them again over the values it read; a restart clears them. A nil
+// field isn't overridden.
+type configOverrides struct {
+	logLevel        *slog.Level
+	verifiedBonus   *int64
+	requireVerified *bool
+	mode            *string
+	modeMessage     *string
+	modeRetryAfter  *time.Duration
+}
+
+// apply writes the overrides over cfg and returns the names of the settings they set.
+func (o configOverrides) apply(cfg *config) []string {
+	var kept []string
+	if o.logLevel != nil {
+		cfg.log.level = strings.ToLower(o.logLevel.String())
+		kept = append(kept, "log-level")
+	}
+	if o.verifiedBonus != nil {
+		cfg.rules.verifiedBonus = *o.verifiedBonus
+		kept = append(kept, "rules-verified-bonus")
+	}
+	if o.requireVerified != nil {
+		cfg.rules.requireVerified = *o.requireVerified
+		kept = append(kept, "rules-require-verified")
+	}
+	if o.mode != nil {
+		cfg.service.mode = *o.mode
+		kept = append(kept, "mode")
+	}
+	if o.modeMessage != nil {
+		cfg.service.message = *o.modeMessage
+		kept = append(kept, "mode-message")
+	}
+	if o.modeRetryAfter != nil {
+		cfg.service.retryAfter = *o.modeRetryAfter
+		kept = append(kept, "mode-retry-after")
+	}
+	return kept
+}
+
+// reloadableSettings are the flags reloadConfig applies without a restart.
+var reloadableSettings = map[string]bool{
+	"limiter-rps":            true,
+	"limiter-burst":          true,
+	"limiter-enabled":        true,
+	"log-level":              true,
+	"rules-verified-bonus":   true,
+	"rules-require-verified": true,
+	"mode":                   true,
+	"mode-message":           true,
+	"mode-retry-after":       true,
+	"cors-trusted-origins":   true,
+	"cors-allowed-methods":   true,
+	"cors-allowed-headers":   true,
+	"cors-allow-credentials": true,
+	"cors-max-age":           true,
+}
+
+// reload logs the outcome of a reload triggered by SIGHUP or the admin endpoint.
+func (app *application) reload(trigger string) ([]string, error) {
+	restartRequired, err := app.reloadConfig()
+	if err != nil {
+		app.logger.Error("config reload failed, keeping the current config", "trigger", trigger, "error", err.Error())
+		return nil, err
+	}
+
+	app.logger.Info("reloaded config", "trigger", trigger)
+	if len(restartRequired) > 0 {
+		app.logger.Warn("changed settings need a restart to take effect", "settings", restartRequired)
+	}
+
+	return restartRequired, nil
+}
+
+// adminReloadHandler reloads the configuration. A failed reload responds with 422 and
+// the reason; the current configuration stays in effect.
+func (app *application) adminReloadHandler(w http.ResponseWriter, r *http.Request) {
+	restartRequired, err := app.reload("admin")
+	if err != nil {
+		app.reloadFailedResponse(w, r, err)
+		return
+	}
+
+	if restartRequired == nil {
+		restartRequired = []string{}
+	}
+
+	err = app.writeResponse(w, r, http.StatusOK, envelope{"status": "reloaded", "restart_required": restartRequired}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
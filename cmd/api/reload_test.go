@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestReloadConfig(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	writeConfigFile := func(content string) {
+		t.Helper()
+		err := os.WriteFile(file, []byte(content), 0o600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfigFile(`{"admin": {"token": "secret"}, "limiter": {"rps": 2}}`)
+
+	app := newTestApplication()
+	app.configArgs = []string{"-config", file}
+	app.configFlags = newTestFlagSet()
+
+	var err error
+	app.config, err = loadConfig(app.configFlags, app.configArgs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfigFile(`{"admin": {"token": "secret"}, "limiter": {"rps": 5}, "log": {"level": "debug"}, "port": 5000}`)
+
+	restartRequired, err := app.reloadConfig()
+	assert.NoError(t, err)
+	assert.Equal(t, strings.Join(restartRequired, ","), "port")
+	assert.Equal(t, app.currentConfig().limiter.rps, 5)
+	assert.Equal(t, app.logLevel.Level(), slog.LevelDebug)
+
+	// The port only changes on a restart.
+	assert.Equal(t, app.currentConfig().port, 4000)
+
+	// An invalid config is rejected as a whole.
+	writeConfigFile(`{"admin": {"token": "secret"}, "limiter": {"rps": -1}, "log": {"level": "error"}}`)
+
+	_, err = app.reloadConfig()
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assert.Contains(t, err.Error(), "limiter.rps: must be positive")
+	assert.Equal(t, app.currentConfig().limiter.rps, 5)
+	assert.Equal(t, app.logLevel.Level(), slog.LevelDebug)
+
+	ts := newTestServer(app.adminRoutes())
+	defer ts.Close()
+
+	reload := func() (int, string) {
+		req, err := http.NewRequest(http.MethodPost, ts.URL+"/admin/reload", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		rs, err := ts.Client().Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rs.Body.Close()
+
+		body, err := io.ReadAll(rs.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rs.StatusCode, string(body)
+	}
+
+	code, body := reload()
+	assert.Equal(t, code, http.StatusUnprocessableEntity)
+	assert.Contains(t, body, "the configuration was not reloaded")
+
+	writeConfigFile(`{"admin": {"token": "secret"}, "limiter": {"rps": 7}}`)
+
+	code, body = reload()
+	assert.Equal(t, code, http.StatusOK)
+	assert.Contains(t, body, `"status":"reloaded"`)
+	assert.Equal(t, app.currentConfig().limiter.rps, 7)
+	assert.Equal(t, app.logLevel.Level(), slog.LevelInfo)
+
+	// Rules changed through the admin API survive a reload, while the other rules
+	// settings still come from the config.
+	status, _ := ts.adminDo(t, http.MethodPut, "/admin/rules", "secret", `{"verified_bonus": 25}`)
+	assert.Equal(t, status, http.StatusOK)
+
+	writeConfigFile(`{"admin": {"token": "secret"}, "rules": {"verified-bonus": 10, "require-verified": true}}`)
+
+	code, _ = reload()
+	assert.Equal(t, code, http.StatusOK)
+	assert.Equal(t, app.currentConfig().rules.verifiedBonus, 25)
+	assert.Equal(t, app.currentConfig().rules.requireVerified, true)
+}
@@ -13,8 +13,12 @@ import (
 // 404 Not Found and 405 Method Not Allowed responses. It also registers routes
 // for API endpoints, linking HTTP methods and URL patterns to specific handler functions.
 //
-// Additionally, the method wraps the router with middleware, such as panic recovery
-// and rate limiting, before returning the final http.Handler instance.
+// Additionally, the method wraps the router with middleware before returning the
+// final http.Handler instance. Every request passes, in order, through request ID,
+// security headers, CORS, compression, metrics, tracing, access log, panic recovery,
+// service mode, rate limit and client certificates. Each route then adds its own IP
+// filter, timeout and load shedding and, for submissions, the signature and abuse
+// checks.
 //
 // Returns:
 // - An http.Handler instance with all routes and middleware configured.
@@ -25,11 +29,67 @@ func (app *application) routes() http.Handler {
 	router.NotFound = http.HandlerFunc(app.notFoundResponse)
 	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
 
-	// Register routes
-	router.HandlerFunc(http.MethodGet, "/healthcheck", app.healthcheckHandler)
-	router.HandlerFunc(http.MethodPost, "/receipts/process", app.processReceiptHandler)
-	router.HandlerFunc(http.MethodGet, "/receipts/:id/points", app.getPointsHandler)
+	// OPTIONS requests, including CORS preflights, get the route's allowed methods.
+	router.GlobalOPTIONS = http.HandlerFunc(app.preflightHandler)
 
-	// Register rateLimit and recoverPanic middleware
-	return app.recoverPanic(app.rateLimit(router))
+	// Register routes. Each route is wrapped with the IP filter for its route group and,
+	// except for the health endpoints, a deadline and the concurrency limiter for its
+	// route class. Time spent waiting for a slot counts towards the deadline.
+	router.Handler(http.MethodGet, "/healthcheck", app.ipFilter(ipGroupSystem, http.HandlerFunc(app.healthcheckHandler)))
+	router.Handler(http.MethodGet, "/livez", app.ipFilter(ipGroupSystem, http.HandlerFunc(app.livezHandler)))
+	router.Handler(http.MethodGet, "/readyz", app.ipFilter(ipGroupSystem, http.HandlerFunc(app.readyzHandler)))
+	router.Handler(http.MethodPost, "/receipts/process", app.ipFilter(ipGroupReceiptsWrite, app.timeout(app.config.timeout.write, app.loadShed(shedClassReceipts, app.verifySignature(app.abuseGuard(http.HandlerFunc(app.processReceiptHandler)))))))
+	router.Handler(http.MethodPut, "/receipts/:id", app.ipFilter(ipGroupReceiptsWrite, app.timeout(app.config.timeout.write, app.loadShed(shedClassReceipts, app.verifySignature(app.abuseGuard(http.HandlerFunc(app.updateReceiptHandler)))))))
+	router.Handler(http.MethodDelete, "/receipts/:id", app.ipFilter(ipGroupReceiptsWrite, app.timeout(app.config.timeout.write, app.loadShed(shedClassReceipts, app.verifySignature(http.HandlerFunc(app.deleteReceiptHandler))))))
+	router.Handler(http.MethodGet, "/receipts/:id/points", app.ipFilter(ipGroupReceiptsRead, app.timeout(app.config.timeout.read, app.loadShed(shedClassReceipts, http.HandlerFunc(app.getPointsHandler)))))
+	router.Handler(http.MethodGet, "/.well-known/fetch-attestation-keys", app.ipFilter(ipGroupReceiptsRead, app.timeout(app.config.timeout.read, app.loadShed(shedClassKeys, http.HandlerFunc(app.attestationKeysHandler)))))
+
+	// Register requestID, secureHeaders, cors, compress, instrument, trace, logAccess,
+	// recoverPanic, serviceMode, rateLimit and clientCertificate middleware. CORS comes
+	// before anything that can reject a request, so browsers can read the rejection.
+	return app.requestID(app.secureHeaders(app.cors(app.compress(app.instrument(router, app.trace(router, app.logAccess(router, app.recoverPanic(app.serviceMode(app.rateLimit(app.clientCertificate(router)))))))))))
+}
+
+// adminRoutes returns the handler for the admin listener. It has its own router so
+// none of these routes can be reached on the public port. Every route requires an
+// admin token with the route's scope (see requireScope), and is also subject to the
+// IP rules of the system group.
+func (app *application) adminRoutes() http.Handler {
+	router := httprouter.New()
+	router.NotFound = http.HandlerFunc(app.notFoundResponse)
+	router.MethodNotAllowed = http.HandlerFunc(app.methodNotAllowedResponse)
+
+	handle := func(method, path, scope string, h http.HandlerFunc) {
+		router.Handler(method, path, app.ipFilter(ipGroupSystem, app.requireScope(scope, h)))
+	}
+
+	handle(http.MethodGet, "/metrics", adminScopeMetrics, app.metrics.registry.Handler().ServeHTTP)
+
+	// Profiles expose memory contents and can be costly to take, so they are opt-in.
+	if app.config.admin.debug {
+		handle(http.MethodGet, "/debug/vars", adminScopeDebug, app.debugVarsHandler)
+		handle(http.MethodGet, "/debug/pprof/*profile", adminScopeDebug, app.pprofHandler)
+		handle(http.MethodPost, "/debug/pprof/*profile", adminScopeDebug, app.pprofHandler)
+	}
+
+	handle(http.MethodPost, "/admin/reload", adminScopeConfig, app.adminReloadHandler)
+	handle(http.MethodGet, "/admin/log-level", adminScopeConfig, app.adminLogLevelHandler)
+	handle(http.MethodPut, "/admin/log-level", adminScopeConfig, app.adminSetLogLevelHandler)
+	handle(http.MethodGet, "/admin/mode", adminScopeConfig, app.adminModeHandler)
+	handle(http.MethodPut, "/admin/mode", adminScopeConfig, app.adminSetModeHandler)
+
+	handle(http.MethodGet, "/admin/stats", adminScopeStore, app.adminStatsHandler)
+	handle(http.MethodGet, "/admin/audit", adminScopeStore, app.adminAuditHandler)
+	handle(http.MethodGet, "/admin/audit/verify", adminScopeStore, app.adminAuditVerifyHandler)
+
+	handle(http.MethodGet, "/admin/rules", adminScopeRules, app.adminRulesHandler)
+	handle(http.MethodPut, "/admin/rules", adminScopeRules, app.adminUpdateRulesHandler)
+	handle(http.MethodGet, "/admin/abuse", adminScopeRules, app.adminAbuseHandler)
+
+	handle(http.MethodGet, "/admin/keys", adminScopeKeys, app.adminKeysHandler)
+	handle(http.MethodPost, "/admin/keys/attestation/rotate", adminScopeKeys, app.adminRotateAttestationKeyHandler)
+	handle(http.MethodPost, "/admin/keys/trust", adminScopeKeys, app.adminAddTrustKeyHandler)
+	handle(http.MethodDelete, "/admin/keys/trust", adminScopeKeys, app.adminRemoveTrustKeyHandler)
+
+	return app.requestID(app.secureHeaders(app.compress(app.logAccess(router, app.recoverPanic(router)))))
 }
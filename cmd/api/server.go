@@ -5,53 +5,195 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 )
 
-// serve starts the HTTP server and handles graceful shutdowns upon receiving
-// termination signals (SIGINT, SIGTERM).
+// writeTimeout is the API server's write timeout. Route deadlines must be shorter, so
+// their timeout response can still be written.
+const writeTimeout = 10 * time.Second
+
+// serve starts the HTTP server, or the HTTPS server if a TLS certificate is configured,
+// and handles graceful shutdowns upon receiving termination signals (SIGINT, SIGTERM).
+// The API listens on the TCP port or, if one is configured, on a unix socket, and can
+// accept HTTP/2 cleartext (h2c). Timeouts and shutdown are the same either way.
+//
+// The listening sockets are inherited when the process was started by systemd socket
+// activation or by a graceful upgrade, and opened otherwise. On SIGUSR2 the server
+// starts a new copy of itself, hands it the sockets, and shuts down once the new
+// process is serving, so no connection is refused during a deploy.
 //
 // Returns:
 //   - `nil` if the server starts and shuts down successfully.
-//   - Any error encountered during ListenAndServe() or Shutdown() if they occur.
+//   - Any error encountered during Serve(), ServeTLS() or Shutdown() if they occur.
 func (app *application) serve() error {
+	tlsConfig, err := app.tlsConfig()
+	if err != nil {
+		return err
+	}
+
+	addr := fmt.Sprintf(":%d", app.config.port)
+	if app.config.listen.socket != "" {
+		addr = app.config.listen.socket
+	}
+
 	srv := &http.Server{
-		Addr:         fmt.Sprintf(":%d", app.config.port),
+		Addr:         addr,
 		Handler:      app.routes(),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
+		WriteTimeout: writeTimeout,
 		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		TLSConfig:    tlsConfig,
+		Protocols:    app.protocols(),
+	}
+
+	// The admin API has its own listener, which shuts down with the API server. CPU
+	// profiles and traces stream for as long as their ?seconds parameter asks, so
+	// there is no write timeout.
+	var adminSrv *http.Server
+	if app.config.admin.addr != "" {
+		adminSrv = &http.Server{
+			Addr:        app.config.admin.addr,
+			Handler:     app.adminRoutes(),
+			IdleTimeout: time.Minute,
+			ReadTimeout: 5 * time.Second,
+			ErrorLog:    slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
+		}
+	}
+
+	inherited, err := inheritedListeners(listenFDsStart)
+	if err != nil {
+		return err
+	}
+
+	listeners := make(map[string]net.Listener)
+
+	ln, err := app.listenAPI(inherited)
+	if err != nil {
+		return err
+	}
+	listeners[listenerAPI] = ln
+
+	if adminSrv != nil {
+		adminLn, err := listen(inherited, listenerAdmin, "tcp", adminSrv.Addr)
+		if err != nil {
+			return err
+		}
+		listeners[listenerAdmin] = adminLn
 	}
 
 	// Use this to receive any errors returned by the graceful Shutdown() function.
 	shutdownError := make(chan error)
 
-	// Listening for termination signals (SIGINT, SIGTERM).
-	go func() {
+	// Listening for termination signals (SIGINT, SIGTERM), and SIGUSR2 for upgrades.
+	app.background("server", func(context.Context) {
 		quit := make(chan os.Signal, 1)
-		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-		s := <-quit // block until detect a signal
+		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR2)
+
+		var s os.Signal
+		for {
+			s = <-quit // block until detect a signal
+			if s != syscall.SIGUSR2 {
+				break
+			}
+
+			// A failed upgrade leaves this process serving as before.
+			app.logger.Info("upgrading server", "signal", s.String())
+			err := app.upgrade(listeners, app.config.shutdown.upgradeTimeout)
+			if err != nil {
+				app.logger.Error("upgrade failed", "error", err.Error())
+				continue
+			}
+			break
+		}
 
 		app.logger.Info("shutting down server", "signal", s.String())
 
+		// Fail readiness first and keep serving while load balancers notice. After an
+		// upgrade the new process accepts on the same sockets, so there is nothing to
+		// wait for.
+		app.shuttingDown.Store(true)
+		if s != syscall.SIGUSR2 && app.config.shutdown.drainDelay > 0 {
+			app.logger.Info("draining", "delay", app.config.shutdown.drainDelay.String())
+			time.Sleep(app.config.shutdown.drainDelay)
+		}
+
 		// Create a context with a 30-second timeout.
 		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer cancel()
 
-		// Relay this return value to the shutdownError channel.
-		shutdownError <- srv.Shutdown(ctx)
-	}()
+		// Shut both servers down at once. The admin server has no write timeout, as
+		// profiles stream, so it can fail to drain in time; the public server must close
+		// regardless, or Serve never returns.
+		var adminErr error
+		var wg sync.WaitGroup
+		if adminSrv != nil {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				adminErr = adminSrv.Shutdown(ctx)
+			}()
+		}
+
+		err := srv.Shutdown(ctx)
+		wg.Wait()
+
+		// Relay both results to the shutdownError channel.
+		shutdownError <- errors.Join(err, adminErr)
+	})
+
+	// Reload the configuration on SIGHUP.
+	app.background("reload", func(ctx context.Context) {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		defer signal.Stop(hup)
 
-	app.logger.Info("starting server", "addr", srv.Addr, "env", app.config.env)
+		for {
+			select {
+			case <-hup:
+				app.reload("SIGHUP")
+			case <-ctx.Done():
+				return
+			}
+		}
+	})
 
-	// ListenAndServe() will immediately return a http.ErrServerClosed error if
-	// Shutdown is called. So we only need to report error that not http.ErrServerClosed.
-	err := srv.ListenAndServe()
+	if adminSrv != nil {
+		app.background("server", func(context.Context) {
+			app.logger.Info("starting admin server", "addr", listeners[listenerAdmin].Addr().String())
+
+			err := adminSrv.Serve(listeners[listenerAdmin])
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.Error("admin server failed", "addr", adminSrv.Addr, "error", err.Error())
+			}
+		})
+	}
+
+	app.logger.Info("starting server", "addr", ln.Addr().String(), "env", app.config.env, "tls", srv.TLSConfig != nil,
+		"inherited", inherited[listenerAPI] != nil, "mode", app.config.service.mode)
+
+	// The sockets are already accepting connections, so a parent process waiting on an
+	// upgrade can stop now.
+	err = notifyReady()
+	if err != nil {
+		app.logger.Error("failed to notify the parent process", "error", err.Error())
+	}
+
+	// Serve() will immediately return a http.ErrServerClosed error if Shutdown is
+	// called. So we only need to report error that not http.ErrServerClosed.
+	// The certificate comes from TLSConfig.GetCertificate, so no files are passed to
+	// ServeTLS().
+	if srv.TLSConfig != nil {
+		err = srv.ServeTLS(ln, "", "")
+	} else {
+		err = srv.Serve(ln)
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -64,6 +206,7 @@ func (app *application) serve() error {
 
 	// Shutdown completed successfully
 	app.logger.Info("stopped server", "addr", srv.Addr)
+	app.stopBackground()
 
 	return nil
 }
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"fetch.trungnng.github.io/internal/concurrency"
+)
+
+// Route classes for load shedding. Each class has its own concurrency limiter, so a
+// burst on one can't starve the other. Health endpoints have no class and are never
+// shed.
+const (
+	shedClassReceipts = "receipts"
+	shedClassKeys     = "keys"
+)
+
+// newShedders creates a concurrency limiter for each route class.
+func newShedders(cfg config) map[string]*concurrency.Limiter {
+	shedders := make(map[string]*concurrency.Limiter)
+	for _, class := range []string{shedClassReceipts, shedClassKeys} {
+		shedders[class] = concurrency.New(concurrency.Config{
+			InitialLimit: cfg.shed.initialLimit,
+			MinLimit:     cfg.shed.minLimit,
+			MaxLimit:     cfg.shed.maxLimit,
+			MaxQueue:     cfg.shed.queueSize,
+			QueueTimeout: cfg.shed.queueTimeout,
+		})
+	}
+	return shedders
+}
+
+// loadShed is a middleware which holds a slot of the route class's concurrency limiter
+// for the duration of the request. Reads wait ahead of writes when the limit is
+// reached, and requests that can't get a slot are shed with 503 Service Unavailable.
+func (app *application) loadShed(class string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter := app.shedders[class]
+		if limiter == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		priority, priorityName := concurrency.Low, "write"
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			priority, priorityName = concurrency.High, "read"
+		}
+
+		start := time.Now()
+		release, err := limiter.Acquire(r.Context(), priority)
+		app.metrics.queueWait.With(class).Observe(time.Since(start).Seconds())
+		app.recordConcurrency(class, limiter)
+
+		if err != nil {
+			// A client that gave up while queued wasn't shed.
+			if isContextError(err) {
+				app.contextErrorResponse(w, r, err)
+				return
+			}
+
+			app.metrics.shed.With(class, priorityName).Inc()
+			app.overloadedResponse(w, r, app.currentConfig().shed.retryAfter)
+			return
+		}
+
+		defer func() {
+			release()
+			app.recordConcurrency(class, limiter)
+		}()
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// recordConcurrency updates the limit and queue gauges of a route class.
+func (app *application) recordConcurrency(class string, limiter *concurrency.Limiter) {
+	stats := limiter.Stats()
+	app.metrics.concurrencyLimit.With(class).Set(float64(stats.Limit))
+	app.metrics.concurrencyActive.With(class).Set(float64(stats.InFlight))
+	app.metrics.queueLength.With(class).Set(float64(stats.Queued))
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/concurrency"
+)
+
+func TestLoadShed(t *testing.T) {
+	app := newTestApplication()
+	app.config.shed.retryAfter = 2 * time.Second
+
+	limiter := concurrency.New(concurrency.Config{
+		InitialLimit: 1,
+		MinLimit:     1,
+		MaxLimit:     1,
+		MaxQueue:     1,
+		QueueTimeout: 5 * time.Second,
+	})
+	app.shedders = map[string]*concurrency.Limiter{shedClassReceipts: limiter}
+
+	unblock := make(chan struct{})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Block") != "" {
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	handler := app.loadShed(shedClassReceipts, next)
+
+	serve := func(method string, block bool) chan *httptest.ResponseRecorder {
+		done := make(chan *httptest.ResponseRecorder, 1)
+		go func() {
+			rr := httptest.NewRecorder()
+			r := httptest.NewRequest(method, "/", nil)
+			if block {
+				r.Header.Set("X-Block", "1")
+			}
+			handler.ServeHTTP(rr, r)
+			done <- rr
+		}()
+		return done
+	}
+
+	waitFor := func(want concurrency.Stats) {
+		t.Helper()
+		for range 100 {
+			if limiter.Stats() == want {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("got: %+v; want: %+v", limiter.Stats(), want)
+	}
+
+	// The first request takes the only slot and the second waits in the queue.
+	first := serve(http.MethodPost, true)
+	waitFor(concurrency.Stats{Limit: 1, InFlight: 1})
+
+	// A client that gives up while queued isn't counted as shed.
+	ctx, cancel := context.WithCancel(t.Context())
+	cancelled := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequestWithContext(ctx, http.MethodPost, "/", nil))
+		cancelled <- rr
+	}()
+	waitFor(concurrency.Stats{Limit: 1, InFlight: 1, Queued: 1})
+	cancel()
+
+	rr := <-cancelled
+	assert.Equal(t, rr.Code, http.StatusServiceUnavailable)
+	assert.Contains(t, rr.Body.String(), "the request was cancelled before it could be processed")
+	waitFor(concurrency.Stats{Limit: 1, InFlight: 1})
+
+	queuedWrite := serve(http.MethodPost, false)
+	waitFor(concurrency.Stats{Limit: 1, InFlight: 1, Queued: 1})
+
+	// With the queue full, another write is shed straight away.
+	rr = <-serve(http.MethodPost, false)
+	assert.Equal(t, rr.Code, http.StatusServiceUnavailable)
+	assert.Equal(t, rr.Header().Get("Retry-After"), "2")
+	assert.Contains(t, rr.Body.String(), "the server is overloaded, please retry later")
+
+	// A read takes the queued write's place.
+	read := serve(http.MethodGet, false)
+	rr = <-queuedWrite
+	assert.Equal(t, rr.Code, http.StatusServiceUnavailable)
+	waitFor(concurrency.Stats{Limit: 1, InFlight: 1, Queued: 1})
+
+	close(unblock)
+	assert.Equal(t, (<-first).Code, http.StatusOK)
+	assert.Equal(t, (<-read).Code, http.StatusOK)
+
+	var metrics strings.Builder
+	assert.NoError(t, app.metrics.registry.WriteText(&metrics))
+	assert.Contains(t, metrics.String(), `load_shed_total{class="receipts",priority="write"} 2`)
+	assert.Contains(t, metrics.String(), `concurrency_limit{class="receipts"} 1`)
+	assert.Contains(t, metrics.String(), `concurrency_queue_length{class="receipts"} 0`)
+}
+
+func TestConcurrencyLimitAdapts(t *testing.T) {
+	limiter := concurrency.New(concurrency.Config{
+		InitialLimit: 10,
+		MinLimit:     5,
+		MaxLimit:     20,
+		QueueTimeout: time.Second,
+	})
+
+	// acquire fills n slots and returns their release functions.
+	acquire := func(n int) []func() {
+		t.Helper()
+
+		var releases []func()
+		for range n {
+			release, err := limiter.Acquire(t.Context(), concurrency.High)
+			if err != nil {
+				t.Fatal(err)
+			}
+			releases = append(releases, release)
+		}
+		return releases
+	}
+
+	// Requests that keep the limit in use at a steady latency raise it.
+	for range 50 {
+		releases := acquire(limiter.Stats().Limit)
+		time.Sleep(time.Millisecond)
+		for _, release := range releases {
+			release()
+		}
+	}
+	assert.Equal(t, limiter.Stats().Limit, 20)
+
+	// Over the limit, with no queue, requests are shed.
+	releases := acquire(20)
+	_, err := limiter.Acquire(t.Context(), concurrency.High)
+	assert.Equal(t, err, concurrency.ErrShed)
+
+	// Requests that slow down lower it.
+	for _, release := range releases {
+		time.Sleep(5 * time.Millisecond)
+		release()
+	}
+	assert.Equal(t, limiter.Stats().Limit < 20, true)
+}
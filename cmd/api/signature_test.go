@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/pkg/reqsign"
+)
+
+func TestVerifySignature(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	app := newTestApplication()
+	app.config.signing.tolerance = 5 * time.Minute
+	app.signingSecrets = map[string][]byte{"partner-1": secret}
+	app.nonces = newNonceCache()
+
+	handler := app.verifySignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, app.contextGetPartner(r)+" "+string(body))
+	}))
+
+	newRequest := func(body string) *http.Request {
+		return httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	}
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	t.Run("Valid signature", func(t *testing.T) {
+		r := newRequest(`{"retailer":"Target"}`)
+		assert.NoError(t, reqsign.Sign(r, "partner-1", secret))
+
+		rr := serve(r)
+		assert.Equal(t, rr.Code, http.StatusOK)
+		assert.Equal(t, rr.Body.String(), `partner-1 {"retailer":"Target"}`)
+
+		// Replaying the exact same request is rejected.
+		r2 := newRequest(`{"retailer":"Target"}`)
+		r2.Header = r.Header.Clone()
+
+		rr = serve(r2)
+		assert.Equal(t, rr.Code, http.StatusUnauthorized)
+		assert.Contains(t, rr.Body.String(), errSignatureReplayed.Error())
+
+		// So is replaying it against another signed route, which shares the nonces.
+		other := app.verifySignature(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+		r3 := newRequest(`{"retailer":"Target"}`)
+		r3.Header = r.Header.Clone()
+
+		rr = httptest.NewRecorder()
+		other.ServeHTTP(rr, r3)
+		assert.Equal(t, rr.Code, http.StatusUnauthorized)
+		assert.Contains(t, rr.Body.String(), errSignatureReplayed.Error())
+	})
+
+	tests := []struct {
+		name     string
+		prepare  func(r *http.Request)
+		expected error
+	}{
+		{
+			name: "Tampered body",
+			prepare: func(r *http.Request) {
+				reqsign.Sign(r, "partner-1", secret)
+				r.Body = io.NopCloser(strings.NewReader(`{"retailer":"Walmart"}`))
+			},
+			expected: errSignatureInvalid,
+		},
+		{
+			name: "Tampered query",
+			prepare: func(r *http.Request) {
+				reqsign.Sign(r, "partner-1", secret)
+				r.URL.RawQuery = "source=pos"
+			},
+			expected: errSignatureInvalid,
+		},
+		{
+			name: "Wrong secret",
+			prepare: func(r *http.Request) {
+				reqsign.Sign(r, "partner-1", []byte("not-the-right-secret-not-the-right"))
+			},
+			expected: errSignatureInvalid,
+		},
+		{
+			name: "Stale timestamp",
+			prepare: func(r *http.Request) {
+				reqsign.SignAt(r, "partner-1", secret, time.Now().Add(-10*time.Minute))
+			},
+			expected: errSignatureStale,
+		},
+		{
+			name: "Unknown key",
+			prepare: func(r *http.Request) {
+				reqsign.Sign(r, "partner-2", secret)
+			},
+			expected: errSignatureUnknownKey,
+		},
+		{
+			name: "Missing header",
+			prepare: func(r *http.Request) {
+				reqsign.Sign(r, "partner-1", secret)
+				r.Header.Del(reqsign.HeaderNonce)
+			},
+			expected: errSignatureIncomplete,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newRequest(`{"retailer":"Target"}`)
+			tc.prepare(r)
+
+			rr := serve(r)
+			assert.Equal(t, rr.Code, http.StatusUnauthorized)
+			assert.Contains(t, rr.Body.String(), tc.expected.Error())
+		})
+	}
+
+	t.Run("Signed query", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/receipts/process?source=pos", strings.NewReader(`{}`))
+		assert.NoError(t, reqsign.Sign(r, "partner-1", secret))
+
+		rr := serve(r)
+		assert.Equal(t, rr.Code, http.StatusOK)
+	})
+
+	t.Run("Unreadable body", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodDelete, "/receipts/1", nil)
+		assert.NoError(t, reqsign.Sign(r, "partner-1", secret))
+		r.Body = io.NopCloser(io.MultiReader(strings.NewReader("{"), failingReader{}))
+
+		rr := serve(r)
+		assert.Equal(t, rr.Code, http.StatusBadRequest)
+		assert.Contains(t, rr.Body.String(), "The request body could not be read")
+	})
+
+	t.Run("Unsigned request", func(t *testing.T) {
+		rr := serve(newRequest(`{}`))
+		assert.Equal(t, rr.Code, http.StatusOK)
+
+		app.config.signing.required = true
+		defer func() { app.config.signing.required = false }()
+
+		rr = serve(newRequest(`{}`))
+		assert.Equal(t, rr.Code, http.StatusUnauthorized)
+		assert.Contains(t, rr.Body.String(), errSignatureMissing.Error())
+	})
+}
+
+// failingReader is a request body that can't be read.
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset")
+}
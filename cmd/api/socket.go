@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// parseSocketMode parses octal unix socket permissions such as "0660".
+func parseSocketMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	if mode > 0o777 {
+		return 0, fmt.Errorf("invalid permissions %q", s)
+	}
+
+	return os.FileMode(mode), nil
+}
+
+// listenUnix listens on a unix socket at path and sets its permissions. A socket
+// left behind by a process that has exited is removed first. A socket that still
+// accepts connections, or a path that isn't a socket, is an error.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	err := removeStaleSocket(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, mode)
+	if err != nil {
+		ln.Close()
+		return nil, err
+	}
+
+	return unixListener{ln.(*net.UnixListener)}, nil
+}
+
+// removeStaleSocket removes the unix socket at path if no process is listening on it.
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if fi.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+
+	return os.Remove(path)
+}
+
+// unixListener reports the peers of unix socket connections as 127.0.0.1. They are
+// local processes, and the IP rules and access log expect a host:port remote
+// address. The embedded listener keeps File() and SetUnlinkOnClose() for upgrades.
+type unixListener struct {
+	*net.UnixListener
+}
+
+func (ln unixListener) Accept() (net.Conn, error) {
+	conn, err := ln.UnixListener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return unixConn{conn}, nil
+}
+
+type unixConn struct {
+	net.Conn
+}
+
+func (c unixConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+}
+
+// fromUnixSocket reports whether the request came in over a unix socket. Its peers
+// all share the address unixConn reports, and are usually a sidecar proxy relaying
+// many clients, so the per-client rate limit and abuse bans don't apply to them.
+func fromUnixSocket(r *http.Request) bool {
+	addr, _ := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	_, ok := addr.(*net.UnixAddr)
+	return ok
+}
+
+// listenAPI returns the API listener: the inherited one if there is one, otherwise
+// the unix socket if one is configured, otherwise the TCP port.
+func (app *application) listenAPI(inherited map[string]net.Listener) (net.Listener, error) {
+	if ln, ok := inherited[listenerAPI]; ok {
+		return ln, nil
+	}
+
+	if app.config.listen.socket == "" {
+		return net.Listen("tcp", fmt.Sprintf(":%d", app.config.port))
+	}
+
+	mode, err := parseSocketMode(app.config.listen.socketMode)
+	if err != nil {
+		return nil, err
+	}
+
+	return listenUnix(app.config.listen.socket, mode)
+}
+
+// protocols returns the protocols the API server accepts. Without h2c it returns nil,
+// which keeps the net/http defaults: HTTP/1 and, over TLS, HTTP/2.
+func (app *application) protocols() *http.Protocols {
+	if !app.config.listen.h2c {
+		return nil
+	}
+
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return protocols
+}
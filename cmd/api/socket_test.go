@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "api.sock")
+
+	ln, err := listenUnix(path, 0o600)
+	assert.NoError(t, err)
+
+	fi, err := os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o600))
+
+	// A socket that is still accepting connections is not replaced.
+	_, err = listenUnix(path, 0o600)
+	assert.Equal(t, err.Error(), path+" is in use by another process")
+
+	// A socket whose process has gone is.
+	ln.(unixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	ln, err = listenUnix(path, 0o660)
+	assert.NoError(t, err)
+	defer ln.Close()
+
+	fi, err = os.Stat(path)
+	assert.NoError(t, err)
+	assert.Equal(t, fi.Mode().Perm(), os.FileMode(0o660))
+
+	// Other files are never removed.
+	file := filepath.Join(t.TempDir(), "api.sock")
+	err = os.WriteFile(file, nil, 0o600)
+	assert.NoError(t, err)
+
+	_, err = listenUnix(file, 0o600)
+	assert.Equal(t, err.Error(), file+" exists and is not a socket")
+}
+
+func TestParseSocketMode(t *testing.T) {
+	mode, err := parseSocketMode("0660")
+	assert.NoError(t, err)
+	assert.Equal(t, mode, os.FileMode(0o660))
+
+	for _, s := range []string{"", "660x", "0999", "01777"} {
+		_, err := parseSocketMode(s)
+		if err == nil {
+			t.Errorf("parseSocketMode(%q): want error", s)
+		}
+	}
+}
+
+func TestUnixSocketH2C(t *testing.T) {
+	app := newTestApplication()
+	app.config.listen.h2c = true
+
+	path := filepath.Join(t.TempDir(), "api.sock")
+	ln, err := listenUnix(path, 0o600)
+	assert.NoError(t, err)
+
+	srv := &http.Server{Handler: app.routes(), Protocols: app.protocols()}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// Speak HTTP/2 without TLS and without an upgrade from HTTP/1.
+	protocols := new(http.Protocols)
+	protocols.SetUnencryptedHTTP2(true)
+	client := &http.Client{
+		Transport: &http.Transport{
+			Protocols: protocols,
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	rs, err := client.Get("http://api/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.ProtoMajor, 2)
+
+	// Unix socket peers all share one address, so they aren't rate limited.
+	app.configMu.Lock()
+	app.config.limiter.enabled = true
+	app.config.limiter.rps = 1
+	app.config.limiter.burst = 1
+	app.configMu.Unlock()
+
+	for range 3 {
+		rs, err = client.Get("http://api/healthcheck")
+		if err != nil {
+			t.Fatal(err)
+		}
+		rs.Body.Close()
+
+		assert.Equal(t, rs.StatusCode, http.StatusOK)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log/slog"
 	"net/http"
@@ -13,9 +15,13 @@ import (
 // containing mocked dependencies. We need to init a new logger because it
 // is needed for the recover panic and rate limit middleware
 func newTestApplication() *application {
-	return &application{
-		logger: slog.New(slog.NewTextHandler(io.Discard, nil)),
+	app := &application{
+		logger:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		logLevel: new(slog.LevelVar),
 	}
+	app.backgroundCtx, app.stopBackground = context.WithCancel(context.Background())
+	app.metrics = app.newMetrics()
+	return app
 }
 
 // Define a custom testServer type which embeds a httptest.Server instance.
@@ -64,3 +70,6 @@ func (ts *testServer) post(t *testing.T, urlPath string, body io.Reader) (int, h
 
 	return rs.StatusCode, rs.Header, string(resBody)
 }
+
+// errTest is a generic error for tests that need one.
+var errTest = errors.New("test error")
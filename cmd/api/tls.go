@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tlsVersions maps the values accepted by the -tls-min-version flag to crypto/tls
+// version numbers.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsClientAuthModes maps the values accepted by the -tls-client-auth flag to the
+// crypto/tls client authentication policy.
+var tlsClientAuthModes = map[string]tls.ClientAuthType{
+	"none":    tls.NoClientCert,
+	"request": tls.VerifyClientCertIfGiven,
+	"require": tls.RequireAndVerifyClientCert,
+}
+
+// parseCipherSuites turns a comma-separated list of cipher suite names, such as
+// "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256", into their IDs. The order of the list is
+// kept. Insecure suites are rejected. TLS 1.3 suites are not configurable in Go, so the
+// list only applies to TLS 1.2 and below, and naming a TLS 1.3 suite is an error rather
+// than a setting that is silently ignored.
+func parseCipherSuites(list string) ([]uint16, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	suites := make(map[string]*tls.CipherSuite)
+	for _, s := range tls.CipherSuites() {
+		suites[s.Name] = s
+	}
+
+	var ids []uint16
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		suite, ok := suites[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS cipher suite %q", name)
+		}
+		if !slices.ContainsFunc(suite.SupportedVersions, func(v uint16) bool { return v <= tls.VersionTLS12 }) {
+			return nil, fmt.Errorf("TLS cipher suite %q is a TLS 1.3 suite, which can't be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+
+	return ids, nil
+}
+
+// certReloader holds the server certificate and the client CA pool, and reloads them
+// from disk when the files change. New handshakes pick up the reloaded files while
+// established connections carry on with the ones they negotiated.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	caFile   string
+
+	mu       sync.RWMutex
+	cert     *tls.Certificate
+	clientCA *x509.CertPool
+	modTimes map[string]time.Time
+}
+
+// newCertReloader loads the certificate, key and optional client CA bundle.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	cr := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+
+	_, err := cr.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+// files returns the paths watched by the reloader.
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.caFile != "" {
+		files = append(files, cr.caFile)
+	}
+	return files
+}
+
+// reload re-reads the files if any of their modification times changed. It reports
+// whether a reload happened. On error the previously loaded files stay in use.
+func (cr *certReloader) reload() (bool, error) {
+	modTimes := make(map[string]time.Time)
+	for _, file := range cr.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		modTimes[file] = info.ModTime()
+	}
+
+	cr.mu.RLock()
+	changed := cr.cert == nil
+	for file, modTime := range modTimes {
+		if !cr.modTimes[file].Equal(modTime) {
+			changed = true
+		}
+	}
+	cr.mu.RUnlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return false, err
+	}
+
+	var pool *x509.CertPool
+	if cr.caFile != "" {
+		pem, err := os.ReadFile(cr.caFile)
+		if err != nil {
+			return false, err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("%s: no certificates found", cr.caFile)
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.clientCA = pool
+	cr.modTimes = modTimes
+	cr.mu.Unlock()
+
+	return true, nil
+}
+
+// getCertificate implements tls.Config.GetCertificate.
+func (cr *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.cert, nil
+}
+
+// clientCAs returns the current client CA pool.
+func (cr *certReloader) clientCAs() *x509.CertPool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	return cr.clientCA
+}
+
+// tlsConfig builds the server's tls.Config from the application config. It returns
+// nil if TLS is not configured.
+func (app *application) tlsConfig() (*tls.Config, error) {
+	cfg := app.config.tls
+
+	if cfg.certFile == "" && cfg.keyFile == "" {
+		return nil, nil
+	}
+	if cfg.certFile == "" || cfg.keyFile == "" {
+		return nil, errors.New("both -tls-cert and -tls-key must be set to enable TLS")
+	}
+
+	minVersion, ok := tlsVersions[cfg.minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid TLS minimum version %q (must be 1.0, 1.1, 1.2 or 1.3)", cfg.minVersion)
+	}
+
+	clientAuth, ok := tlsClientAuthModes[cfg.clientAuth]
+	if !ok {
+		return nil, fmt.Errorf("invalid TLS client auth mode %q (must be none, request or require)", cfg.clientAuth)
+	}
+	if clientAuth != tls.NoClientCert && cfg.clientCAFile == "" {
+		return nil, errors.New("-tls-client-ca must be set when client certificates are verified")
+	}
+
+	cipherSuites, err := parseCipherSuites(cfg.cipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := newCertReloader(cfg.certFile, cfg.keyFile, cfg.clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// Poll the certificate files so renewed certificates are used without a restart.
+	if cfg.reloadInterval > 0 {
+		app.background("tls", func(ctx context.Context) {
+			for sleep(ctx, cfg.reloadInterval) {
+				reloaded, err := reloader.reload()
+				if err != nil {
+					app.logger.Error("failed to reload TLS certificates", "error", err.Error())
+					continue
+				}
+
+				if reloaded {
+					app.logger.Info("reloaded TLS certificates", "cert", cfg.certFile)
+				}
+			}
+		})
+	}
+
+	base := &tls.Config{
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		ClientAuth:     clientAuth,
+		GetCertificate: reloader.getCertificate,
+		NextProtos:     app.nextProtos(),
+	}
+
+	// GetConfigForClient is called for every handshake, which lets each new connection
+	// see the most recently loaded client CA bundle. The handshake uses the config it
+	// returns, not the server's own clone of base, so base must carry the ALPN
+	// protocols itself.
+	base.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		c := base.Clone()
+		c.ClientCAs = reloader.clientCAs()
+		c.GetConfigForClient = nil
+		return c, nil
+	}
+
+	return base, nil
+}
+
+// nextProtos returns the ALPN protocols offered in TLS handshakes, most preferred
+// first.
+func (app *application) nextProtos() []string {
+	if protocols := app.protocols(); protocols != nil && !protocols.HTTP2() {
+		return []string{"http/1.1"}
+	}
+	return []string{"h2", "http/1.1"}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+// newTestCertificate creates a certificate for commonName signed by parent (or
+// self-signed if parent is nil) and returns it with its private key.
+func newTestCertificate(t *testing.T, commonName string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Fetch Test"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cert, key
+}
+
+// writeTestCertificate writes the certificate and key as PEM files in dir.
+func writeTestCertificate(t *testing.T, dir, name string, cert *x509.Certificate, key *ecdsa.PrivateKey) (string, string) {
+	t.Helper()
+
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+
+	cert1, key1 := newTestCertificate(t, "first", nil, nil)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", cert1, key1)
+
+	cr, err := newCertReloader(certFile, keyFile, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := cr.getCertificate(nil)
+	assert.Equal(t, got.Leaf.Subject.CommonName, "first")
+
+	// Nothing changed on disk, so nothing is reloaded.
+	reloaded, err := cr.reload()
+	assert.NoError(t, err)
+	assert.Equal(t, reloaded, false)
+
+	cert2, key2 := newTestCertificate(t, "second", nil, nil)
+	writeTestCertificate(t, dir, "server", cert2, key2)
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, future, future)
+
+	reloaded, err = cr.reload()
+	assert.NoError(t, err)
+	assert.Equal(t, reloaded, true)
+
+	got, _ = cr.getCertificate(nil)
+	assert.Equal(t, got.Leaf.Subject.CommonName, "second")
+
+	// A broken key keeps the current certificate.
+	os.WriteFile(keyFile, []byte("not a key"), 0o600)
+	os.Chtimes(keyFile, future.Add(time.Minute), future.Add(time.Minute))
+
+	_, err = cr.reload()
+	if err == nil {
+		t.Fatal("expected an error for an invalid key")
+	}
+
+	got, _ = cr.getCertificate(nil)
+	assert.Equal(t, got.Leaf.Subject.CommonName, "second")
+}
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := newTestCertificate(t, "Test CA", nil, nil)
+	serverCert, serverKey := newTestCertificate(t, "server", ca, caKey)
+	clientCert, clientKey := newTestCertificate(t, "partner-1", ca, caKey)
+
+	caFile, _ := writeTestCertificate(t, dir, "ca", ca, caKey)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", serverCert, serverKey)
+
+	app := newTestApplication()
+	app.config.tls.certFile = certFile
+	app.config.tls.keyFile = keyFile
+	app.config.tls.minVersion = "1.2"
+	app.config.tls.clientCAFile = caFile
+	app.config.tls.clientAuth = "require"
+
+	tlsConfig, err := app.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := app.clientCertificate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, app.contextGetClientCertSubject(r))
+	}))
+
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = tlsConfig
+	ts.StartTLS()
+	defer ts.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	// Without a client certificate the handshake fails.
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = client.Get(ts.URL)
+	if err == nil {
+		t.Fatal("expected the handshake to fail without a client certificate")
+	}
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots,
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{clientCert.Raw},
+			PrivateKey:  clientKey,
+		}},
+	}}}
+
+	rs, err := client.Get(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	body, err := io.ReadAll(rs.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, string(body), "CN=partner-1,O=Fetch Test")
+}
+
+func TestTLSConfigValidation(t *testing.T) {
+	tests := []struct {
+		name       string
+		minVersion string
+		clientAuth string
+		ciphers    string
+		clientCA   string
+		expected   string
+	}{
+		{"Invalid version", "1.4", "none", "", "", "invalid TLS minimum version"},
+		{"Invalid client auth", "1.2", "maybe", "", "", "invalid TLS client auth mode"},
+		{"Client auth without CA", "1.2", "require", "", "", "-tls-client-ca must be set"},
+		{"Unknown cipher", "1.2", "none", "TLS_RSA_WITH_RC4_128_SHA", "", "unknown or insecure TLS cipher suite"},
+		{"TLS 1.3 cipher", "1.2", "none", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_AES_128_GCM_SHA256", "", `"TLS_AES_128_GCM_SHA256" is a TLS 1.3 suite`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			app := newTestApplication()
+			app.config.tls.certFile = "cert.pem"
+			app.config.tls.keyFile = "key.pem"
+			app.config.tls.minVersion = tc.minVersion
+			app.config.tls.clientAuth = tc.clientAuth
+			app.config.tls.cipherSuites = tc.ciphers
+			app.config.tls.clientCAFile = tc.clientCA
+
+			_, err := app.tlsConfig()
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tc.expected)
+		})
+	}
+}
+
+func TestTLSNegotiatesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+
+	ca, caKey := newTestCertificate(t, "Test CA", nil, nil)
+	serverCert, serverKey := newTestCertificate(t, "server", ca, caKey)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", serverCert, serverKey)
+
+	app := newTestApplication()
+	app.config.tls.certFile = certFile
+	app.config.tls.keyFile = keyFile
+	app.config.tls.minVersion = "1.2"
+	app.config.tls.clientAuth = "none"
+
+	tlsConfig, err := app.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serve the way serve does, so the handshake goes through GetConfigForClient.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: app.routes(), TLSConfig: tlsConfig, Protocols: app.protocols()}
+	go srv.ServeTLS(ln, "", "")
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{RootCAs: roots, NextProtos: []string{"h2", "http/1.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	assert.Equal(t, conn.ConnectionState().NegotiatedProtocol, "h2")
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, ForceAttemptHTTP2: true}}
+	rs, err := client.Get("https://" + ln.Addr().String() + "/livez")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Body.Close()
+
+	assert.Equal(t, rs.StatusCode, http.StatusOK)
+	assert.Equal(t, rs.ProtoMajor, 2)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"fetch.trungnng.github.io/internal/tracing"
+	"github.com/julienschmidt/httprouter"
+)
+
+// newTracer creates the tracer for the configured exporter. It returns a nil tracer,
+// which records nothing, when tracing is disabled.
+func (app *application) newTracer() (*tracing.Tracer, error) {
+	var exporter tracing.Exporter
+
+	switch app.config.trace.exporter {
+	case "none", "":
+		return nil, nil
+	case "stdout":
+		exporter = tracing.NewWriterExporter(os.Stdout, "fetch")
+	case "file":
+		if app.config.trace.file == "" {
+			return nil, fmt.Errorf("-trace-file must be set for the file trace exporter")
+		}
+		f, err := os.OpenFile(app.config.trace.file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			return nil, err
+		}
+		exporter = tracing.NewWriterExporter(f, "fetch")
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q (must be none, stdout or file)", app.config.trace.exporter)
+	}
+
+	return tracing.New(exporter, func(err error) {
+		app.logger.Error("failed to export spans", "error", err.Error())
+	}), nil
+}
+
+// trace is a middleware which starts a server span for each request. An incoming W3C
+// traceparent header makes the span part of the caller's trace, and the tracestate
+// header is carried along with it. The server span's traceparent is returned in the
+// response so clients can find the trace.
+func (app *application) trace(router *httprouter.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.tracer == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// An invalid traceparent must be ignored and a new trace started.
+		remote, err := tracing.ParseTraceparent(r.Header.Get("traceparent"))
+		if err == nil {
+			remote.TraceState = r.Header.Get("tracestate")
+		}
+
+		route := routePattern(router, r)
+
+		ctx, span := app.tracer.StartServer(r.Context(), r.Method+" "+route, remote)
+		defer span.End()
+
+		span.SetAttribute("http.request.method", r.Method)
+		span.SetAttribute("http.route", route)
+		span.SetAttribute("url.path", r.URL.Path)
+
+		sc := span.SpanContext()
+		w.Header().Set("traceparent", sc.Traceparent())
+		if sc.TraceState != "" {
+			w.Header().Set("tracestate", sc.TraceState)
+		}
+
+		cw := &captureWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r.WithContext(ctx))
+
+		span.SetAttribute("http.response.status_code", cw.status)
+		if cw.status >= 500 {
+			span.SetError(fmt.Errorf("HTTP %s", strconv.Itoa(cw.status)))
+		}
+	})
+}
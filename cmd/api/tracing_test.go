@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+	"fetch.trungnng.github.io/internal/data"
+	"fetch.trungnng.github.io/internal/tracing"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		valid  bool
+	}{
+		{"Valid", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", true},
+		{"Future version with extra field", "01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz", true},
+		{"Version 00 with extra field", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-xyz", false},
+		{"Forbidden version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", false},
+		{"Zero trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"Zero span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01", false},
+		{"Uppercase", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01", false},
+		{"Short trace ID", "00-4bf92f3577b34da6-00f067aa0ba902b7-01", false},
+		{"Empty", "", false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			sc, err := tracing.ParseTraceparent(tc.header)
+			assert.Equal(t, err == nil, tc.valid)
+			if tc.valid {
+				assert.Equal(t, sc.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+				assert.Equal(t, sc.SpanID.String(), "00f067aa0ba902b7")
+			}
+		})
+	}
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	var spans, logs bytes.Buffer
+
+	app := newTestApplication()
+	app.logger = slog.New(newContextHandler(slog.NewTextHandler(&logs, nil)))
+	app.model = data.NewModels()
+	app.tracer = tracing.New(tracing.NewWriterExporter(&spans, "fetch"), nil)
+
+	body := `{
+		"retailer": "Target",
+		"purchaseDate": "2022-01-01",
+		"purchaseTime": "13:01",
+		"items": [{"shortDescription": "Mountain Dew 12PK", "price": "6.49"}],
+		"total": "6.49"
+	}`
+
+	r := httptest.NewRequest(http.MethodPost, "/receipts/process", strings.NewReader(body))
+	r.RemoteAddr = "192.0.2.1:1234"
+	r.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "vendor=abc")
+
+	rr := httptest.NewRecorder()
+	app.routes().ServeHTTP(rr, r)
+	assert.Equal(t, rr.Code, http.StatusOK)
+
+	traceparent, err := tracing.ParseTraceparent(rr.Header().Get("traceparent"))
+	assert.NoError(t, err)
+	assert.Equal(t, traceparent.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, rr.Header().Get("tracestate"), "vendor=abc")
+
+	type exported struct {
+		ResourceSpans []struct {
+			ScopeSpans []struct {
+				Spans []struct {
+					TraceID      string `json:"traceId"`
+					SpanID       string `json:"spanId"`
+					ParentSpanID string `json:"parentSpanId"`
+					Name         string `json:"name"`
+				} `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+
+	parents := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(spans.String()), "\n") {
+		var e exported
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range e.ResourceSpans[0].ScopeSpans[0].Spans {
+			assert.Equal(t, s.TraceID, "4bf92f3577b34da6a3ce929d0e0e4736")
+			parents[s.Name] = s.ParentSpanID
+		}
+	}
+
+	// The server span is a child of the caller's span, and every operation is a child
+	// of the server span.
+	server := traceparent.SpanID.String()
+	assert.Equal(t, parents["POST /receipts/process"], "00f067aa0ba902b7")
+	for _, name := range []string{"readRequest", "ValidateReceipt", "store.Insert", "calculatePoints"} {
+		assert.Equal(t, parents[name], server)
+	}
+
+	// Log lines written with the request context carry the trace ID.
+	logs.Reset()
+	app.logError(r, errTest)
+	assert.Equal(t, strings.Contains(logs.String(), "trace_id="), false)
+
+	ctx, span := app.tracer.Start(r.Context(), "test")
+	app.logError(r.WithContext(ctx), errTest)
+	span.End()
+	assert.Contains(t, logs.String(), "trace_id="+span.SpanContext().TraceID.String())
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables used to hand listening sockets to a process. LISTEN_FDS,
+// LISTEN_PID and LISTEN_FDNAMES follow systemd's socket activation protocol, so the
+// same code path serves systemd and graceful upgrades. The ready fd is specific to
+// upgrades: the new process writes to it once it is serving. It has no FETCH_ prefix
+// because that prefix is reserved for settings.
+const (
+	envListenFDs      = "LISTEN_FDS"
+	envListenPID      = "LISTEN_PID"
+	envListenFDNames  = "LISTEN_FDNAMES"
+	envUpgradeReadyFD = "UPGRADE_READY_FD"
+
+	// listenFDsStart is the first file descriptor passed by socket activation.
+	listenFDsStart = 3
+)
+
+// Listener names. Without LISTEN_FDNAMES, the first inherited socket is the API
+// listener and the second the admin listener.
+const (
+	listenerAPI   = "api"
+	listenerAdmin = "admin"
+)
+
+// inheritedListeners returns the listeners passed in by systemd or by the parent
+// process of an upgrade, keyed on name. It returns an empty map if none were passed.
+// The environment variables are cleared so they don't leak into child processes.
+func inheritedListeners(startFD int) (map[string]net.Listener, error) {
+	defer func() {
+		os.Unsetenv(envListenFDs)
+		os.Unsetenv(envListenPID)
+		os.Unsetenv(envListenFDNames)
+	}()
+
+	listeners := make(map[string]net.Listener)
+
+	count := os.Getenv(envListenFDs)
+	if count == "" {
+		return listeners, nil
+	}
+
+	// systemd sets LISTEN_PID so a child that inherits the environment doesn't take
+	// the sockets for its own.
+	if pid := os.Getenv(envListenPID); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return listeners, nil
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q", envListenFDs, count)
+	}
+
+	names := []string{listenerAPI, listenerAdmin}
+	if s := os.Getenv(envListenFDNames); s != "" {
+		names = strings.Split(s, ":")
+	}
+
+	for i := range n {
+		name := strconv.Itoa(i)
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+
+		f := os.NewFile(uintptr(startFD+i), name)
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("inherited socket %q (fd %d): %w", name, startFD+i, err)
+		}
+
+		// A socket handed over by an upgrade is removed when this process stops, as it
+		// would have been by the process that created it. Sockets from systemd are left
+		// for systemd to manage.
+		if ul, ok := ln.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(os.Getenv(envUpgradeReadyFD) != "")
+			ln = unixListener{ul}
+		}
+
+		listeners[name] = ln
+	}
+
+	return listeners, nil
+}
+
+// listen returns the inherited listener with the given name if there is one, and
+// otherwise listens on addr.
+func listen(inherited map[string]net.Listener, name, network, addr string) (net.Listener, error) {
+	if ln, ok := inherited[name]; ok {
+		return ln, nil
+	}
+
+	return net.Listen(network, addr)
+}
+
+// fileListener is implemented by *net.TCPListener, *net.UnixListener and unixListener.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// upgrade starts a new copy of the running binary with the same arguments and hands
+// it the listeners. It returns once the new process reports that it is serving, or
+// with an error if it exits or doesn't become ready within the timeout. On error the
+// new process is killed and the current one carries on serving.
+func (app *application) upgrade(listeners map[string]net.Listener, timeout time.Duration) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	var files []*os.File
+	var names []string
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	for _, name := range []string{listenerAPI, listenerAdmin} {
+		ln, ok := listeners[name]
+		if !ok {
+			continue
+		}
+
+		fl, ok := ln.(fileListener)
+		if !ok {
+			return fmt.Errorf("listener %q can't be passed to another process", name)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names = append(names, name)
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(os.Environ(),
+		fmt.Sprintf("%s=%d", envListenFDs, len(names)),
+		fmt.Sprintf("%s=%s", envListenFDNames, strings.Join(names, ":")),
+		fmt.Sprintf("%s=%d", envUpgradeReadyFD, listenFDsStart+len(files)),
+	)
+
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	app.logger.Info("started new process", "pid", cmd.Process.Pid)
+
+	err = waitReady(ready, timeout)
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("new process %d did not become ready: %w", cmd.Process.Pid, err)
+	}
+
+	// The new process outlives this one, so it is never waited for. It now owns any
+	// unix socket, which must stay in place when this process closes its listener.
+	cmd.Process.Release()
+
+	for _, ln := range listeners {
+		if ul, ok := ln.(unixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+
+	return nil
+}
+
+// waitReady waits for a "ready" line on r. It fails if r is closed first, which
+// happens when the new process exits, or the timeout passes.
+func waitReady(r *os.File, timeout time.Duration) error {
+	err := r.SetReadDeadline(time.Now().Add(timeout))
+	if err != nil {
+		return err
+	}
+
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return errors.New("timed out")
+		}
+		return errors.New("process exited")
+	}
+	if strings.TrimSpace(line) != "ready" {
+		return fmt.Errorf("unexpected message %q", line)
+	}
+
+	return nil
+}
+
+// notifyReady tells the parent of an upgrade that this process is serving. It does
+// nothing if the process wasn't started by an upgrade.
+func notifyReady() error {
+	s := os.Getenv(envUpgradeReadyFD)
+	if s == "" {
+		return nil
+	}
+	os.Unsetenv(envUpgradeReadyFD)
+
+	fd, err := strconv.Atoi(s)
+	if err != nil {
+		return fmt.Errorf("invalid %s %q", envUpgradeReadyFD, s)
+	}
+
+	f := os.NewFile(uintptr(fd), "ready")
+	defer f.Close()
+
+	_, err = f.WriteString("ready\n")
+	return err
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestInheritedListeners(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// Without LISTEN_FDS nothing is inherited.
+	inherited, err := inheritedListeners(int(f.Fd()))
+	assert.NoError(t, err)
+	assert.Equal(t, len(inherited), 0)
+
+	// Sockets meant for another process are left alone.
+	t.Setenv(envListenFDs, "1")
+	t.Setenv(envListenPID, "1")
+	inherited, err = inheritedListeners(int(f.Fd()))
+	assert.NoError(t, err)
+	assert.Equal(t, len(inherited), 0)
+
+	// The socket is duplicated because inheritedListeners closes the fd it is given.
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(envListenFDs, "1")
+	t.Setenv(envListenPID, strconv.Itoa(os.Getpid()))
+	t.Setenv(envListenFDNames, listenerAPI)
+
+	inherited, err = inheritedListeners(fd)
+	assert.NoError(t, err)
+	assert.Equal(t, len(inherited), 1)
+	defer inherited[listenerAPI].Close()
+
+	assert.Equal(t, inherited[listenerAPI].Addr().String(), ln.Addr().String())
+	assert.Equal(t, os.Getenv(envListenFDs), "")
+
+	got, err := listen(inherited, listenerAPI, "tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	assert.Equal(t, got, inherited[listenerAPI])
+}
+
+func TestUpgradeReady(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	t.Setenv(envUpgradeReadyFD, strconv.Itoa(int(w.Fd())))
+	assert.NoError(t, notifyReady())
+	assert.NoError(t, waitReady(r, time.Second))
+
+	// A process that exits without reporting closes its end of the pipe.
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	w.Close()
+
+	err = waitReady(r, time.Second)
+	assert.Equal(t, err.Error(), "process exited")
+
+	// A process that hangs times out.
+	r, w, err = os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	err = waitReady(r, 10*time.Millisecond)
+	assert.Equal(t, err.Error(), "timed out")
+}
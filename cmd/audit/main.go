@@ -0,0 +1,48 @@
+// Command audit verifies the hash chain of a receipt processor audit log file.
+//
+// Usage:
+//
+//	audit -file /var/lib/fetch/audit.log
+//
+// It prints the number of entries checked and exits with status 0 if the chain is
+// intact. Otherwise it prints the first broken link and exits with status 1.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"fetch.trungnng.github.io/internal/audit"
+)
+
+func main() {
+	var file string
+	flag.StringVar(&file, "file", "", "Path to the audit log file")
+	flag.Parse()
+
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "usage: audit -file <path>")
+		os.Exit(2)
+	}
+
+	entries, err := audit.ReadFile(file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	err = audit.Verify(entries)
+	if err != nil {
+		var broken *audit.BrokenLinkError
+		if errors.As(err, &broken) {
+			fmt.Printf("FAIL: first broken link at entry %d: %s\n", broken.Seq, broken.Reason)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	fmt.Printf("OK: %d entries verified\n", len(entries))
+}
@@ -1,9 +1,9 @@
 module fetch.trungnng.github.io
 
-go 1.23.2
+go 1.24
 
 require (
-	github.com/google/uuid v1.6.0 // indirect
-	github.com/julienschmidt/httprouter v1.3.0 // indirect
-	golang.org/x/time v0.8.0 // indirect
+	github.com/google/uuid v1.6.0
+	github.com/julienschmidt/httprouter v1.3.0
+	golang.org/x/time v0.8.0
 )
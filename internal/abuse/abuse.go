@@ -0,0 +1,195 @@
+package abuse
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config holds the tuning parameters for the Tracker.
+type Config struct {
+	// Threshold is the rejected/total ratio at which a client is banned.
+	Threshold float64
+	// MinSamples is the number of (decayed) submissions a client must make before its
+	// ratio is taken into account. This stops a single typo from costing a client.
+	MinSamples float64
+	// BanDuration is the length of the first ban. Each repeated ban doubles it, up to
+	// maxBanMultiplier times the base duration.
+	BanDuration time.Duration
+	// HalfLife is the time it takes for a client's counts to decay by half.
+	HalfLife time.Duration
+}
+
+const (
+	// Clients are never throttled below this fraction of their normal allowance
+	// unless they are banned outright.
+	minFactor        = 0.1
+	maxBanMultiplier = 16
+
+	// Counts decay continuously, so a burst of N submissions adds up to slightly less
+	// than N. Allow for that when comparing against MinSamples.
+	sampleEpsilon = 0.01
+)
+
+// ClientStatus is a point-in-time view of a tracked client.
+type ClientStatus struct {
+	Client      string     `json:"client"`
+	Accepted    float64    `json:"accepted"`
+	Rejected    float64    `json:"rejected"`
+	RejectRatio float64    `json:"reject_ratio"`
+	Factor      float64    `json:"allowance_factor"`
+	Bans        int        `json:"bans"`
+	BannedUntil *time.Time `json:"banned_until,omitempty"`
+}
+
+type client struct {
+	accepted    float64
+	rejected    float64
+	updated     time.Time
+	bans        int
+	bannedUntil time.Time
+}
+
+// Tracker keeps an exponentially decayed count of accepted and rejected submissions
+// per client and turns the rejection ratio into an allowance factor or a temporary ban.
+type Tracker struct {
+	cfg     Config
+	mu      sync.Mutex
+	clients map[string]*client
+	now     func() time.Time
+}
+
+// New returns a Tracker using the given configuration.
+func New(cfg Config) *Tracker {
+	return &Tracker{
+		cfg:     cfg,
+		clients: make(map[string]*client),
+		now:     time.Now,
+	}
+}
+
+// decay brings the client's counts up to date. Must be called with t.mu held.
+func (t *Tracker) decay(c *client, now time.Time) {
+	if t.cfg.HalfLife > 0 && !c.updated.IsZero() {
+		elapsed := now.Sub(c.updated)
+		weight := math.Pow(0.5, float64(elapsed)/float64(t.cfg.HalfLife))
+		c.accepted *= weight
+		c.rejected *= weight
+	}
+	c.updated = now
+}
+
+// factor returns the allowance factor for the client. Must be called with t.mu held
+// after decay.
+func (t *Tracker) factor(c *client) float64 {
+	total := c.accepted + c.rejected
+	if total+sampleEpsilon < t.cfg.MinSamples || total == 0 || t.cfg.Threshold <= 0 {
+		return 1
+	}
+
+	ratio := c.rejected / total
+	return max(minFactor, 1-ratio/t.cfg.Threshold)
+}
+
+// Record registers the outcome of a submission from the client. Once the client's
+// rejection ratio reaches the threshold it is banned and its counts are reset.
+func (t *Tracker) Record(key string, rejected bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+
+	c, ok := t.clients[key]
+	if !ok {
+		c = &client{}
+		t.clients[key] = c
+	}
+	t.decay(c, now)
+
+	if rejected {
+		c.rejected++
+	} else {
+		c.accepted++
+	}
+
+	total := c.accepted + c.rejected
+	if total+sampleEpsilon >= t.cfg.MinSamples && t.cfg.Threshold > 0 && c.rejected/total >= t.cfg.Threshold {
+		multiplier := min(1<<c.bans, maxBanMultiplier)
+		c.bannedUntil = now.Add(t.cfg.BanDuration * time.Duration(multiplier))
+		c.bans++
+		c.accepted, c.rejected = 0, 0
+	}
+}
+
+// Check returns the allowance factor (between 0 and 1) for the client. If the client is
+// banned the factor is 0 and retryAfter is the time remaining on the ban.
+func (t *Tracker) Check(key string) (factor float64, retryAfter time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c, ok := t.clients[key]
+	if !ok {
+		return 1, 0
+	}
+
+	now := t.now()
+	if now.Before(c.bannedUntil) {
+		return 0, c.bannedUntil.Sub(now)
+	}
+
+	t.decay(c, now)
+	return t.factor(c), 0
+}
+
+// Sweep removes clients which are not banned and whose counts have decayed to almost
+// nothing, so the map does not grow without bound.
+func (t *Tracker) Sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	for key, c := range t.clients {
+		t.decay(c, now)
+		if now.After(c.bannedUntil) && c.accepted+c.rejected < 0.01 {
+			delete(t.clients, key)
+		}
+	}
+}
+
+// Snapshot returns the status of every tracked client, most rejected first.
+func (t *Tracker) Snapshot() []ClientStatus {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	statuses := make([]ClientStatus, 0, len(t.clients))
+
+	for key, c := range t.clients {
+		t.decay(c, now)
+
+		status := ClientStatus{
+			Client:   key,
+			Accepted: math.Round(c.accepted*100) / 100,
+			Rejected: math.Round(c.rejected*100) / 100,
+			Factor:   t.factor(c),
+			Bans:     c.bans,
+		}
+		if total := c.accepted + c.rejected; total > 0 {
+			status.RejectRatio = math.Round(c.rejected/total*100) / 100
+		}
+		if now.Before(c.bannedUntil) {
+			status.Factor = 0
+			bannedUntil := c.bannedUntil.UTC()
+			status.BannedUntil = &bannedUntil
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Rejected > statuses[j].Rejected
+	})
+
+	return statuses
+}
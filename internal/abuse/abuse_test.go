@@ -0,0 +1,150 @@
+package abuse
+
+import (
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+// clock is a manually advanced time source for the Tracker.
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+func newTestTracker() (*Tracker, *clock) {
+	c := &clock{now: time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)}
+
+	t := New(Config{Threshold: 0.5, MinSamples: 4, BanDuration: time.Minute, HalfLife: time.Hour})
+	t.now = c.Now
+	return t, c
+}
+
+func record(tr *Tracker, key string, accepted, rejected int) {
+	for range accepted {
+		tr.Record(key, false)
+	}
+	for range rejected {
+		tr.Record(key, true)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	tr, _ := newTestTracker()
+
+	factor, retryAfter := tr.Check("unknown")
+	assert.Equal(t, factor, 1.0)
+	assert.Equal(t, retryAfter, time.Duration(0))
+
+	// Too few submissions to judge the client.
+	record(tr, "new", 0, 2)
+	factor, _ = tr.Check("new")
+	assert.Equal(t, factor, 1.0)
+
+	// The allowance shrinks as the rejection ratio nears the threshold.
+	record(tr, "sloppy", 3, 1)
+	factor, retryAfter = tr.Check("sloppy")
+	assert.Equal(t, factor, 0.5)
+	assert.Equal(t, retryAfter, time.Duration(0))
+
+	// But never below the minimum factor.
+	tr.cfg.Threshold = 0.26
+	factor, _ = tr.Check("sloppy")
+	assert.Equal(t, factor, minFactor)
+}
+
+func TestBan(t *testing.T) {
+	tr, clk := newTestTracker()
+
+	record(tr, "bad", 2, 2)
+	factor, retryAfter := tr.Check("bad")
+	assert.Equal(t, factor, 0.0)
+	assert.Equal(t, retryAfter, time.Minute)
+
+	clk.now = clk.now.Add(20 * time.Second)
+	_, retryAfter = tr.Check("bad")
+	assert.Equal(t, retryAfter, 40*time.Second)
+
+	// The counts were reset by the ban, so the client starts afresh once it ends.
+	clk.now = clk.now.Add(time.Minute)
+	factor, retryAfter = tr.Check("bad")
+	assert.Equal(t, factor, 1.0)
+	assert.Equal(t, retryAfter, time.Duration(0))
+}
+
+func TestRepeatedBans(t *testing.T) {
+	tr, clk := newTestTracker()
+
+	// Each ban lasts twice as long as the one before, up to the cap.
+	for _, want := range []time.Duration{1, 2, 4, 8, 16, 16} {
+		record(tr, "bad", 0, 4)
+
+		_, retryAfter := tr.Check("bad")
+		assert.Equal(t, retryAfter, want*time.Minute)
+
+		clk.now = clk.now.Add(retryAfter)
+	}
+}
+
+func TestDecay(t *testing.T) {
+	tr, clk := newTestTracker()
+
+	record(tr, "client", 6, 2)
+	clk.now = clk.now.Add(time.Hour)
+
+	status := tr.Snapshot()[0]
+	assert.Equal(t, status.Accepted, 3.0)
+	assert.Equal(t, status.Rejected, 1.0)
+	assert.Equal(t, status.RejectRatio, 0.25)
+
+	// Only 4 decayed submissions are left, so one more rejection weighs as much as
+	// a quarter of the history.
+	record(tr, "client", 0, 1)
+	status = tr.Snapshot()[0]
+	assert.Equal(t, status.RejectRatio, 0.4)
+}
+
+func TestSweep(t *testing.T) {
+	tr, clk := newTestTracker()
+
+	tr.cfg.BanDuration = 24 * time.Hour
+	record(tr, "quiet", 1, 0)
+	record(tr, "banned", 0, 4)
+
+	// After many half-lives the quiet client's counts have all but gone, while the
+	// banned client is kept until its ban ends.
+	clk.now = clk.now.Add(12 * time.Hour)
+	tr.Sweep()
+
+	snapshot := tr.Snapshot()
+	assert.Equal(t, len(snapshot), 1)
+	assert.Equal(t, snapshot[0].Client, "banned")
+	assert.Equal(t, snapshot[0].Bans, 1)
+	assert.Equal(t, snapshot[0].Factor, 0.0)
+	if snapshot[0].BannedUntil == nil {
+		t.Fatal("expected banned_until to be set")
+	}
+
+	clk.now = snapshot[0].BannedUntil.Add(time.Second)
+	tr.Sweep()
+	assert.Equal(t, len(tr.Snapshot()), 0)
+}
+
+func TestSnapshotOrder(t *testing.T) {
+	tr, _ := newTestTracker()
+
+	record(tr, "a", 4, 0)
+	record(tr, "b", 4, 3)
+	record(tr, "c", 4, 1)
+
+	var clients []string
+	for _, status := range tr.Snapshot() {
+		clients = append(clients, status.Client)
+	}
+	assert.Equal(t, len(clients), 3)
+	assert.Equal(t, clients[0]+clients[1]+clients[2], "bca")
+}
@@ -0,0 +1,296 @@
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Actions recorded in the audit log.
+const (
+	ActionCreate = "create"
+	ActionUpdate = "update"
+	ActionDelete = "delete"
+)
+
+// genesisHash is the PrevHash of the first entry in a log.
+var genesisHash = strings.Repeat("0", 64)
+
+// Entry is a single audit record. Hash covers every other field, including PrevHash,
+// so changing, removing or reordering entries breaks the chain.
+type Entry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Action    string    `json:"action"`
+	ReceiptID string    `json:"receipt_id"`
+	Before    string    `json:"before,omitempty"`
+	After     string    `json:"after,omitempty"`
+	PrevHash  string    `json:"prev_hash"`
+	Hash      string    `json:"hash"`
+}
+
+// computeHash returns the hex SHA-256 of the entry's fields, excluding Hash.
+func (e *Entry) computeHash() string {
+	h := sha256.New()
+	for _, field := range []string{
+		strconv.FormatInt(e.Seq, 10),
+		e.Time.UTC().Format(time.RFC3339Nano),
+		e.Actor,
+		e.Action,
+		e.ReceiptID,
+		e.Before,
+		e.After,
+		e.PrevHash,
+	} {
+		// Length-prefix each field so values can't bleed into their neighbours.
+		fmt.Fprintf(h, "%d:%s\n", len(field), field)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// BrokenLinkError describes the first entry at which a chain fails verification.
+type BrokenLinkError struct {
+	Seq    int64
+	Reason string
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("audit chain broken at entry %d: %s", e.Seq, e.Reason)
+}
+
+// Verify checks that the entries form an unbroken hash chain starting from the
+// genesis hash. It returns a *BrokenLinkError for the first bad entry.
+func Verify(entries []Entry) error {
+	prevHash := genesisHash
+
+	for i, e := range entries {
+		switch {
+		case e.Seq != int64(i+1):
+			return &BrokenLinkError{Seq: e.Seq, Reason: fmt.Sprintf("expected sequence number %d", i+1)}
+		case e.PrevHash != prevHash:
+			return &BrokenLinkError{Seq: e.Seq, Reason: "previous hash does not match the preceding entry"}
+		case e.Hash != e.computeHash():
+			return &BrokenLinkError{Seq: e.Seq, Reason: "entry hash does not match its contents"}
+		}
+		prevHash = e.Hash
+	}
+
+	return nil
+}
+
+// Read decodes the JSON Lines encoded entries from r.
+func Read(r io.Reader) ([]Entry, error) {
+	var entries []Entry
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+
+		var e Entry
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		entries = append(entries, e)
+	}
+
+	return entries, scanner.Err()
+}
+
+// ReadFile reads every entry of the log file at path.
+func ReadFile(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return Read(f)
+}
+
+// Log is an append-only, hash-chained audit log. Entries are kept in memory and, if
+// the log was opened with a path, also appended to the file as JSON Lines.
+type Log struct {
+	mu      sync.Mutex
+	entries []Entry
+	path    string
+	file    *os.File
+	size    int64 // size of the file when entries was last in step with it
+	now     func() time.Time
+}
+
+// New returns an in-memory Log.
+func New() *Log {
+	return &Log{now: time.Now}
+}
+
+// Open returns a Log backed by the file at path, loading the entries already in it.
+// New entries are chained onto the last existing one, even if the existing chain
+// doesn't verify, so that Verify keeps pointing at the original break.
+//
+// The file may be shared with other processes, such as the old and new process
+// during a graceful upgrade. Each append locks the file and first loads the entries
+// the others added, so they all extend the same chain.
+func Open(path string) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &Log{path: path, file: f, size: -1, now: time.Now}
+
+	err = l.lock()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	defer l.unlock()
+
+	err = l.sync()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// lock takes an exclusive lock on the file, waiting for other processes to release
+// theirs.
+func (l *Log) lock() error {
+	return syscall.Flock(int(l.file.Fd()), syscall.LOCK_EX)
+}
+
+func (l *Log) unlock() {
+	syscall.Flock(int(l.file.Fd()), syscall.LOCK_UN)
+}
+
+// sync reloads the entries from the file if it changed size since this Log last
+// wrote to or read it. It must be called with the file locked.
+func (l *Log) sync() error {
+	info, err := l.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == l.size {
+		return nil
+	}
+
+	entries, err := ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	l.entries = entries
+	l.size = info.Size()
+	return nil
+}
+
+// Append adds an entry to the log. before and after are digests of the record before
+// and after the change; either may be empty for creates and deletes.
+func (l *Log) Append(actor, action, receiptID, before, after string) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file != nil {
+		err := l.lock()
+		if err != nil {
+			return Entry{}, err
+		}
+		defer l.unlock()
+
+		err = l.sync()
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+
+	e := Entry{
+		Seq:       int64(len(l.entries) + 1),
+		Time:      l.now().UTC(),
+		Actor:     actor,
+		Action:    action,
+		ReceiptID: receiptID,
+		Before:    before,
+		After:     after,
+		PrevHash:  genesisHash,
+	}
+	if len(l.entries) > 0 {
+		e.PrevHash = l.entries[len(l.entries)-1].Hash
+	}
+	e.Hash = e.computeHash()
+
+	if l.file != nil {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return Entry{}, err
+		}
+
+		n, err := l.file.Write(append(b, '\n'))
+		l.size += int64(n)
+		if err != nil {
+			return Entry{}, err
+		}
+	}
+
+	l.entries = append(l.entries, e)
+	return e, nil
+}
+
+// Entries returns a copy of all entries in the log.
+func (l *Log) Entries() []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries := make([]Entry, len(l.entries))
+	copy(entries, l.entries)
+	return entries
+}
+
+// Len returns the number of entries in the log.
+func (l *Log) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return len(l.entries)
+}
+
+// Verify checks the hash chain. For a file-backed log the file is re-read, so changes
+// made to it on disk are detected.
+func (l *Log) Verify() error {
+	if l.path == "" {
+		return Verify(l.Entries())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entries, err := ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+
+	return Verify(entries)
+}
+
+// Close closes the underlying file, if any.
+func (l *Log) Close() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
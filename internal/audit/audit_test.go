@@ -0,0 +1,224 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+// newTestLog returns an in-memory log of three entries with a fixed clock.
+func newTestLog(t *testing.T) *Log {
+	t.Helper()
+
+	l := New()
+	l.now = func() time.Time { return time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC) }
+
+	for _, action := range []string{ActionCreate, ActionUpdate, ActionDelete} {
+		_, err := l.Append("partner-a", action, "r1", "before", "after")
+		assert.NoError(t, err)
+	}
+	return l
+}
+
+func TestAppend(t *testing.T) {
+	l := newTestLog(t)
+	entries := l.Entries()
+
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, l.Len(), 3)
+	assert.Equal(t, entries[0].PrevHash, genesisHash)
+	for i, e := range entries {
+		assert.Equal(t, e.Seq, int64(i+1))
+		assert.Equal(t, e.Hash, e.computeHash())
+		if i > 0 {
+			assert.Equal(t, e.PrevHash, entries[i-1].Hash)
+		}
+	}
+
+	assert.NoError(t, l.Verify())
+	assert.NoError(t, Verify(nil))
+}
+
+func TestVerifyTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(entries []Entry) []Entry
+		seq    int64
+		reason string
+	}{
+		{
+			name: "Changed Field",
+			tamper: func(entries []Entry) []Entry {
+				entries[1].Actor = "someone-else"
+				return entries
+			},
+			seq:    2,
+			reason: "entry hash does not match its contents",
+		},
+		{
+			name: "Changed Field With Recomputed Hash",
+			tamper: func(entries []Entry) []Entry {
+				entries[1].After = "forged"
+				entries[1].Hash = entries[1].computeHash()
+				return entries
+			},
+			seq:    3,
+			reason: "previous hash does not match the preceding entry",
+		},
+		{
+			name: "Removed Entry",
+			tamper: func(entries []Entry) []Entry {
+				return append(entries[:1], entries[2:]...)
+			},
+			seq:    3,
+			reason: "expected sequence number 2",
+		},
+		{
+			name: "Removed First Entry",
+			tamper: func(entries []Entry) []Entry {
+				return entries[1:]
+			},
+			seq:    2,
+			reason: "expected sequence number 1",
+		},
+		{
+			name: "Reordered Entries",
+			tamper: func(entries []Entry) []Entry {
+				entries[1], entries[2] = entries[2], entries[1]
+				return entries
+			},
+			seq:    3,
+			reason: "expected sequence number 2",
+		},
+		{
+			name: "Renumbered After Removal",
+			tamper: func(entries []Entry) []Entry {
+				entries = append(entries[:1], entries[2:]...)
+				entries[1].Seq = 2
+				entries[1].Hash = entries[1].computeHash()
+				return entries
+			},
+			seq:    2,
+			reason: "previous hash does not match the preceding entry",
+		},
+		{
+			name: "Changed Genesis",
+			tamper: func(entries []Entry) []Entry {
+				entries[0].PrevHash = strings.Repeat("f", 64)
+				entries[0].Hash = entries[0].computeHash()
+				return entries
+			},
+			seq:    1,
+			reason: "previous hash does not match the preceding entry",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			entries := tc.tamper(newTestLog(t).Entries())
+
+			err := Verify(entries)
+
+			var broken *BrokenLinkError
+			if !errors.As(err, &broken) {
+				t.Fatalf("got: %v; want a *BrokenLinkError", err)
+			}
+			assert.Equal(t, broken.Seq, tc.seq)
+			assert.Equal(t, broken.Reason, tc.reason)
+		})
+	}
+}
+
+func TestEntriesReturnsCopy(t *testing.T) {
+	l := newTestLog(t)
+
+	entries := l.Entries()
+	entries[0].Actor = "someone-else"
+
+	assert.NoError(t, l.Verify())
+}
+
+func TestFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	l, err := Open(path)
+	assert.NoError(t, err)
+	_, err = l.Append("partner-a", ActionCreate, "r1", "", "digest-1")
+	assert.NoError(t, err)
+	_, err = l.Append("partner-a", ActionUpdate, "r1", "digest-1", "digest-2")
+	assert.NoError(t, err)
+	assert.NoError(t, l.Close())
+
+	// Reopening continues the chain from the file.
+	l, err = Open(path)
+	assert.NoError(t, err)
+	defer l.Close()
+
+	e, err := l.Append("partner-b", ActionDelete, "r1", "digest-2", "")
+	assert.NoError(t, err)
+	assert.Equal(t, e.Seq, int64(3))
+	assert.NoError(t, l.Verify())
+
+	entries, err := ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), 3)
+	assert.Equal(t, entries[2].PrevHash, entries[1].Hash)
+
+	// Verify re-reads the file, so an edit made on disk is caught.
+	b, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	err = os.WriteFile(path, []byte(strings.Replace(string(b), "partner-b", "partner-c", 1)), 0o600)
+	assert.NoError(t, err)
+
+	var broken *BrokenLinkError
+	if !errors.As(l.Verify(), &broken) {
+		t.Fatal("expected a *BrokenLinkError")
+	}
+	assert.Equal(t, broken.Seq, int64(3))
+}
+
+func TestSharedFileLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+
+	// Two logs on one file, as the old and new process have during an upgrade.
+	parent, err := Open(path)
+	assert.NoError(t, err)
+	defer parent.Close()
+	_, err = parent.Append("partner-a", ActionCreate, "r1", "", "digest-1")
+	assert.NoError(t, err)
+
+	child, err := Open(path)
+	assert.NoError(t, err)
+	defer child.Close()
+
+	// Each continues the chain from the entries the other wrote.
+	for i, l := range []*Log{child, parent, parent, child} {
+		e, err := l.Append("partner-a", ActionUpdate, "r1", "digest-1", "digest-2")
+		assert.NoError(t, err)
+		assert.Equal(t, e.Seq, int64(i+2))
+	}
+
+	entries, err := ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), 5)
+	assert.NoError(t, Verify(entries))
+	assert.NoError(t, parent.Verify())
+}
+
+func TestRead(t *testing.T) {
+	entries, err := Read(strings.NewReader("\n" + `{"seq": 1, "actor": "a"}` + "\n\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Actor, "a")
+
+	_, err = Read(strings.NewReader(`{"seq": 1}` + "\n" + `{"seq": `))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assert.Contains(t, err.Error(), "line 2: ")
+}
@@ -0,0 +1,235 @@
+// Package concurrency limits the number of requests in flight, adapting the limit to
+// latency and shedding the requests that can't be admitted.
+package concurrency
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+)
+
+// ErrShed is returned by Acquire when a request is turned away: the queue is full,
+// the request waited longer than the queue timeout, or it was pushed out of the queue
+// by a higher priority request.
+var ErrShed = errors.New("concurrency: request shed")
+
+// Priority orders the requests waiting for a slot. Waiting High requests are always
+// admitted before Low ones.
+type Priority int
+
+const (
+	Low Priority = iota
+	High
+)
+
+// Config holds the tuning parameters for the Limiter.
+type Config struct {
+	// InitialLimit is the number of requests allowed in flight before the limiter has
+	// seen any latencies. The limit then moves between MinLimit and MaxLimit.
+	InitialLimit int
+	MinLimit     int
+	MaxLimit     int
+	// MaxQueue is the number of requests that can wait for a slot. Zero sheds every
+	// request over the limit straight away.
+	MaxQueue int
+	// QueueTimeout is the longest a request waits for a slot.
+	QueueTimeout time.Duration
+}
+
+const (
+	// The limit follows the ratio of the long-term to the short-term average latency.
+	// While recent requests are no slower than tolerance times the long-term average,
+	// each request moves the limit a fraction of the way towards the limit plus its
+	// square root. Once they are slower it moves towards a lower target, at worst half
+	// the limit.
+	shortWindow = 10
+	longWindow  = 500
+	tolerance   = 1.5
+	minGradient = 0.5
+	smoothing   = 0.2
+)
+
+// Stats is a point-in-time view of a Limiter.
+type Stats struct {
+	Limit    int
+	InFlight int
+	Queued   int
+}
+
+type waiter struct {
+	ready chan struct{}
+	elem  *list.Element
+	shed  bool
+}
+
+// Limiter caps the number of requests in flight. The cap adapts to latency in the
+// manner of Netflix's gradient limiter: when requests slow down compared to the
+// long-term average the process is saturated and the cap is lowered, and while they
+// don't it is raised.
+type Limiter struct {
+	cfg      Config
+	mu       sync.Mutex
+	limit    float64
+	inFlight int
+	queues   [2]*list.List // of *waiter, indexed by Priority
+	shortRTT float64
+	longRTT  float64
+}
+
+// New returns a Limiter using the given configuration.
+func New(cfg Config) *Limiter {
+	return &Limiter{
+		cfg:    cfg,
+		limit:  float64(cfg.InitialLimit),
+		queues: [2]*list.List{list.New(), list.New()},
+	}
+}
+
+// Acquire admits a request, waiting in the queue if the limit is reached. The
+// returned function must be called once the request is done. It returns ErrShed if
+// the request is turned away, or the context's error if it is cancelled while waiting.
+func (l *Limiter) Acquire(ctx context.Context, p Priority) (func(), error) {
+	l.mu.Lock()
+
+	if l.inFlight < l.capacity() && l.queued() == 0 {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.releaser(), nil
+	}
+
+	if l.queued() >= l.cfg.MaxQueue {
+		// A full queue makes room for a high priority request by shedding the most
+		// recent low priority one.
+		back := l.queues[Low].Back()
+		if p != High || back == nil {
+			l.mu.Unlock()
+			return nil, ErrShed
+		}
+
+		evicted := l.queues[Low].Remove(back).(*waiter)
+		evicted.shed = true
+		close(evicted.ready)
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	w.elem = l.queues[p].PushBack(w)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(l.cfg.QueueTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case <-w.ready:
+	case <-timer.C:
+		err = ErrShed
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	if err != nil {
+		l.mu.Lock()
+		select {
+		case <-w.ready:
+			// Admitted or shed while giving up; w.ready decides.
+			err = nil
+		default:
+			l.queues[p].Remove(w.elem)
+		}
+		l.mu.Unlock()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	if w.shed {
+		return nil, ErrShed
+	}
+	return l.releaser(), nil
+}
+
+// releaser returns the function which frees a request's slot and feeds its latency
+// into the limit.
+func (l *Limiter) releaser() func() {
+	start := time.Now()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rtt := time.Since(start).Seconds()
+
+			l.mu.Lock()
+			defer l.mu.Unlock()
+
+			l.update(rtt)
+			l.inFlight--
+
+			// Hand the free slots to waiting requests, high priority first.
+			for l.inFlight < l.capacity() {
+				queue := l.queues[High]
+				if queue.Len() == 0 {
+					queue = l.queues[Low]
+				}
+				if queue.Len() == 0 {
+					break
+				}
+
+				w := queue.Remove(queue.Front()).(*waiter)
+				l.inFlight++
+				close(w.ready)
+			}
+		})
+	}
+}
+
+// update adjusts the limit after a request took rtt seconds. Must be called with l.mu
+// held, before the request is removed from inFlight.
+func (l *Limiter) update(rtt float64) {
+	if l.shortRTT == 0 {
+		l.shortRTT = rtt
+		l.longRTT = rtt
+	}
+	l.shortRTT += (rtt - l.shortRTT) / shortWindow
+	l.longRTT += (rtt - l.longRTT) / longWindow
+
+	// A long-term average far above the recent one is left over from an earlier
+	// overload. Let it come down faster so it doesn't hold the limit up.
+	if l.longRTT > 2*l.shortRTT {
+		l.longRTT *= 0.95
+	}
+
+	// While less than half the limit is in use, latency says nothing about it.
+	if float64(l.inFlight) < l.limit/2 || l.shortRTT == 0 {
+		return
+	}
+
+	gradient := math.Max(minGradient, math.Min(1, tolerance*l.longRTT/l.shortRTT))
+	target := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.limit*(1-smoothing) + target*smoothing
+	l.limit = math.Max(float64(l.cfg.MinLimit), math.Min(float64(l.cfg.MaxLimit), l.limit))
+}
+
+// capacity returns the limit as a number of requests. Must be called with l.mu held.
+func (l *Limiter) capacity() int {
+	return int(l.limit)
+}
+
+// queued returns the number of waiting requests. Must be called with l.mu held.
+func (l *Limiter) queued() int {
+	return l.queues[Low].Len() + l.queues[High].Len()
+}
+
+// Stats returns the current limit, requests in flight and queue length.
+func (l *Limiter) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return Stats{
+		Limit:    l.capacity(),
+		InFlight: l.inFlight,
+		Queued:   l.queued(),
+	}
+}
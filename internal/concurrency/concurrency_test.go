@@ -0,0 +1,212 @@
+package concurrency
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func newTestLimiter(queue int, timeout time.Duration) *Limiter {
+	return New(Config{InitialLimit: 1, MinLimit: 1, MaxLimit: 1, MaxQueue: queue, QueueTimeout: timeout})
+}
+
+type result struct {
+	release func()
+	err     error
+}
+
+// acquire calls Acquire in the background and waits until the request is admitted or
+// queued.
+func acquire(t *testing.T, l *Limiter, ctx context.Context, p Priority) chan result {
+	t.Helper()
+
+	before := l.Stats()
+	done := make(chan result, 1)
+	go func() {
+		release, err := l.Acquire(ctx, p)
+		done <- result{release, err}
+	}()
+
+	for range 100 {
+		if s := l.Stats(); s.Queued != before.Queued || s.InFlight != before.InFlight || len(done) > 0 {
+			return done
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("request neither admitted nor queued")
+	return nil
+}
+
+func TestAcquireRelease(t *testing.T) {
+	l := newTestLimiter(1, time.Minute)
+
+	first := <-acquire(t, l, t.Context(), Low)
+	assert.NoError(t, first.err)
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1})
+
+	second := acquire(t, l, t.Context(), Low)
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1, Queued: 1})
+
+	// Releasing hands the slot straight to the waiting request. A second call is a
+	// no-op.
+	first.release()
+	first.release()
+
+	res := <-second
+	assert.NoError(t, res.err)
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1})
+
+	res.release()
+	assert.Equal(t, l.Stats(), Stats{Limit: 1})
+}
+
+func TestAcquireQueueFull(t *testing.T) {
+	l := newTestLimiter(1, time.Minute)
+
+	first := <-acquire(t, l, t.Context(), Low)
+	assert.NoError(t, first.err)
+	queued := acquire(t, l, t.Context(), High)
+
+	// Nothing low priority is queued, so there is nothing to evict.
+	for _, p := range []Priority{Low, High} {
+		_, err := l.Acquire(t.Context(), p)
+		if !errors.Is(err, ErrShed) {
+			t.Errorf("priority %d: got: %v; want: %v", p, err, ErrShed)
+		}
+	}
+
+	first.release()
+	res := <-queued
+	assert.NoError(t, res.err)
+	res.release()
+}
+
+func TestAcquireEvictsLowPriority(t *testing.T) {
+	l := newTestLimiter(2, time.Minute)
+
+	first := <-acquire(t, l, t.Context(), Low)
+	assert.NoError(t, first.err)
+	older := acquire(t, l, t.Context(), Low)
+	newer := acquire(t, l, t.Context(), Low)
+
+	// A read arriving at a full queue pushes out the most recent write. The queue
+	// length doesn't change, so the shed write is what shows the read is queued.
+	read := make(chan result, 1)
+	go func() {
+		release, err := l.Acquire(t.Context(), High)
+		read <- result{release, err}
+	}()
+
+	res := <-newer
+	if !errors.Is(res.err, ErrShed) {
+		t.Fatalf("got: %v; want: %v", res.err, ErrShed)
+	}
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1, Queued: 2})
+
+	// The read is admitted ahead of the older write.
+	first.release()
+	res = <-read
+	assert.NoError(t, res.err)
+	assert.Equal(t, len(older), 0)
+
+	res.release()
+	res = <-older
+	assert.NoError(t, res.err)
+	res.release()
+	assert.Equal(t, l.Stats(), Stats{Limit: 1})
+}
+
+func TestAcquireTimeout(t *testing.T) {
+	l := newTestLimiter(1, 20*time.Millisecond)
+
+	first := <-acquire(t, l, t.Context(), Low)
+	assert.NoError(t, first.err)
+
+	res := <-acquire(t, l, t.Context(), Low)
+	if !errors.Is(res.err, ErrShed) {
+		t.Fatalf("got: %v; want: %v", res.err, ErrShed)
+	}
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1})
+
+	first.release()
+}
+
+func TestAcquireCancelled(t *testing.T) {
+	l := newTestLimiter(1, time.Minute)
+
+	first := <-acquire(t, l, t.Context(), Low)
+	assert.NoError(t, first.err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	queued := acquire(t, l, ctx, Low)
+	cancel()
+
+	// The context's error is returned, not ErrShed, and the request leaves the queue.
+	res := <-queued
+	if !errors.Is(res.err, context.Canceled) {
+		t.Fatalf("got: %v; want: %v", res.err, context.Canceled)
+	}
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1})
+
+	first.release()
+	assert.Equal(t, l.Stats(), Stats{Limit: 1})
+}
+
+// A request can be handed a slot just as it gives up waiting. It must then be
+// admitted, or the slot it was given would never be freed.
+func TestAcquireAdmittedWhileGivingUp(t *testing.T) {
+	l := newTestLimiter(1, time.Minute)
+
+	first := <-acquire(t, l, t.Context(), Low)
+	assert.NoError(t, first.err)
+
+	ctx, cancel := context.WithCancel(t.Context())
+	queued := acquire(t, l, ctx, Low)
+
+	// Hold the lock so the waiter, once cancelled, is stuck on its way out of the
+	// queue. Then hand it first's slot as first's release would.
+	l.mu.Lock()
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	w := l.queues[Low].Remove(l.queues[Low].Front()).(*waiter)
+	close(w.ready)
+	l.mu.Unlock()
+
+	res := <-queued
+	assert.NoError(t, res.err)
+	if res.release == nil {
+		t.Fatal("admitted request has no release function")
+	}
+	assert.Equal(t, l.Stats(), Stats{Limit: 1, InFlight: 1})
+
+	res.release()
+	assert.Equal(t, l.Stats(), Stats{Limit: 1})
+}
+
+func TestLimitBounds(t *testing.T) {
+	l := New(Config{InitialLimit: 8, MinLimit: 5, MaxLimit: 10, MaxQueue: 0, QueueTimeout: time.Second})
+
+	// Steady latency with the limit in use raises it, but not past MaxLimit.
+	for range 200 {
+		l.mu.Lock()
+		l.inFlight = l.capacity()
+		l.update(0.01)
+		l.inFlight = 0
+		l.mu.Unlock()
+	}
+	assert.Equal(t, l.Stats().Limit, 10)
+
+	// A sudden slowdown lowers it, but not past MinLimit.
+	for range 200 {
+		l.mu.Lock()
+		l.inFlight = l.capacity()
+		l.update(1)
+		l.inFlight = 0
+		l.mu.Unlock()
+	}
+	assert.Equal(t, l.Stats().Limit, 5)
+}
@@ -9,6 +9,7 @@ import (
 var (
 	ErrRecordNotFound  = errors.New("record not found")
 	ErrDuplicateRecord = errors.New("record with same ID exist")
+	ErrEditConflict    = errors.New("edit conflict")
 )
 
 // Models acts as a container for different database models.
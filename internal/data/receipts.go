@@ -1,9 +1,17 @@
 package data
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
 	"sync"
 	"time"
 
+	"fetch.trungnng.github.io/internal/audit"
 	"fetch.trungnng.github.io/internal/validator"
 	"github.com/google/uuid"
 )
@@ -18,6 +26,14 @@ type Receipt struct {
 	PurchaseTime time.Time
 	Items        []*Item
 	Total        float32
+
+	// SignatureStatus records the outcome of checking the retailer's digital signature
+	// over the receipt (unsigned, untrusted, invalid or verified).
+	SignatureStatus string
+
+	// Version starts at 1 when the receipt is inserted and goes up by one with every
+	// update. An update must carry the version it was based on.
+	Version int64
 }
 
 // Item represents a receipt's item record in the database.
@@ -29,6 +45,65 @@ type Item struct {
 	Price            float32
 }
 
+// CanonicalJSON returns the canonical JSON encoding of the receipt's content. It is
+// the message retailers sign and is stable for equal receipts: keys are in sorted
+// order, there is no insignificant whitespace, and values use the same formats as the
+// API input with surrounding whitespace trimmed. For example:
+//
+//	{"items":[{"price":"6.49","shortDescription":"Mountain Dew 12PK"}],"purchaseDate":"2022-01-01","purchaseTime":"13:01","retailer":"Target","total":"6.49"}
+func (rc *Receipt) CanonicalJSON() ([]byte, error) {
+	type canonicalItem struct {
+		Price            string `json:"price"`
+		ShortDescription string `json:"shortDescription"`
+	}
+
+	// Fields are declared in alphabetical order so encoding/json writes sorted keys.
+	canonical := struct {
+		Items        []canonicalItem `json:"items"`
+		PurchaseDate string          `json:"purchaseDate"`
+		PurchaseTime string          `json:"purchaseTime"`
+		Retailer     string          `json:"retailer"`
+		Total        string          `json:"total"`
+	}{
+		Items:        make([]canonicalItem, 0, len(rc.Items)),
+		PurchaseDate: rc.PurchaseDate.Format("2006-01-02"),
+		PurchaseTime: rc.PurchaseTime.Format("15:04"),
+		Retailer:     strings.TrimSpace(rc.Retailer),
+		Total:        fmt.Sprintf("%.2f", rc.Total),
+	}
+
+	for _, item := range rc.Items {
+		canonical.Items = append(canonical.Items, canonicalItem{
+			Price:            fmt.Sprintf("%.2f", item.Price),
+			ShortDescription: strings.TrimSpace(item.ShortDescription),
+		})
+	}
+
+	// Retailer names may contain "&", which json.Marshal would escape as \u0026.
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err := enc.Encode(canonical)
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// Digest returns the "sha256:<hex>" digest of the receipt's canonical JSON together
+// with its signature status, as recorded in the audit log.
+func (rc *Receipt) Digest() (string, error) {
+	canonical, err := rc.CanonicalJSON()
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(append(canonical, rc.SignatureStatus...))
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
 func ValidateReceipt(v *validator.Validator, rc *Receipt) {
 	v.Check(rc.Retailer != "", "retailer", "must be provided")
 	v.Check(len(rc.Retailer) <= 500, "retailer", "must not be more than 500 bytes long")
@@ -50,10 +125,17 @@ func ValidateReceipt(v *validator.Validator, rc *Receipt) {
 	}
 }
 
-// In-memory store for Receipt records.
+// In-memory store for Receipt records. The methods that read or change a receipt
+// take the request's context, and return its error without touching the store once
+// the request is cancelled or past its deadline.
 type ReceiptModel struct {
 	data map[string]*Receipt
 	mu   sync.RWMutex
+
+	// AuditLog, if set, receives an entry for every create, update and delete. The
+	// entry is written before the change is applied, and the change is abandoned if
+	// the entry can't be written, so the log never misses a mutation.
+	AuditLog *audit.Log
 }
 
 // NewReceiptModel initializes a new instance of ReceiptModel with an empty data store.
@@ -81,23 +163,84 @@ func (r *ReceiptModel) NewReceiptItem() *Item {
 	}
 }
 
-// Insert adds a new Receipt to the in-memory data store.
-// If a receipt with the same ID already exists, it returns an error.
-func (r *ReceiptModel) Insert(receipt *Receipt) error {
+// audit writes an audit entry for a change from before to after. Either may be nil.
+// Must be called with r.mu held.
+func (r *ReceiptModel) audit(actor, action, id string, before, after *Receipt) error {
+	if r.AuditLog == nil {
+		return nil
+	}
+
+	var beforeDigest, afterDigest string
+	var err error
+
+	if before != nil {
+		beforeDigest, err = before.Digest()
+		if err != nil {
+			return err
+		}
+	}
+	if after != nil {
+		afterDigest, err = after.Digest()
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.AuditLog.Append(actor, action, id, beforeDigest, afterDigest)
+	return err
+}
+
+// lock takes the write lock for a change on behalf of a request. A request that is
+// cancelled while waiting for the lock makes no change: the lock is released again
+// and the context's error returned.
+func (r *ReceiptModel) lock(ctx context.Context) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
 	r.mu.Lock()
+
+	err = ctx.Err()
+	if err != nil {
+		r.mu.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// Insert adds a new Receipt to the in-memory data store on behalf of actor, at version
+// 1. If a receipt with the same ID already exists, it returns an error.
+func (r *ReceiptModel) Insert(ctx context.Context, actor string, receipt *Receipt) error {
+	err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
 	defer r.mu.Unlock()
 
 	if _, exists := r.data[receipt.ID]; exists {
 		return ErrDuplicateRecord
 	}
 
+	err = r.audit(actor, audit.ActionCreate, receipt.ID, nil, receipt)
+	if err != nil {
+		return err
+	}
+
+	receipt.Version = 1
 	r.data[receipt.ID] = receipt
 	return nil
 }
 
 // Get retrieves a Receipt from the in-memory data store by its ID.
 // Returns ErrRecordNotFound if no matching receipt is found.
-func (r *ReceiptModel) Get(id string) (*Receipt, error) {
+func (r *ReceiptModel) Get(ctx context.Context, id string) (*Receipt, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
 	r.mu.RLock()
 	defer r.mu.RUnlock()
 
@@ -109,29 +252,66 @@ func (r *ReceiptModel) Get(id string) (*Receipt, error) {
 	return receipt, nil
 }
 
-// Update modifies an existing Receipt in the in-memory data store.
-// If no receipt with the given ID exists, it returns ErrRecordNotFound.
-func (r *ReceiptModel) Update(receipt *Receipt) error {
-	r.mu.Lock()
+// Len returns the number of receipts in the store.
+func (r *ReceiptModel) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return len(r.data)
+}
+
+// Update modifies an existing Receipt in the in-memory data store on behalf of actor.
+// If no receipt with the given ID exists, it returns ErrRecordNotFound. The receipt's
+// Version must be the stored version, or ErrEditConflict is returned because someone
+// else updated it in the meantime. On success the version is incremented.
+func (r *ReceiptModel) Update(ctx context.Context, actor string, receipt *Receipt) error {
+	err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
 	defer r.mu.Unlock()
 
-	if _, exists := r.data[receipt.ID]; !exists {
+	existing, exists := r.data[receipt.ID]
+	if !exists {
 		return ErrRecordNotFound
 	}
+	if receipt.Version != existing.Version {
+		return ErrEditConflict
+	}
+
+	err = r.audit(actor, audit.ActionUpdate, receipt.ID, existing, receipt)
+	if err != nil {
+		return err
+	}
 
+	receipt.Version++
 	r.data[receipt.ID] = receipt
 	return nil
 }
 
-// Delete removes a Receipt from the in-memory data store by its ID.
-// If no receipt with the given ID exists, it returns ErrRecordNotFound.
-func (r *ReceiptModel) Delete(id string) error {
-	r.mu.Lock()
+// Delete removes a Receipt from the in-memory data store by its ID on behalf of actor.
+// If no receipt with the given ID exists, it returns ErrRecordNotFound. A non-zero
+// version must be the stored version, or ErrEditConflict is returned; zero deletes
+// whichever version is stored.
+func (r *ReceiptModel) Delete(ctx context.Context, actor string, id string, version int64) error {
+	err := r.lock(ctx)
+	if err != nil {
+		return err
+	}
 	defer r.mu.Unlock()
 
-	if _, exists := r.data[id]; !exists {
+	existing, exists := r.data[id]
+	if !exists {
 		return ErrRecordNotFound
 	}
+	if version != 0 && version != existing.Version {
+		return ErrEditConflict
+	}
+
+	err = r.audit(actor, audit.ActionDelete, id, existing, nil)
+	if err != nil {
+		return err
+	}
 
 	delete(r.data, id)
 	return nil
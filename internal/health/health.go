@@ -0,0 +1,128 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is reported for a check that did not finish within its timeout.
+var ErrTimeout = errors.New("check timed out")
+
+// Status values reported for a check.
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// Check reports whether a dependency is healthy. It should return promptly once ctx is
+// done, although the Registry does not wait for it.
+type Check func(ctx context.Context) error
+
+// Result is the outcome of a single check.
+type Result struct {
+	Name     string `json:"name"`
+	Status   string `json:"status"`
+	Error    string `json:"error,omitempty"`
+	Duration string `json:"duration"`
+}
+
+type check struct {
+	name    string
+	timeout time.Duration
+	fn      Check
+}
+
+// Registry holds named checks and runs them together. A nil Registry has no checks.
+type Registry struct {
+	mu     sync.RWMutex
+	checks []check
+}
+
+// New returns an empty Registry.
+func New() *Registry {
+	return &Registry{}
+}
+
+// Register adds a check. A timeout of 0 means the check is only bounded by the context
+// passed to Run.
+func (r *Registry) Register(name string, timeout time.Duration, fn Check) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checks = append(r.checks, check{name: name, timeout: timeout, fn: fn})
+}
+
+// Run runs every check concurrently and returns their results sorted by name. It
+// reports true only if all checks passed.
+func (r *Registry) Run(ctx context.Context) (bool, []Result) {
+	if r == nil {
+		return true, []Result{}
+	}
+
+	r.mu.RLock()
+	checks := append([]check(nil), r.checks...)
+	r.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Name < results[j].Name
+	})
+
+	healthy := true
+	for _, res := range results {
+		if res.Status != StatusOK {
+			healthy = false
+		}
+	}
+
+	return healthy, results
+}
+
+// run runs the check with its timeout. A check which overruns is left to finish in the
+// background and reported as timed out.
+func (c check) run(ctx context.Context) Result {
+	if c.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.timeout)
+		defer cancel()
+	}
+
+	start := time.Now()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.fn(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = ErrTimeout
+	}
+
+	res := Result{
+		Name:     c.name,
+		Status:   StatusOK,
+		Duration: time.Since(start).Round(time.Microsecond).String(),
+	}
+	if err != nil {
+		res.Status = StatusFail
+		res.Error = err.Error()
+	}
+
+	return res
+}
@@ -0,0 +1,262 @@
+package ipfilter
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrInvalidAction = errors.New("invalid rule action")
+	ErrInvalidRule   = errors.New("invalid rule")
+)
+
+// Action is the outcome of a rule that matches a client address.
+type Action string
+
+const (
+	Allow Action = "allow"
+	Deny  Action = "deny"
+)
+
+// Rule is a single allow or deny entry. Single IPs are stored as a /32 or /128 prefix.
+type Rule struct {
+	Action Action
+	Prefix netip.Prefix
+}
+
+// String returns the rule in the form accepted by ParseRule.
+func (r Rule) String() string {
+	if r.Prefix.IsSingleIP() {
+		return fmt.Sprintf("%s %s", r.Action, r.Prefix.Addr())
+	}
+	return fmt.Sprintf("%s %s", r.Action, r.Prefix)
+}
+
+// Policy is an ordered list of rules for a route group. The first matching rule wins,
+// and Default is used when no rule matches.
+type Policy struct {
+	Rules   []Rule
+	Default Action
+}
+
+// Allowed reports whether the address is permitted by the policy.
+func (p *Policy) Allowed(addr netip.Addr) bool {
+	// Treat IPv4-mapped IPv6 addresses (::ffff:1.2.3.4) as plain IPv4 so that
+	// IPv4 CIDRs match on dual-stack listeners.
+	addr = addr.Unmap()
+
+	for _, rule := range p.Rules {
+		if rule.Prefix.Contains(addr) {
+			return rule.Action == Allow
+		}
+	}
+
+	return p.Default != Deny
+}
+
+// ParseRule parses a rule in the form "allow 10.0.0.0/8" or "deny 2001:db8::1".
+func ParseRule(s string) (Rule, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return Rule{}, fmt.Errorf("%w %q: expected \"<allow|deny> <ip|cidr>\"", ErrInvalidRule, s)
+	}
+
+	action, err := parseAction(fields[0])
+	if err != nil {
+		return Rule{}, err
+	}
+
+	prefix, err := parsePrefix(fields[1])
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w %q: %v", ErrInvalidRule, s, err)
+	}
+
+	return Rule{Action: action, Prefix: prefix}, nil
+}
+
+func parseAction(s string) (Action, error) {
+	switch Action(strings.ToLower(s)) {
+	case Allow:
+		return Allow, nil
+	case Deny:
+		return Deny, nil
+	default:
+		return "", fmt.Errorf("%w %q", ErrInvalidAction, s)
+	}
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+		}
+		return prefix.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Parse decodes a JSON rules document. The document maps a route group name to its
+// policy, for example:
+//
+//	{
+//	  "receipts.write": {
+//	    "default": "deny",
+//	    "rules": ["deny 10.1.2.0/24", "allow 10.0.0.0/8", "allow 2001:db8::/32"]
+//	  }
+//	}
+func Parse(b []byte) (map[string]*Policy, error) {
+	var doc map[string]struct {
+		Default string   `json:"default"`
+		Rules   []string `json:"rules"`
+	}
+
+	err := json.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	policies := make(map[string]*Policy, len(doc))
+
+	for group, p := range doc {
+		policy := &Policy{Default: Allow}
+
+		if p.Default != "" {
+			policy.Default, err = parseAction(p.Default)
+			if err != nil {
+				return nil, fmt.Errorf("group %q: %w", group, err)
+			}
+		}
+
+		for _, s := range p.Rules {
+			rule, err := ParseRule(s)
+			if err != nil {
+				return nil, fmt.Errorf("group %q: %w", group, err)
+			}
+			policy.Rules = append(policy.Rules, rule)
+		}
+
+		policies[group] = policy
+	}
+
+	return policies, nil
+}
+
+// Filter holds the policies for every route group. The policies are loaded from a
+// file and can be swapped atomically at runtime without blocking requests.
+type Filter struct {
+	path     string
+	policies atomic.Pointer[map[string]*Policy]
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// New returns a Filter with the given policies which is not backed by a file.
+func New(policies map[string]*Policy) *Filter {
+	f := &Filter{}
+	f.policies.Store(&policies)
+	return f
+}
+
+// Load reads the rules file at path and returns a Filter backed by it.
+func Load(path string) (*Filter, error) {
+	f := &Filter{path: path}
+
+	err := f.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload re-reads the rules file. If the file cannot be read or parsed the current
+// policies are kept and the error is returned.
+func (f *Filter) Reload() error {
+	if f.path == "" {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+
+	policies, err := Parse(b)
+	if err != nil {
+		return fmt.Errorf("%s: %w", f.path, err)
+	}
+
+	f.policies.Store(&policies)
+	f.modTime = info.ModTime()
+
+	return nil
+}
+
+// ReloadIfChanged reloads the rules file only if its modification time has changed
+// since the last successful load. It reports whether a reload happened.
+func (f *Filter) ReloadIfChanged() (bool, error) {
+	if f.path == "" {
+		return false, nil
+	}
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+
+	f.mu.Lock()
+	changed := !info.ModTime().Equal(f.modTime)
+	f.mu.Unlock()
+
+	if !changed {
+		return false, nil
+	}
+
+	return true, f.Reload()
+}
+
+// Policies returns the policies currently in effect, keyed on route group. The
+// returned policies must not be modified.
+func (f *Filter) Policies() map[string]*Policy {
+	return *f.policies.Load()
+}
+
+// Allowed reports whether addr may access routes in the given group. Groups without a
+// policy are open to everyone.
+func (f *Filter) Allowed(group string, addr netip.Addr) bool {
+	policies := *f.policies.Load()
+
+	policy, ok := policies[group]
+	if !ok {
+		return true
+	}
+
+	return policy.Allowed(addr)
+}
@@ -0,0 +1,199 @@
+package ipfilter
+
+import (
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestParseRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want string
+	}{
+		{"IPv4 CIDR", "allow 10.0.0.0/8", "allow 10.0.0.0/8"},
+		{"Host Bits Masked", "deny 10.1.2.3/24", "deny 10.1.2.0/24"},
+		{"Single IPv4", "deny 192.0.2.1", "deny 192.0.2.1"},
+		{"Single IPv6", "allow 2001:db8::1", "allow 2001:db8::1"},
+		{"IPv6 CIDR", "allow 2001:db8::/32", "allow 2001:db8::/32"},
+		{"IPv4-Mapped Address", "deny ::ffff:192.0.2.1", "deny 192.0.2.1"},
+		{"IPv4-Mapped CIDR", "allow ::ffff:10.0.0.0/104", "allow 10.0.0.0/8"},
+		{"Action Case", "ALLOW 10.0.0.0/8", "allow 10.0.0.0/8"},
+		{"Extra Spaces", "  deny\t10.0.0.0/8 ", "deny 10.0.0.0/8"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := ParseRule(tc.rule)
+			assert.NoError(t, err)
+			assert.Equal(t, rule.String(), tc.want)
+		})
+	}
+}
+
+func TestParseRuleInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		rule string
+		want error
+	}{
+		{"Empty", "", ErrInvalidRule},
+		{"Missing Address", "allow", ErrInvalidRule},
+		{"Too Many Fields", "allow 10.0.0.0/8 now", ErrInvalidRule},
+		{"Unknown Action", "permit 10.0.0.0/8", ErrInvalidAction},
+		{"Bad Address", "allow 10.0.0.256", ErrInvalidRule},
+		{"Bad Prefix Length", "allow 10.0.0.0/33", ErrInvalidRule},
+		{"Hostname", "allow localhost", ErrInvalidRule},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseRule(tc.rule)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("got: %v; want: %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	var rules []Rule
+	for _, s := range []string{"deny 10.1.2.0/24", "allow 10.0.0.0/8", "allow 2001:db8::/32", "deny 192.0.2.7"} {
+		rule, err := ParseRule(s)
+		assert.NoError(t, err)
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		addr         string
+		allowed      bool
+		defaultAllow bool
+	}{
+		// The first matching rule wins, so the narrower deny beats the wider allow.
+		{"10.1.2.3", false, false},
+		{"10.1.3.3", true, false},
+		{"10.255.255.255", true, false},
+		{"11.0.0.1", false, false},
+		{"2001:db8:1::5", true, false},
+		{"2001:db9::5", false, false},
+		// IPv4 clients on a dual-stack listener match the IPv4 rules.
+		{"::ffff:10.1.3.3", true, false},
+		{"::ffff:10.1.2.3", false, false},
+		// Without a matching rule the default applies.
+		{"11.0.0.1", true, true},
+		{"192.0.2.7", false, true},
+	}
+
+	for _, tc := range tests {
+		policy := &Policy{Rules: rules, Default: Deny}
+		if tc.defaultAllow {
+			policy.Default = Allow
+		}
+
+		got := policy.Allowed(netip.MustParseAddr(tc.addr))
+		if got != tc.allowed {
+			t.Errorf("%s (default %s): got: %t; want: %t", tc.addr, policy.Default, got, tc.allowed)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	policies, err := Parse([]byte(`{
+		"receipts.write": {"default": "deny", "rules": ["allow 10.0.0.0/8"]},
+		"system": {"rules": ["deny 192.0.2.0/24"]}
+	}`))
+	assert.NoError(t, err)
+	assert.Equal(t, len(policies), 2)
+
+	write := policies["receipts.write"]
+	assert.Equal(t, write.Default, Deny)
+	assert.Equal(t, len(write.Rules), 1)
+	assert.Equal(t, write.Rules[0].String(), "allow 10.0.0.0/8")
+
+	// The default is allow when the policy doesn't set one.
+	assert.Equal(t, policies["system"].Default, Allow)
+
+	_, err = Parse([]byte(`{"system": {"default": "block"}}`))
+	if !errors.Is(err, ErrInvalidAction) {
+		t.Errorf("got: %v; want: %v", err, ErrInvalidAction)
+	}
+	assert.Contains(t, err.Error(), `group "system"`)
+
+	_, err = Parse([]byte(`{"system": {"rules": ["allow nowhere"]}}`))
+	if !errors.Is(err, ErrInvalidRule) {
+		t.Errorf("got: %v; want: %v", err, ErrInvalidRule)
+	}
+
+	_, err = Parse([]byte(`["allow 10.0.0.0/8"]`))
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestFilter(t *testing.T) {
+	f := New(map[string]*Policy{"system": {Default: Deny}})
+
+	assert.Equal(t, f.Allowed("system", netip.MustParseAddr("192.0.2.1")), false)
+
+	// Groups without a policy are open.
+	assert.Equal(t, f.Allowed("receipts.read", netip.MustParseAddr("192.0.2.1")), true)
+
+	// A filter that isn't backed by a file has nothing to reload.
+	changed, err := f.ReloadIfChanged()
+	assert.NoError(t, err)
+	assert.Equal(t, changed, false)
+}
+
+func TestFilterReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rules.json")
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	write := func(rules string, modTime time.Time) {
+		t.Helper()
+		assert.NoError(t, os.WriteFile(path, []byte(rules), 0o600))
+		assert.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+
+	start := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	write(`{"system": {"default": "deny", "rules": ["allow 10.0.0.0/8"]}}`, start)
+
+	f, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, f.Allowed("system", addr), true)
+
+	changed, err := f.ReloadIfChanged()
+	assert.NoError(t, err)
+	assert.Equal(t, changed, false)
+
+	write(`{"system": {"default": "deny"}}`, start.Add(time.Minute))
+
+	changed, err = f.ReloadIfChanged()
+	assert.NoError(t, err)
+	assert.Equal(t, changed, true)
+	assert.Equal(t, f.Allowed("system", addr), false)
+
+	// A bad file keeps the rules in effect, and is tried again on the next check.
+	write(`{"system": {"default": "maybe"}}`, start.Add(2*time.Minute))
+
+	changed, err = f.ReloadIfChanged()
+	assert.Equal(t, changed, true)
+	if !errors.Is(err, ErrInvalidAction) {
+		t.Fatalf("got: %v; want: %v", err, ErrInvalidAction)
+	}
+	assert.Contains(t, err.Error(), path)
+	assert.Equal(t, f.Allowed("system", addr), false)
+
+	changed, _ = f.ReloadIfChanged()
+	assert.Equal(t, changed, true)
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got: %v; want: %v", err, os.ErrNotExist)
+	}
+}
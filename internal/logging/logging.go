@@ -0,0 +1,175 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// RedactedValue replaces the value of redacted attributes.
+const RedactedValue = "[REDACTED]"
+
+// RedactHandler is a slog.Handler which replaces the values of configured attribute
+// keys before records reach the wrapped handler. Keys are matched case-insensitively
+// at any depth, including inside groups.
+type RedactHandler struct {
+	next slog.Handler
+	keys map[string]bool
+}
+
+// NewRedactHandler wraps next so the given attribute keys are redacted.
+func NewRedactHandler(next slog.Handler, keys []string) *RedactHandler {
+	set := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		set[strings.ToLower(key)] = true
+	}
+	return &RedactHandler{next: next, keys: set}
+}
+
+func (h *RedactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *RedactHandler) Handle(ctx context.Context, record slog.Record) error {
+	if len(h.keys) == 0 {
+		return h.next.Handle(ctx, record)
+	}
+
+	redacted := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(attr slog.Attr) bool {
+		redacted.AddAttrs(h.redact(attr))
+		return true
+	})
+
+	return h.next.Handle(ctx, redacted)
+}
+
+func (h *RedactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, 0, len(attrs))
+	for _, attr := range attrs {
+		redacted = append(redacted, h.redact(attr))
+	}
+	return &RedactHandler{next: h.next.WithAttrs(redacted), keys: h.keys}
+}
+
+func (h *RedactHandler) WithGroup(name string) slog.Handler {
+	return &RedactHandler{next: h.next.WithGroup(name), keys: h.keys}
+}
+
+func (h *RedactHandler) redact(attr slog.Attr) slog.Attr {
+	if h.keys[strings.ToLower(attr.Key)] {
+		return slog.String(attr.Key, RedactedValue)
+	}
+
+	attr.Value = attr.Value.Resolve()
+	if attr.Value.Kind() == slog.KindGroup {
+		group := attr.Value.Group()
+		redacted := make([]slog.Attr, 0, len(group))
+		for _, a := range group {
+			redacted = append(redacted, h.redact(a))
+		}
+		return slog.Attr{Key: attr.Key, Value: slog.GroupValue(redacted...)}
+	}
+
+	return attr
+}
+
+// RotatingFile is an io.WriteCloser which appends to a file and rotates it once it
+// reaches a maximum size. Rotated files are renamed path.1, path.2 and so on, with
+// path.1 the most recent, and only maxBackups of them are kept.
+type RotatingFile struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// OpenRotatingFile opens (or creates) the file at path. A maxSize of 0 disables
+// rotation.
+func OpenRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	rf := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file = f
+	rf.size = info.Size()
+	return nil
+}
+
+// rotate closes the current file, shifts the backups and opens a new file. Must be
+// called with rf.mu held.
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	if rf.maxBackups < 1 {
+		err = os.Remove(rf.path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return rf.open()
+	}
+
+	// Drop the oldest backup, then shift the rest up by one.
+	os.Remove(fmt.Sprintf("%s.%d", rf.path, rf.maxBackups))
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+	}
+
+	err = os.Rename(rf.path, rf.path+".1")
+	if err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+// Write implements io.Writer. A single write is never split across files.
+func (rf *RotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+// Close closes the current file.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.file.Close()
+}
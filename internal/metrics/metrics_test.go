@@ -0,0 +1,150 @@
+package metrics
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func writeText(t *testing.T, r *Registry) string {
+	t.Helper()
+
+	var b strings.Builder
+	assert.NoError(t, r.WriteText(&b))
+	return b.String()
+}
+
+func TestCounterVec(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("requests_total", "Requests served.", "method", "status")
+
+	c.With("POST", "200").Inc()
+	c.With("GET", "200").Add(2.5)
+	c.With("GET", "200").Inc()
+
+	assert.Equal(t, writeText(t, r), `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{method="GET",status="200"} 3.5
+requests_total{method="POST",status="200"} 1
+`)
+}
+
+func TestCounterConcurrentAdds(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("events_total", "Events.")
+
+	var wg sync.WaitGroup
+	for range 50 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 100 {
+				c.With().Inc()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Contains(t, writeText(t, r), "\nevents_total 5000\n")
+}
+
+func TestGaugeVec(t *testing.T) {
+	r := NewRegistry()
+	g := r.NewGaugeVec("in_flight", "Requests in flight.", "class")
+
+	g.With("receipts").Set(4)
+	g.With("receipts").Inc()
+	g.With("receipts").Dec()
+	g.With("receipts").Add(-1.5)
+	g.With("keys").Set(math.Inf(1))
+
+	assert.Equal(t, writeText(t, r), `# HELP in_flight Requests in flight.
+# TYPE in_flight gauge
+in_flight{class="keys"} +Inf
+in_flight{class="receipts"} 2.5
+`)
+}
+
+func TestGaugeFunc(t *testing.T) {
+	r := NewRegistry()
+	n := 1.0
+	r.NewGaugeFunc("receipts", "Receipts stored.", func() float64 { return n })
+
+	n = 7
+	assert.Contains(t, writeText(t, r), "\nreceipts 7\n")
+}
+
+func TestHistogramVec(t *testing.T) {
+	r := NewRegistry()
+	h := r.NewHistogramVec("latency_seconds", "Request latency.", []float64{1, 0.1, 0.5}, "route")
+
+	for _, f := range []float64{0.05, 0.1, 0.3, 2} {
+		h.With("/points").Observe(f)
+	}
+
+	assert.Equal(t, writeText(t, r), `# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/points",le="0.1"} 2
+latency_seconds_bucket{route="/points",le="0.5"} 3
+latency_seconds_bucket{route="/points",le="1"} 3
+latency_seconds_bucket{route="/points",le="+Inf"} 4
+latency_seconds_sum{route="/points"} 2.45
+latency_seconds_count{route="/points"} 4
+`)
+}
+
+func TestEscaping(t *testing.T) {
+	r := NewRegistry()
+	c := r.NewCounterVec("errors_total", "Errors by path,\nescaped with \\.", "path")
+	c.With("/a\"b\\c\nd").Inc()
+
+	assert.Equal(t, writeText(t, r), `# HELP errors_total Errors by path,\nescaped with \\.
+# TYPE errors_total counter
+errors_total{path="/a\"b\\c\nd"} 1
+`)
+}
+
+func TestPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		fn   func(r *Registry)
+		want string
+	}{
+		{"Duplicate Name", func(r *Registry) {
+			r.NewCounterVec("dup", "")
+			r.NewGaugeVec("dup", "")
+		}, "metrics: duplicate metric name dup"},
+		{"Wrong Label Count", func(r *Registry) {
+			r.NewCounterVec("c", "", "a", "b").With("x")
+		}, "metrics: c expects 2 label values, got 1"},
+		{"Negative Counter Add", func(r *Registry) {
+			r.NewCounterVec("c", "").With().Add(-1)
+		}, "metrics: counter cannot decrease"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			defer func() {
+				got, _ := recover().(string)
+				assert.Equal(t, got, tc.want)
+			}()
+			tc.fn(NewRegistry())
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("hits_total", "Hits.").With().Inc()
+
+	rr := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	assert.Equal(t, rr.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+	assert.Contains(t, rr.Body.String(), "\nhits_total 1\n")
+}
@@ -0,0 +1,354 @@
+// Package msgpack encodes and decodes MessagePack (https://msgpack.org) for the generic
+// values encoding/json works with: nil, bool, numbers, string, []any and
+// map[string]any.
+package msgpack
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+)
+
+// ErrInvalid is returned by Unmarshal for data that isn't a single well-formed
+// MessagePack value this package can decode.
+var ErrInvalid = errors.New("msgpack: invalid data")
+
+// maxDepth bounds the nesting of arrays and maps, so a small message can't exhaust the
+// stack.
+const maxDepth = 100
+
+// Marshal returns the MessagePack encoding of v. Maps are written with their keys in
+// sorted order, so equal values encode to equal bytes. A json.Number is written as an
+// integer if it is one, and as a float64 otherwise.
+func Marshal(v any) ([]byte, error) {
+	return appendValue(nil, v)
+}
+
+func appendValue(b []byte, v any) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if v {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return appendInt(b, int64(v)), nil
+	case int64:
+		return appendInt(b, v), nil
+	case uint64:
+		return appendUint(b, v), nil
+	case float64:
+		return appendFloat(b, v), nil
+	case json.Number:
+		if n, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return appendInt(b, n), nil
+		}
+		if n, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return appendUint(b, n), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, fmt.Errorf("msgpack: invalid number %q", v)
+		}
+		return appendFloat(b, f), nil
+	case string:
+		return appendString(b, v), nil
+	case []any:
+		b = appendLength(b, len(v), 0x90, 0xdc)
+		for _, e := range v {
+			var err error
+			b, err = appendValue(b, e)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	case map[string]any:
+		b = appendLength(b, len(v), 0x80, 0xde)
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+
+		for _, k := range keys {
+			b = appendString(b, k)
+
+			var err error
+			b, err = appendValue(b, v[k])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return b, nil
+	default:
+		return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+	}
+}
+
+func appendInt(b []byte, n int64) []byte {
+	switch {
+	case n >= 0:
+		return appendUint(b, uint64(n))
+	case n >= -32:
+		return append(b, byte(n))
+	case n >= math.MinInt8:
+		return append(b, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		return binary.BigEndian.AppendUint16(append(b, 0xd1), uint16(n))
+	case n >= math.MinInt32:
+		return binary.BigEndian.AppendUint32(append(b, 0xd2), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(n))
+	}
+}
+
+func appendUint(b []byte, n uint64) []byte {
+	switch {
+	case n <= 0x7f:
+		return append(b, byte(n))
+	case n <= math.MaxUint8:
+		return append(b, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(n))
+	case n <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(n))
+	default:
+		return binary.BigEndian.AppendUint64(append(b, 0xcf), n)
+	}
+}
+
+func appendFloat(b []byte, f float64) []byte {
+	return binary.BigEndian.AppendUint64(append(b, 0xcb), math.Float64bits(f))
+}
+
+func appendString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n <= 31:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+// appendLength writes the header of an array or map of n elements: fix is the
+// format byte of the fixarray or fixmap, and format16 that of the 16-bit form, which is
+// followed by the 32-bit form.
+func appendLength(b []byte, n int, fix, format16 byte) []byte {
+	switch {
+	case n <= 15:
+		return append(b, fix|byte(n))
+	case n <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, format16), uint16(n))
+	default:
+		return binary.BigEndian.AppendUint32(append(b, format16+1), uint32(n))
+	}
+}
+
+// Unmarshal decodes a single MessagePack value. Integers are returned as int64, or
+// uint64 if they don't fit, floats as float64, strings and binary data as string,
+// arrays as []any and maps as map[string]any. Maps must have string keys, and
+// extension types aren't supported.
+func Unmarshal(data []byte) (any, error) {
+	d := decoder{data: data}
+
+	v, err := d.value(0)
+	if err != nil {
+		return nil, err
+	}
+	if d.off != len(d.data) {
+		return nil, fmt.Errorf("%w: trailing data after the value", ErrInvalid)
+	}
+
+	return v, nil
+}
+
+type decoder struct {
+	data []byte
+	off  int
+}
+
+// next returns the next n bytes.
+func (d *decoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.data)-d.off {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalid)
+	}
+
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// uint reads a big-endian unsigned integer of size bytes.
+func (d *decoder) uint(size int) (uint64, error) {
+	b, err := d.next(size)
+	if err != nil {
+		return 0, err
+	}
+
+	var n uint64
+	for _, c := range b {
+		n = n<<8 | uint64(c)
+	}
+	return n, nil
+}
+
+func (d *decoder) value(depth int) (any, error) {
+	if depth > maxDepth {
+		return nil, fmt.Errorf("%w: nested more than %d levels deep", ErrInvalid, maxDepth)
+	}
+
+	b, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+
+	switch c := b[0]; {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xf0 == 0x80:
+		return d.mapValue(int(c&0x0f), depth)
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	}
+
+	switch c := b[0]; c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xd9: // bin 8, str 8
+		n, err := d.uint(1)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc5, 0xda: // bin 16, str 16
+		n, err := d.uint(2)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xc6, 0xdb: // bin 32, str 32
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return d.str(int(n))
+	case 0xca:
+		n, err := d.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 0xcb:
+		n, err := d.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return math.Float64frombits(n), nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		n, err := d.uint(1 << (c - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case 0xd0:
+		n, err := d.uint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.uint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.uint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.uint(8)
+		return int64(n), err
+	case 0xdc, 0xdd: // array 16, array 32
+		n, err := d.uint(2 << (c - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.array(int(n), depth)
+	case 0xde, 0xdf: // map 16, map 32
+		n, err := d.uint(2 << (c - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.mapValue(int(n), depth)
+	default:
+		return nil, fmt.Errorf("%w: unsupported format 0x%02x", ErrInvalid, c)
+	}
+}
+
+func (d *decoder) str(n int) (string, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+func (d *decoder) array(n int, depth int) (any, error) {
+	// Every element takes at least a byte, so a length past the end of the data is
+	// rejected before anything is allocated for it.
+	if n > len(d.data)-d.off {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalid)
+	}
+
+	a := make([]any, 0, n)
+	for range n {
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, v)
+	}
+	return a, nil
+}
+
+func (d *decoder) mapValue(n int, depth int) (any, error) {
+	if n > (len(d.data)-d.off)/2 {
+		return nil, fmt.Errorf("%w: unexpected end of data", ErrInvalid)
+	}
+
+	m := make(map[string]any, n)
+	for range n {
+		k, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("%w: map key is not a string", ErrInvalid)
+		}
+
+		v, err := d.value(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		m[key] = v
+	}
+	return m, nil
+}
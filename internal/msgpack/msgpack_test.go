@@ -0,0 +1,120 @@
+package msgpack
+
+import (
+	"encoding/hex"
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value any
+	}{
+		{"Nil", nil},
+		{"False", false},
+		{"True", true},
+		{"Positive Fixint", int64(127)},
+		{"Negative Fixint", int64(-32)},
+		{"Int8", int64(-128)},
+		{"Int16", int64(math.MinInt16)},
+		{"Int32", int64(math.MinInt32)},
+		{"Int64", int64(math.MinInt64)},
+		{"Uint8", int64(255)},
+		{"Uint16", int64(math.MaxUint16)},
+		{"Uint32", int64(math.MaxUint32)},
+		{"Max Int64", int64(math.MaxInt64)},
+		{"Uint64", uint64(math.MaxUint64)},
+		{"Float", 3.25},
+		{"Empty String", ""},
+		{"Str8", strings.Repeat("a", 255)},
+		{"Str16", strings.Repeat("b", math.MaxUint16)},
+		{"Str32", strings.Repeat("c", math.MaxUint16+1)},
+		{"Empty Array", []any{}},
+		{"Array16", make([]any, 16)},
+		{"Nested", map[string]any{"items": []any{map[string]any{"price": 1.5, "name": "gum"}}, "total": int64(3)}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := Marshal(tc.value)
+			assert.NoError(t, err)
+
+			got, err := Unmarshal(b)
+			assert.NoError(t, err)
+			if !reflect.DeepEqual(got, tc.value) {
+				t.Errorf("got: %#v; want: %#v", got, tc.value)
+			}
+		})
+	}
+}
+
+func TestMarshalSortsKeys(t *testing.T) {
+	b, err := Marshal(map[string]any{"b": int64(2), "a": int64(1), "c": int64(3)})
+	assert.NoError(t, err)
+	assert.Equal(t, hex.EncodeToString(b), "83a16101a16202a16303")
+}
+
+func TestMarshalUnsupported(t *testing.T) {
+	_, err := Marshal(map[string]any{"ch": make(chan int)})
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assert.Equal(t, err.Error(), "msgpack: unsupported type chan int")
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		hex  string
+		want string
+	}{
+		{"Empty", "", "unexpected end of data"},
+		{"Truncated Int", "cd01", "unexpected end of data"},
+		{"Truncated Float", "cb3ff8", "unexpected end of data"},
+		{"Truncated Str8", "d905616263", "unexpected end of data"},
+		{"Truncated Str16 Header", "da00", "unexpected end of data"},
+		{"Truncated Array", "930101", "unexpected end of data"},
+		{"Truncated Map Value", "81a161", "unexpected end of data"},
+		{"Oversized Str32", "dbffffffff61", "unexpected end of data"},
+		{"Oversized Bin32", "c6ffffffff", "unexpected end of data"},
+		{"Oversized Array32", "ddffffffff", "unexpected end of data"},
+		{"Oversized Map32", "dfffffffff", "unexpected end of data"},
+		{"Oversized Array16", "dcffff01", "unexpected end of data"},
+		{"Map Longer Than Data", "de00030101", "unexpected end of data"},
+		{"Non-String Key", "810101", "map key is not a string"},
+		{"Extension", "d40100", "unsupported format 0xd4"},
+		{"Never Used", "c1", "unsupported format 0xc1"},
+		{"Trailing Data", "c0c0", "trailing data after the value"},
+		{"Too Deep", strings.Repeat("91", maxDepth+1) + "c0", "nested more than 100 levels deep"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := hex.DecodeString(tc.hex)
+			assert.NoError(t, err)
+
+			_, err = Unmarshal(b)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !errors.Is(err, ErrInvalid) {
+				t.Errorf("got: %v; want an ErrInvalid error", err)
+			}
+			assert.Contains(t, err.Error(), tc.want)
+		})
+	}
+}
+
+func TestUnmarshalMaxDepth(t *testing.T) {
+	b, err := hex.DecodeString(strings.Repeat("91", maxDepth) + "c0")
+	assert.NoError(t, err)
+
+	_, err = Unmarshal(b)
+	assert.NoError(t, err)
+}
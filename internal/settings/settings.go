@@ -0,0 +1,181 @@
+// Package settings layers settings from a config file and environment variables on top
+// of a flag.FlagSet. The flag set stays the single source of truth for names, types
+// and defaults: file keys and environment variables are mapped to flag names and
+// applied with flag.FlagSet.Set, so they are parsed and checked exactly like flags.
+package settings
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownKey is returned for a setting which doesn't match a flag.
+var ErrUnknownKey = errors.New("unknown setting")
+
+// ParseFile reads a JSON or TOML config file, chosen by its extension (.toml for TOML,
+// anything else is JSON), and returns its settings flattened to flag names.
+func ParseFile(path string) (map[string]string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		doc, err = parseTOML(b)
+	} else {
+		err = json.Unmarshal(b, &doc)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := make(map[string]string)
+	err = flatten("", doc, settings)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return settings, nil
+}
+
+// flatten joins nested keys with "-" so {"limiter": {"rps": 2}} becomes
+// "limiter-rps". Underscores and dots in keys are treated like dashes. Arrays become
+// comma-separated lists.
+func flatten(prefix string, doc map[string]any, settings map[string]string) error {
+	for key, value := range doc {
+		name := normalize(key)
+		if prefix != "" {
+			name = prefix + "-" + name
+		}
+
+		switch v := value.(type) {
+		case map[string]any:
+			err := flatten(name, v, settings)
+			if err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, 0, len(v))
+			for _, item := range v {
+				s, err := scalar(name, item)
+				if err != nil {
+					return err
+				}
+				items = append(items, s)
+			}
+			settings[name] = strings.Join(items, ",")
+		default:
+			s, err := scalar(name, v)
+			if err != nil {
+				return err
+			}
+			settings[name] = s
+		}
+	}
+
+	return nil
+}
+
+func scalar(name string, value any) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	default:
+		return "", fmt.Errorf("%s: unsupported value %v", name, value)
+	}
+}
+
+func normalize(key string) string {
+	return strings.ToLower(strings.NewReplacer("_", "-", ".", "-").Replace(key))
+}
+
+// FromEnv returns the settings held in environment variables starting with prefix,
+// keyed on flag name. With the prefix "FETCH_", FETCH_LIMITER_RPS sets "limiter-rps".
+func FromEnv(environ []string, prefix string) map[string]string {
+	settings := make(map[string]string)
+
+	for _, kv := range environ {
+		key, value, ok := strings.Cut(kv, "=")
+		if !ok {
+			continue
+		}
+
+		name, ok := strings.CutPrefix(key, prefix)
+		if !ok || name == "" {
+			continue
+		}
+
+		settings[normalize(name)] = value
+	}
+
+	return settings
+}
+
+// Unknown removes the settings which don't match a flag and returns their names,
+// sorted. Sources shared with other software, such as the environment, use it to skip
+// names that aren't theirs instead of failing in Apply.
+func Unknown(fs *flag.FlagSet, settings map[string]string) []string {
+	var names []string
+	for name := range settings {
+		if fs.Lookup(name) == nil {
+			names = append(names, name)
+			delete(settings, name)
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Apply sets the flags named in settings, except those in skip, which have been set
+// by a source with higher precedence. Unknown names and invalid values are reported
+// with the source, such as the file name or "environment", so they are easy to find.
+func Apply(fs *flag.FlagSet, settings map[string]string, source string, skip map[string]bool) error {
+	names := make([]string, 0, len(settings))
+	for name := range settings {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		if skip[name] {
+			continue
+		}
+
+		if fs.Lookup(name) == nil {
+			errs = append(errs, fmt.Errorf("%s: %w %q", source, ErrUnknownKey, name))
+			continue
+		}
+
+		err := fs.Set(name, settings[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: invalid value %q for %s: %v", source, settings[name], name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Explicit returns the names of the flags that were set on the command line.
+func Explicit(fs *flag.FlagSet) map[string]bool {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	return set
+}
@@ -0,0 +1,194 @@
+package settings
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+// newFlagSet returns a flag set with a few flags of each type, as the API registers.
+func newFlagSet() *flag.FlagSet {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Int("port", 4000, "")
+	fs.String("env", "development", "")
+	fs.Float64("limiter-rps", 2, "")
+	fs.Bool("limiter-enabled", true, "")
+	fs.Duration("shutdown-drain-delay", 5*time.Second, "")
+	fs.String("cors-trusted-origins", "", "")
+	return fs
+}
+
+func writeFile(t *testing.T, name, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), name)
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestParseFileJSON(t *testing.T) {
+	path := writeFile(t, "config.json", `{
+		"port": 8080,
+		"limiter": {"rps": 2.5, "enabled": false},
+		"shutdown_drain.delay": "1s",
+		"cors": {"trusted-origins": ["https://a.example.com", "https://b.example.com"]}
+	}`)
+
+	settings, err := ParseFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, len(settings), 5)
+	assert.Equal(t, settings["port"], "8080")
+	assert.Equal(t, settings["limiter-rps"], "2.5")
+	assert.Equal(t, settings["limiter-enabled"], "false")
+	assert.Equal(t, settings["shutdown-drain-delay"], "1s")
+	assert.Equal(t, settings["cors-trusted-origins"], "https://a.example.com,https://b.example.com")
+}
+
+func TestParseFileTOML(t *testing.T) {
+	path := writeFile(t, "config.TOML", `
+# The API listener.
+port = 8_080
+env = "production" # trailing comment
+
+[limiter]
+rps = 2.5
+enabled = false
+
+[shutdown.drain]
+delay = '1s'
+
+[cors]
+"trusted-origins" = ["https://a.example.com#x", 'https://b.example.com']
+`)
+
+	settings, err := ParseFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, len(settings), 6)
+	assert.Equal(t, settings["port"], "8080")
+	assert.Equal(t, settings["env"], "production")
+	assert.Equal(t, settings["limiter-rps"], "2.5")
+	assert.Equal(t, settings["limiter-enabled"], "false")
+	assert.Equal(t, settings["shutdown-drain-delay"], "1s")
+	assert.Equal(t, settings["cors-trusted-origins"], "https://a.example.com#x,https://b.example.com")
+}
+
+func TestParseTOMLInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		want string
+	}{
+		{"Unclosed Header", "[limiter", "line 1: invalid table header"},
+		{"Array Of Tables", "[[limiter]]", "line 1: invalid table header"},
+		{"Empty Header Part", "[limiter.]", "line 1: invalid table header"},
+		{"Missing Equals", "port 4000", "line 1: expected key = value"},
+		{"Missing Key", "= 4000", "line 1: missing key"},
+		{"Missing Value", "port =", "line 1: missing value"},
+		{"Duplicate Key", "port = 1\nport = 2", `line 2: "port" is already defined`},
+		{"Table Over Key", "limiter = 1\n[limiter]", `line 2: "limiter" is already defined`},
+		{"Unterminated String", "env = 'production", "line 1: unterminated string"},
+		{"Multi-Line Array", "origins = [\n\"a\"]", "line 1: arrays must be on a single line"},
+		{"Bare Word", "env = production", "line 1: invalid value production"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseTOML([]byte(tc.toml))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tc.want)
+		})
+	}
+}
+
+func TestParseFileErrors(t *testing.T) {
+	_, err := ParseFile(filepath.Join(t.TempDir(), "missing.json"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("got: %v; want: %v", err, os.ErrNotExist)
+	}
+
+	path := writeFile(t, "config.json", `{"port": 4000`)
+	_, err = ParseFile(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assert.Contains(t, err.Error(), path+": ")
+
+	path = writeFile(t, "config.json", `{"limiter": {"rps": null}}`)
+	_, err = ParseFile(path)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	assert.Contains(t, err.Error(), "limiter-rps: unsupported value")
+}
+
+func TestFromEnv(t *testing.T) {
+	settings := FromEnv([]string{
+		"FETCH_LIMITER_RPS=3",
+		"FETCH_ENV=staging=blue",
+		"FETCH_=ignored",
+		"HOME=/root",
+		"fetch_port=1",
+		"MALFORMED",
+	}, "FETCH_")
+
+	assert.Equal(t, len(settings), 2)
+	assert.Equal(t, settings["limiter-rps"], "3")
+	assert.Equal(t, settings["env"], "staging=blue")
+}
+
+func TestUnknown(t *testing.T) {
+	settings := map[string]string{"port": "1", "service-host": "10.0.0.1", "port-80-tcp": "tcp://10.0.0.1:80"}
+
+	names := Unknown(newFlagSet(), settings)
+	assert.Equal(t, len(names), 2)
+	assert.Equal(t, names[0], "port-80-tcp")
+	assert.Equal(t, names[1], "service-host")
+	assert.Equal(t, len(settings), 1)
+	assert.Equal(t, settings["port"], "1")
+}
+
+func TestApplyPrecedence(t *testing.T) {
+	fs := newFlagSet()
+	assert.NoError(t, fs.Parse([]string{"-port", "9000"}))
+	explicit := Explicit(fs)
+	assert.Equal(t, len(explicit), 1)
+
+	// Sources are applied from lowest to highest precedence, each skipping the flags
+	// set on the command line: the file, then the environment.
+	file := map[string]string{"port": "8080", "env": "staging", "limiter-rps": "5"}
+	env := map[string]string{"port": "7000", "env": "production"}
+
+	assert.NoError(t, Apply(fs, file, "config.json", explicit))
+	assert.NoError(t, Apply(fs, env, "environment", explicit))
+
+	assert.Equal(t, fs.Lookup("port").Value.String(), "9000")
+	assert.Equal(t, fs.Lookup("env").Value.String(), "production")
+	assert.Equal(t, fs.Lookup("limiter-rps").Value.String(), "5")
+	assert.Equal(t, fs.Lookup("limiter-enabled").Value.String(), "true")
+}
+
+func TestApplyErrors(t *testing.T) {
+	fs := newFlagSet()
+
+	err := Apply(fs, map[string]string{
+		"port":          "eighty",
+		"limiter-burst": "4",
+		"env":           "staging",
+	}, "config.toml", nil)
+
+	if !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("got: %v; want: %v", err, ErrUnknownKey)
+	}
+	assert.Contains(t, err.Error(), `config.toml: unknown setting "limiter-burst"`)
+	assert.Contains(t, err.Error(), `config.toml: invalid value "eighty" for port`)
+
+	// Valid settings are still applied.
+	assert.Equal(t, fs.Lookup("env").Value.String(), "staging")
+}
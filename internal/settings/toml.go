@@ -0,0 +1,150 @@
+package settings
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseTOML parses the subset of TOML used by config files: [table] and [table.sub]
+// headers, and key = value pairs where the value is a string, integer, float, boolean
+// or a single-line array of those. Comments start with #.
+func parseTOML(b []byte) (map[string]any, error) {
+	doc := make(map[string]any)
+	table := doc
+
+	for i, line := range strings.Split(string(b), "\n") {
+		lineNo := i + 1
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: invalid table header", lineNo)
+			}
+
+			table = doc
+			for _, part := range strings.Split(strings.Trim(line, "[]"), ".") {
+				part = strings.TrimSpace(part)
+				if part == "" {
+					return nil, fmt.Errorf("line %d: invalid table header", lineNo)
+				}
+
+				next, ok := table[part].(map[string]any)
+				if !ok {
+					if _, exists := table[part]; exists {
+						return nil, fmt.Errorf("line %d: %q is already defined", lineNo, part)
+					}
+					next = make(map[string]any)
+					table[part] = next
+				}
+				table = next
+			}
+			continue
+		}
+
+		key, raw, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNo)
+		}
+
+		key = strings.Trim(strings.TrimSpace(key), `"`)
+		if key == "" {
+			return nil, fmt.Errorf("line %d: missing key", lineNo)
+		}
+		if _, exists := table[key]; exists {
+			return nil, fmt.Errorf("line %d: %q is already defined", lineNo, key)
+		}
+
+		value, err := parseTOMLValue(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		table[key] = value
+	}
+
+	return doc, nil
+}
+
+// stripComment removes a trailing comment, leaving # inside strings alone.
+func stripComment(line string) string {
+	var quote rune
+	for i, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseTOMLValue(raw string) (any, error) {
+	switch {
+	case raw == "":
+		return nil, fmt.Errorf("missing value")
+	case raw == "true" || raw == "false":
+		return raw == "true", nil
+	case strings.HasPrefix(raw, `"`):
+		return strconv.Unquote(raw)
+	case strings.HasPrefix(raw, "'"):
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	case strings.HasPrefix(raw, "["):
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("arrays must be on a single line")
+		}
+
+		items := []any{}
+		for _, item := range splitArray(raw[1 : len(raw)-1]) {
+			value, err := parseTOMLValue(item)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	}
+
+	n := strings.ReplaceAll(raw, "_", "")
+	if i, err := strconv.ParseInt(n, 10, 64); err == nil {
+		return i, nil
+	}
+	if f, err := strconv.ParseFloat(n, 64); err == nil {
+		return f, nil
+	}
+
+	return nil, fmt.Errorf("invalid value %s", raw)
+}
+
+// splitArray splits the inside of an array on commas outside quotes.
+func splitArray(s string) []string {
+	var items []string
+	var quote rune
+	start := 0
+
+	for i, c := range s {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\''):
+			quote = c
+		case quote == 0 && c == ',':
+			items = append(items, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+
+	if last := strings.TrimSpace(s[start:]); last != "" {
+		items = append(items, last)
+	}
+
+	return items
+}
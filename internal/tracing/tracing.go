@@ -0,0 +1,392 @@
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrInvalidTraceparent = errors.New("invalid traceparent header")
+
+// TraceID and SpanID identify a trace and a span within it, as defined by W3C Trace
+// Context.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// IsValid reports whether the ID is not all zeroes.
+func (t TraceID) IsValid() bool { return t != TraceID{} }
+
+// IsValid reports whether the ID is not all zeroes.
+func (s SpanID) IsValid() bool { return s != SpanID{} }
+
+// flagSampled is the "sampled" bit of the traceparent trace-flags field.
+const flagSampled = 0x01
+
+// SpanContext is the part of a span that is propagated between services.
+type SpanContext struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	Flags      byte
+	TraceState string
+}
+
+// ParseTraceparent parses a W3C traceparent header such as
+// "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01".
+func ParseTraceparent(s string) (SpanContext, error) {
+	s = strings.TrimSpace(s)
+	parts := strings.Split(s, "-")
+	if len(parts) < 4 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	version, err := hex.DecodeString(parts[0])
+	if err != nil || len(version) != 1 || version[0] == 0xff {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	// Version 00 has exactly four fields. Later versions may append more, which
+	// must be ignored.
+	if version[0] == 0 && len(parts) != 4 {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	var sc SpanContext
+	if !decodeLowerHex(sc.TraceID[:], parts[1]) || !decodeLowerHex(sc.SpanID[:], parts[2]) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	if !sc.TraceID.IsValid() || !sc.SpanID.IsValid() {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+
+	var flags [1]byte
+	if !decodeLowerHex(flags[:], parts[3]) {
+		return SpanContext{}, ErrInvalidTraceparent
+	}
+	sc.Flags = flags[0]
+
+	return sc, nil
+}
+
+// decodeLowerHex decodes s into dst, requiring exactly len(dst)*2 lowercase hex digits.
+func decodeLowerHex(dst []byte, s string) bool {
+	if len(s) != len(dst)*2 || strings.ToLower(s) != s {
+		return false
+	}
+	_, err := hex.Decode(dst, []byte(s))
+	return err == nil
+}
+
+// Traceparent formats the span context as a version 00 traceparent header.
+func (sc SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", sc.TraceID, sc.SpanID, sc.Flags)
+}
+
+// SpanKind values, numbered as in OTLP.
+const (
+	KindInternal = 1
+	KindServer   = 2
+)
+
+// Status codes, numbered as in OTLP.
+const (
+	StatusUnset = 0
+	StatusOK    = 1
+	StatusError = 2
+)
+
+// Span is a timed operation within a trace. All methods are safe to call on a nil
+// *Span, which is what a nil *Tracer hands out, so instrumented code doesn't have to
+// check whether tracing is enabled.
+type Span struct {
+	tracer *Tracer
+	name   string
+	kind   int
+	sc     SpanContext
+	parent SpanID
+	start  time.Time
+
+	mu            sync.Mutex
+	end           time.Time
+	attributes    map[string]any
+	statusCode    int
+	statusMessage string
+}
+
+// SpanContext returns the span's propagation context.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.sc
+}
+
+// SetAttribute records a key/value pair on the span.
+func (s *Span) SetAttribute(key string, value any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+// SetError marks the span as failed.
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statusCode = StatusError
+	s.statusMessage = err.Error()
+}
+
+// End finishes the span and hands it to the exporter. Calling End more than once has
+// no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	s.tracer.export(s)
+}
+
+type spanContextKey struct{}
+
+// SpanFromContext returns the current span, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// Exporter receives finished spans.
+type Exporter interface {
+	Export(spans []*Span) error
+}
+
+// Tracer creates spans and sends them to an Exporter when they end. A nil *Tracer is
+// valid and creates nil spans.
+type Tracer struct {
+	exporter Exporter
+	onError  func(error)
+}
+
+// New returns a Tracer which sends finished spans to exporter. Export errors are
+// passed to onError, which may be nil.
+func New(exporter Exporter, onError func(error)) *Tracer {
+	return &Tracer{exporter: exporter, onError: onError}
+}
+
+// Start begins a span which is a child of the span in ctx, or the root of a new trace
+// if ctx has none. The returned context carries the new span.
+func (t *Tracer) Start(ctx context.Context, name string) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return t.start(ctx, name, KindInternal, SpanContext{Flags: flagSampled})
+	}
+
+	return t.start(ctx, name, KindInternal, parent.sc)
+}
+
+// StartServer begins a server span for an incoming request. If remote is valid (it
+// came from a traceparent header) the span joins the caller's trace.
+func (t *Tracer) StartServer(ctx context.Context, name string, remote SpanContext) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	if !remote.TraceID.IsValid() {
+		remote = SpanContext{Flags: flagSampled}
+	}
+
+	return t.start(ctx, name, KindServer, remote)
+}
+
+func (t *Tracer) start(ctx context.Context, name string, kind int, parent SpanContext) (context.Context, *Span) {
+	s := &Span{
+		tracer:     t,
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: make(map[string]any),
+		sc: SpanContext{
+			TraceID:    parent.TraceID,
+			Flags:      parent.Flags,
+			TraceState: parent.TraceState,
+		},
+		parent: parent.SpanID,
+	}
+
+	if !s.sc.TraceID.IsValid() {
+		rand.Read(s.sc.TraceID[:])
+	}
+	rand.Read(s.sc.SpanID[:])
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+func (t *Tracer) export(s *Span) {
+	if t.exporter == nil || s.sc.Flags&flagSampled == 0 {
+		return
+	}
+
+	err := t.exporter.Export([]*Span{s})
+	if err != nil && t.onError != nil {
+		t.onError(err)
+	}
+}
+
+// WriterExporter writes each batch of spans to an io.Writer as a single line of
+// OTLP/JSON (an ExportTraceServiceRequest), suitable for a file or stdout that a
+// collector tails.
+type WriterExporter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	service string
+}
+
+// NewWriterExporter returns an exporter that writes to w.
+func NewWriterExporter(w io.Writer, service string) *WriterExporter {
+	return &WriterExporter{w: w, service: service}
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	TraceState        string          `json:"traceState,omitempty"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	} `json:"status"`
+}
+
+func toOTLPValue(v any) otlpValue {
+	switch v := v.(type) {
+	case string:
+		return otlpValue{StringValue: &v}
+	case int:
+		s := strconv.Itoa(v)
+		return otlpValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpValue{IntValue: &s}
+	case float64:
+		return otlpValue{DoubleValue: &v}
+	case bool:
+		return otlpValue{BoolValue: &v}
+	default:
+		s := fmt.Sprint(v)
+		return otlpValue{StringValue: &s}
+	}
+}
+
+func toOTLPSpan(s *Span) otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           s.sc.TraceID.String(),
+		SpanID:            s.sc.SpanID.String(),
+		TraceState:        s.sc.TraceState,
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parent.IsValid() {
+		span.ParentSpanID = s.parent.String()
+	}
+	span.Status.Code = s.statusCode
+	span.Status.Message = s.statusMessage
+
+	keys := make([]string, 0, len(s.attributes))
+	for key := range s.attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		span.Attributes = append(span.Attributes, otlpAttribute{Key: key, Value: toOTLPValue(s.attributes[key])})
+	}
+
+	return span
+}
+
+// Export implements Exporter.
+func (e *WriterExporter) Export(spans []*Span) error {
+	otlpSpans := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		otlpSpans = append(otlpSpans, toOTLPSpan(s))
+	}
+
+	service := e.service
+	request := map[string]any{
+		"resourceSpans": []any{
+			map[string]any{
+				"resource": map[string]any{
+					"attributes": []otlpAttribute{{Key: "service.name", Value: otlpValue{StringValue: &service}}},
+				},
+				"scopeSpans": []any{
+					map[string]any{
+						"scope": map[string]any{"name": "fetch.trungnng.github.io/internal/tracing"},
+						"spans": otlpSpans,
+					},
+				},
+			},
+		},
+	}
+
+	b, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(append(b, '\n'))
+	return err
+}
@@ -0,0 +1,186 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	sc, err := ParseTraceparent(" 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 ")
+	assert.NoError(t, err)
+	assert.Equal(t, sc.TraceID.String(), "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, sc.SpanID.String(), "00f067aa0ba902b7")
+	assert.Equal(t, sc.Flags, byte(0x01))
+	assert.Equal(t, sc.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	// Later versions may append fields, which are ignored.
+	sc, err = ParseTraceparent("cc-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-future")
+	assert.NoError(t, err)
+	assert.Equal(t, sc.Traceparent(), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+
+	tests := []struct {
+		name   string
+		header string
+	}{
+		{"Empty", ""},
+		{"Too Few Fields", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7"},
+		{"Extra Field In Version 00", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-x"},
+		{"Forbidden Version", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{"Bad Version", "0-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{"Uppercase Trace ID", "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"},
+		{"Short Trace ID", "00-4bf92f3577b34da6a3ce929d0e0e47-00f067aa0ba902b7-01"},
+		{"Zero Trace ID", "00-00000000000000000000000000000000-00f067aa0ba902b7-01"},
+		{"Zero Span ID", "00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01"},
+		{"Bad Flags", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-1"},
+		{"Not Hex", "00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := ParseTraceparent(tc.header)
+			if !errors.Is(err, ErrInvalidTraceparent) {
+				t.Errorf("got: %v; want: %v", err, ErrInvalidTraceparent)
+			}
+		})
+	}
+}
+
+// recorder is an Exporter which keeps the spans it is given.
+type recorder struct {
+	spans []*Span
+	err   error
+}
+
+func (r *recorder) Export(spans []*Span) error {
+	r.spans = append(r.spans, spans...)
+	return r.err
+}
+
+func TestTracer(t *testing.T) {
+	rec := &recorder{}
+	tracer := New(rec, nil)
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+
+	// A server span joins the caller's trace, and its children join it in turn.
+	ctx, server := tracer.StartServer(t.Context(), "GET /receipts/:id/points", remote)
+	assert.Equal(t, SpanFromContext(ctx), server)
+	assert.Equal(t, server.SpanContext().TraceID, remote.TraceID)
+	assert.Equal(t, server.parent, remote.SpanID)
+
+	_, child := tracer.Start(ctx, "calculatePoints")
+	assert.Equal(t, child.SpanContext().TraceID, remote.TraceID)
+	assert.Equal(t, child.parent, server.SpanContext().SpanID)
+	assert.Equal(t, child.SpanContext().SpanID != server.SpanContext().SpanID, true)
+
+	// Spans are exported once, when they end.
+	child.End()
+	child.End()
+	server.End()
+	assert.Equal(t, len(rec.spans), 2)
+	assert.Equal(t, rec.spans[0], child)
+
+	// Without a valid caller, a new sampled trace is started.
+	_, root := tracer.StartServer(t.Context(), "GET /healthcheck", SpanContext{})
+	assert.Equal(t, root.SpanContext().TraceID.IsValid(), true)
+	assert.Equal(t, root.SpanContext().TraceID != remote.TraceID, true)
+	assert.Equal(t, root.parent.IsValid(), false)
+	root.End()
+	assert.Equal(t, len(rec.spans), 3)
+
+	// Traces the caller didn't sample aren't exported.
+	remote.Flags = 0
+	_, unsampled := tracer.StartServer(t.Context(), "GET /healthcheck", remote)
+	unsampled.End()
+	assert.Equal(t, len(rec.spans), 3)
+}
+
+func TestNilTracer(t *testing.T) {
+	var tracer *Tracer
+
+	ctx, span := tracer.Start(context.Background(), "noop")
+	if span != nil {
+		t.Fatal("expected a nil span")
+	}
+	assert.Equal(t, SpanFromContext(ctx) == nil, true)
+
+	// Every method is safe on the nil span.
+	span.SetAttribute("key", "value")
+	span.SetError(errors.New("boom"))
+	span.End()
+	assert.Equal(t, span.SpanContext().TraceID.IsValid(), false)
+}
+
+func TestExportError(t *testing.T) {
+	var got error
+	tracer := New(&recorder{err: errors.New("collector down")}, func(err error) { got = err })
+
+	_, span := tracer.Start(t.Context(), "op")
+	span.End()
+
+	if got == nil || got.Error() != "collector down" {
+		t.Errorf("got: %v; want: collector down", got)
+	}
+}
+
+func TestWriterExporter(t *testing.T) {
+	var b strings.Builder
+	tracer := New(NewWriterExporter(&b, "fetch-api"), nil)
+
+	remote, err := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	assert.NoError(t, err)
+
+	_, span := tracer.StartServer(t.Context(), "POST /receipts/process", remote)
+	span.SetAttribute("http.status_code", 400)
+	span.SetAttribute("http.method", "POST")
+	span.SetAttribute("sampled", true)
+	span.SetAttribute("points", int64(28))
+	span.SetAttribute("ratio", 0.5)
+	span.SetError(errors.New("invalid receipt"))
+	span.End()
+
+	output := b.String()
+	assert.Equal(t, strings.Count(output, "\n"), 1)
+
+	var request struct {
+		ResourceSpans []struct {
+			Resource struct {
+				Attributes []otlpAttribute `json:"attributes"`
+			} `json:"resource"`
+			ScopeSpans []struct {
+				Spans []otlpSpan `json:"spans"`
+			} `json:"scopeSpans"`
+		} `json:"resourceSpans"`
+	}
+	assert.NoError(t, json.Unmarshal([]byte(output), &request))
+
+	resource := request.ResourceSpans[0]
+	assert.Equal(t, *resource.Resource.Attributes[0].Value.StringValue, "fetch-api")
+
+	got := resource.ScopeSpans[0].Spans[0]
+	assert.Equal(t, got.TraceID, "4bf92f3577b34da6a3ce929d0e0e4736")
+	assert.Equal(t, got.ParentSpanID, "00f067aa0ba902b7")
+	assert.Equal(t, got.SpanID, span.SpanContext().SpanID.String())
+	assert.Equal(t, got.Name, "POST /receipts/process")
+	assert.Equal(t, got.Kind, KindServer)
+	assert.Equal(t, got.Status.Code, StatusError)
+	assert.Equal(t, got.Status.Message, "invalid receipt")
+
+	// Attributes are sorted by key and typed as OTLP expects; integers are strings.
+	var keys []string
+	for _, attr := range got.Attributes {
+		keys = append(keys, attr.Key)
+	}
+	assert.Equal(t, strings.Join(keys, ","), "http.method,http.status_code,points,ratio,sampled")
+	assert.Equal(t, *got.Attributes[0].Value.StringValue, "POST")
+	assert.Equal(t, *got.Attributes[1].Value.IntValue, "400")
+	assert.Equal(t, *got.Attributes[2].Value.IntValue, "28")
+	assert.Equal(t, *got.Attributes[3].Value.DoubleValue, 0.5)
+	assert.Equal(t, *got.Attributes[4].Value.BoolValue, true)
+}
@@ -0,0 +1,142 @@
+package trust
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// Status is the result of checking a receipt's signature against the trust store.
+type Status string
+
+const (
+	// Unsigned means the receipt did not come with a signature.
+	Unsigned Status = "unsigned"
+	// Untrusted means the receipt was signed but the retailer has no keys in the trust
+	// store, so the signature could not be checked.
+	Untrusted Status = "untrusted"
+	// Invalid means the retailer is known but the signature does not match any of its
+	// keys. The receipt has been tampered with or signed with the wrong key.
+	Invalid Status = "invalid"
+	// Verified means the signature matches one of the retailer's keys.
+	Verified Status = "verified"
+)
+
+// Store holds the Ed25519 public keys of each retailer. A retailer may have several
+// keys at once so it can rotate them without a gap.
+type Store struct {
+	mu   sync.RWMutex
+	keys map[string][]ed25519.PublicKey
+}
+
+// New returns an empty Store.
+func New() *Store {
+	return &Store{keys: make(map[string][]ed25519.PublicKey)}
+}
+
+// Load reads a trust store file. The file is a JSON object mapping each retailer name
+// (as it appears in Receipt.Retailer) to a list of base64-encoded Ed25519 public keys:
+//
+//	{"Target": ["11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=", "..."]}
+func Load(path string) (*Store, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string][]string
+	err = json.Unmarshal(b, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	s := New()
+	for retailer, encoded := range doc {
+		for _, e := range encoded {
+			key, err := base64.StdEncoding.DecodeString(e)
+			if err != nil || len(key) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("%s: invalid public key for retailer %q", path, retailer)
+			}
+			s.Add(retailer, ed25519.PublicKey(key))
+		}
+	}
+
+	return s, nil
+}
+
+// Add registers a public key for the retailer.
+func (s *Store) Add(retailer string, key ed25519.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.keys[retailer] = append(s.keys[retailer], key)
+}
+
+// Remove unregisters a public key from the retailer. It reports whether the key was
+// found.
+func (s *Store) Remove(retailer string, key ed25519.PublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := s.keys[retailer]
+	for i, k := range keys {
+		if k.Equal(key) {
+			keys = append(keys[:i:i], keys[i+1:]...)
+			if len(keys) == 0 {
+				delete(s.keys, retailer)
+			} else {
+				s.keys[retailer] = keys
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keys returns a copy of every retailer's keys.
+func (s *Store) Keys() map[string][]ed25519.PublicKey {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make(map[string][]ed25519.PublicKey, len(s.keys))
+	for retailer, k := range s.keys {
+		keys[retailer] = append([]ed25519.PublicKey(nil), k...)
+	}
+
+	return keys
+}
+
+// Retailers returns the number of retailers with at least one key.
+func (s *Store) Retailers() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.keys)
+}
+
+// Verify checks the detached signature over msg against the retailer's keys.
+func (s *Store) Verify(retailer string, msg, signature []byte) Status {
+	if len(signature) == 0 {
+		return Unsigned
+	}
+
+	s.mu.RLock()
+	keys := s.keys[retailer]
+	s.mu.RUnlock()
+
+	if len(keys) == 0 {
+		return Untrusted
+	}
+
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, signature) {
+			return Verified
+		}
+	}
+
+	return Invalid
+}
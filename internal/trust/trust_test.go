@@ -0,0 +1,120 @@
+package trust
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+// newKey returns a key pair derived from seed, so tests are repeatable.
+func newKey(seed byte) (ed25519.PublicKey, ed25519.PrivateKey) {
+	b := make([]byte, ed25519.SeedSize)
+	b[0] = seed
+
+	private := ed25519.NewKeyFromSeed(b)
+	return private.Public().(ed25519.PublicKey), private
+}
+
+func TestVerify(t *testing.T) {
+	current, currentPrivate := newKey(1)
+	next, nextPrivate := newKey(2)
+	_, otherPrivate := newKey(3)
+
+	s := New()
+	s.Add("Target", current)
+	s.Add("Target", next)
+
+	msg := []byte(`{"retailer":"Target","total":"35.35"}`)
+
+	tests := []struct {
+		name      string
+		retailer  string
+		msg       []byte
+		signature []byte
+		want      Status
+	}{
+		{"Unsigned", "Target", msg, nil, Unsigned},
+		{"Unknown Retailer", "Walmart", msg, ed25519.Sign(currentPrivate, msg), Untrusted},
+		{"Current Key", "Target", msg, ed25519.Sign(currentPrivate, msg), Verified},
+		{"Next Key", "Target", msg, ed25519.Sign(nextPrivate, msg), Verified},
+		{"Other Key", "Target", msg, ed25519.Sign(otherPrivate, msg), Invalid},
+		{"Tampered Message", "Target", []byte(`{"retailer":"Target","total":"0.35"}`), ed25519.Sign(currentPrivate, msg), Invalid},
+		{"Truncated Signature", "Target", msg, ed25519.Sign(currentPrivate, msg)[:32], Invalid},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, s.Verify(tc.retailer, tc.msg, tc.signature), tc.want)
+		})
+	}
+}
+
+func TestRemove(t *testing.T) {
+	first, _ := newKey(1)
+	second, _ := newKey(2)
+
+	s := New()
+	s.Add("Target", first)
+	s.Add("Target", second)
+	assert.Equal(t, s.Retailers(), 1)
+
+	// Keys handed out earlier are copies, so removing one doesn't change them.
+	keys := s.Keys()
+
+	assert.Equal(t, s.Remove("Target", first), true)
+	assert.Equal(t, s.Remove("Target", first), false)
+	assert.Equal(t, len(s.Keys()["Target"]), 1)
+	assert.Equal(t, len(keys["Target"]), 2)
+	assert.Equal(t, keys["Target"][0].Equal(first), true)
+
+	// A retailer without keys is dropped.
+	assert.Equal(t, s.Remove("Target", second), true)
+	assert.Equal(t, s.Retailers(), 0)
+	assert.Equal(t, s.Remove("Walmart", second), false)
+}
+
+func TestLoad(t *testing.T) {
+	first, firstPrivate := newKey(1)
+	second, _ := newKey(2)
+
+	path := filepath.Join(t.TempDir(), "trust.json")
+	doc := `{"Target": ["` + base64.StdEncoding.EncodeToString(first) + `", "` + base64.StdEncoding.EncodeToString(second) + `"], "Walmart": []}`
+	assert.NoError(t, os.WriteFile(path, []byte(doc), 0o600))
+
+	s, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, s.Retailers(), 1)
+	assert.Equal(t, len(s.Keys()["Target"]), 2)
+	assert.Equal(t, s.Verify("Target", []byte("msg"), ed25519.Sign(firstPrivate, []byte("msg"))), Verified)
+
+	tests := []struct {
+		name string
+		doc  string
+		want string
+	}{
+		{"Not JSON", `{"Target": `, path + ": "},
+		{"Not Base64", `{"Target": ["not base64!"]}`, `invalid public key for retailer "Target"`},
+		{"Wrong Length", `{"Target": ["` + base64.StdEncoding.EncodeToString(first[:16]) + `"]}`, `invalid public key for retailer "Target"`},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.NoError(t, os.WriteFile(path, []byte(tc.doc), 0o600))
+
+			_, err := Load(path)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			assert.Contains(t, err.Error(), tc.want)
+		})
+	}
+
+	_, err = Load(filepath.Join(t.TempDir(), "missing.json"))
+	if !os.IsNotExist(err) {
+		t.Errorf("got: %v; want a not exist error", err)
+	}
+}
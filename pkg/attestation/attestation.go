@@ -0,0 +1,149 @@
+// Package attestation signs and verifies points attestations: statements from the
+// receipt processor that a receipt with a given content hash was awarded a number of
+// points under a ruleset version.
+//
+// Partners can verify attestations offline. Fetch the key set once from
+// /.well-known/fetch-attestation-keys, then:
+//
+//	var keys attestation.KeySet
+//	json.NewDecoder(rs.Body).Decode(&keys)
+//
+//	statement, err := attestation.Verify(att, keys)
+//
+// The key set is keyed on key ID so retired keys can still be used to verify old
+// attestations after the server starts signing with a new one.
+package attestation
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Algorithm is the signature algorithm of every attestation.
+const Algorithm = "Ed25519"
+
+var (
+	ErrUnknownKey       = errors.New("attestation: unknown key ID")
+	ErrInvalidSignature = errors.New("attestation: invalid signature")
+	ErrMalformed        = errors.New("attestation: malformed attestation")
+)
+
+// Statement is the signed content of an attestation.
+type Statement struct {
+	ReceiptID      string    `json:"receipt_id"`
+	ContentHash    string    `json:"content_hash"`
+	Points         int64     `json:"points"`
+	RulesetVersion string    `json:"ruleset_version"`
+	IssuedAt       time.Time `json:"issued_at"`
+}
+
+// Attestation is a signed Statement. The statement is carried as base64url-encoded
+// JSON so the exact signed bytes survive any re-encoding of the outer document.
+type Attestation struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// PublicKey is a published verification key.
+type PublicKey struct {
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Key       string `json:"public_key"`
+}
+
+// KeySet is the document served at the well-known keys endpoint.
+type KeySet struct {
+	Keys []PublicKey `json:"keys"`
+}
+
+// KeyID derives a stable key ID from a public key: the first 8 bytes of its SHA-256
+// hash, hex-encoded.
+func KeyID(key ed25519.PublicKey) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewPublicKey returns the published form of key.
+func NewPublicKey(key ed25519.PublicKey) PublicKey {
+	return PublicKey{
+		KeyID:     KeyID(key),
+		Algorithm: Algorithm,
+		Key:       base64.StdEncoding.EncodeToString(key),
+	}
+}
+
+// ContentHash returns the "sha256:<hex>" digest of a receipt's canonical JSON.
+func ContentHash(canonical []byte) string {
+	sum := sha256.Sum256(canonical)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Sign signs the statement with key.
+func Sign(key ed25519.PrivateKey, statement Statement) (Attestation, error) {
+	payload, err := json.Marshal(statement)
+	if err != nil {
+		return Attestation{}, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+	signature := ed25519.Sign(key, []byte(encoded))
+
+	return Attestation{
+		KeyID:     KeyID(key.Public().(ed25519.PublicKey)),
+		Algorithm: Algorithm,
+		Payload:   encoded,
+		Signature: base64.RawURLEncoding.EncodeToString(signature),
+	}, nil
+}
+
+// Verify checks the attestation's signature against the key set and returns the
+// signed statement.
+func Verify(att Attestation, keys KeySet) (Statement, error) {
+	if att.Algorithm != Algorithm {
+		return Statement{}, ErrMalformed
+	}
+
+	var key ed25519.PublicKey
+	for _, k := range keys.Keys {
+		if k.KeyID == att.KeyID && k.Algorithm == Algorithm {
+			b, err := base64.StdEncoding.DecodeString(k.Key)
+			if err != nil || len(b) != ed25519.PublicKeySize {
+				return Statement{}, ErrMalformed
+			}
+			key = b
+			break
+		}
+	}
+	if key == nil {
+		return Statement{}, ErrUnknownKey
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(att.Signature)
+	if err != nil {
+		return Statement{}, ErrMalformed
+	}
+
+	if !ed25519.Verify(key, []byte(att.Payload), signature) {
+		return Statement{}, ErrInvalidSignature
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(att.Payload)
+	if err != nil {
+		return Statement{}, ErrMalformed
+	}
+
+	var statement Statement
+	err = json.Unmarshal(payload, &statement)
+	if err != nil {
+		return Statement{}, ErrMalformed
+	}
+
+	return statement, nil
+}
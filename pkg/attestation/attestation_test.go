@@ -0,0 +1,127 @@
+package attestation
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+// newKey returns a key pair derived from seed, so tests are repeatable.
+func newKey(seed byte) (ed25519.PublicKey, ed25519.PrivateKey) {
+	b := make([]byte, ed25519.SeedSize)
+	b[0] = seed
+
+	private := ed25519.NewKeyFromSeed(b)
+	return private.Public().(ed25519.PublicKey), private
+}
+
+func newStatement() Statement {
+	return Statement{
+		ReceiptID:      "7fb1377b-b223-49d9-a31a-5a02701dd310",
+		ContentHash:    ContentHash([]byte(`{"retailer":"Target"}`)),
+		Points:         28,
+		RulesetVersion: "1+a1b2c3d4",
+		IssuedAt:       time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	oldPublic, oldPrivate := newKey(1)
+	public, private := newKey(2)
+	keys := KeySet{Keys: []PublicKey{NewPublicKey(public), NewPublicKey(oldPublic)}}
+
+	att, err := Sign(private, newStatement())
+	assert.NoError(t, err)
+	assert.Equal(t, att.KeyID, KeyID(public))
+	assert.Equal(t, att.Algorithm, Algorithm)
+
+	statement, err := Verify(att, keys)
+	assert.NoError(t, err)
+	assert.Equal(t, statement, newStatement())
+
+	// Attestations signed with a retired key still verify while it is published.
+	att, err = Sign(oldPrivate, newStatement())
+	assert.NoError(t, err)
+	_, err = Verify(att, keys)
+	assert.NoError(t, err)
+}
+
+func TestVerifyInvalid(t *testing.T) {
+	public, private := newKey(1)
+	_, otherPrivate := newKey(2)
+	keys := KeySet{Keys: []PublicKey{NewPublicKey(public)}}
+
+	forged, err := Sign(otherPrivate, newStatement())
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		tamper func(att *Attestation, keys *KeySet)
+		want   error
+	}{
+		{"Wrong Algorithm", func(att *Attestation, keys *KeySet) {
+			att.Algorithm = "HS256"
+		}, ErrMalformed},
+		{"Unknown Key", func(att *Attestation, keys *KeySet) {
+			keys.Keys = nil
+		}, ErrUnknownKey},
+		{"Key For Another Algorithm", func(att *Attestation, keys *KeySet) {
+			keys.Keys[0].Algorithm = "ES256"
+		}, ErrUnknownKey},
+		{"Malformed Public Key", func(att *Attestation, keys *KeySet) {
+			keys.Keys[0].Key = base64.StdEncoding.EncodeToString(public[:16])
+		}, ErrMalformed},
+		{"Malformed Signature", func(att *Attestation, keys *KeySet) {
+			att.Signature = "not base64!"
+		}, ErrMalformed},
+		{"Signed With Another Key", func(att *Attestation, keys *KeySet) {
+			att.Signature = forged.Signature
+		}, ErrInvalidSignature},
+		{"Tampered Payload", func(att *Attestation, keys *KeySet) {
+			statement := newStatement()
+			statement.Points = 1000
+			tampered, _ := Sign(otherPrivate, statement)
+			att.Payload = tampered.Payload
+		}, ErrInvalidSignature},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			att, err := Sign(private, newStatement())
+			assert.NoError(t, err)
+
+			set := KeySet{Keys: append([]PublicKey(nil), keys.Keys...)}
+			tc.tamper(&att, &set)
+
+			_, err = Verify(att, set)
+			if !errors.Is(err, tc.want) {
+				t.Errorf("got: %v; want: %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestKeyID(t *testing.T) {
+	first, _ := newKey(1)
+	second, _ := newKey(2)
+
+	assert.Equal(t, len(KeyID(first)), 16)
+	assert.Equal(t, KeyID(first), KeyID(append(ed25519.PublicKey(nil), first...)))
+	assert.Equal(t, KeyID(first) != KeyID(second), true)
+
+	published := NewPublicKey(first)
+	assert.Equal(t, published.KeyID, KeyID(first))
+	assert.Equal(t, published.Algorithm, Algorithm)
+	assert.Equal(t, published.Key, base64.StdEncoding.EncodeToString(first))
+}
+
+func TestContentHash(t *testing.T) {
+	// The SHA-256 of "test".
+	assert.Equal(t, ContentHash([]byte("test")), "sha256:9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08")
+	assert.Equal(t, strings.HasPrefix(ContentHash(nil), "sha256:"), true)
+}
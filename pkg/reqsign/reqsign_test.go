@@ -0,0 +1,97 @@
+package reqsign
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"fetch.trungnng.github.io/internal/assert"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestCanonicalString(t *testing.T) {
+	got := CanonicalString("post", "/receipts/process?source=pos", 1733011200, "5f2b0c8e9d1a4b7c", []byte("test"))
+
+	assert.Equal(t, got, strings.Join([]string{
+		"POST",
+		"/receipts/process?source=pos",
+		"1733011200",
+		"5f2b0c8e9d1a4b7c",
+		"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+	}, "\n"))
+
+	// An empty body hashes like any other.
+	got = CanonicalString("DELETE", "/receipts/1", 1733011200, "n", nil)
+	assert.Equal(t, strings.HasSuffix(got, "\ne3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"), true)
+}
+
+func TestValid(t *testing.T) {
+	canonical := CanonicalString("POST", "/receipts/process", 1733011200, "n", []byte("{}"))
+	signature := Signature(secret, canonical)
+
+	assert.Equal(t, Valid(secret, canonical, signature), true)
+	assert.Equal(t, Valid([]byte("another secret"), canonical, signature), false)
+	assert.Equal(t, Valid(secret, canonical+"x", signature), false)
+	assert.Equal(t, Valid(secret, canonical, ""), false)
+}
+
+func TestSign(t *testing.T) {
+	signedAt := time.Unix(1733011200, 0)
+
+	r, err := http.NewRequest(http.MethodPost, "https://api.example.com/receipts/process?source=pos&lane=2", strings.NewReader(`{"retailer":"Target"}`))
+	assert.NoError(t, err)
+	assert.NoError(t, SignAt(r, "partner-1", secret, signedAt))
+
+	assert.Equal(t, r.Header.Get(HeaderKeyID), "partner-1")
+	assert.Equal(t, r.Header.Get(HeaderTimestamp), strconv.FormatInt(signedAt.Unix(), 10))
+
+	nonce := r.Header.Get(HeaderNonce)
+	assert.Equal(t, len(nonce), 32)
+
+	// The signature covers the escaped path and the query, not the host.
+	canonical := CanonicalString(http.MethodPost, "/receipts/process?source=pos&lane=2", signedAt.Unix(), nonce, []byte(`{"retailer":"Target"}`))
+	assert.Equal(t, Valid(secret, canonical, r.Header.Get(HeaderSignature)), true)
+
+	// The body can still be sent, and sent again on a redirect.
+	body, err := io.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), `{"retailer":"Target"}`)
+
+	rc, err := r.GetBody()
+	assert.NoError(t, err)
+	body, err = io.ReadAll(rc)
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), `{"retailer":"Target"}`)
+}
+
+func TestSignEscapedPath(t *testing.T) {
+	r, err := http.NewRequest(http.MethodDelete, "https://api.example.com/receipts/a%2Fb", nil)
+	assert.NoError(t, err)
+	assert.NoError(t, Sign(r, "partner-1", secret))
+
+	ts, err := strconv.ParseInt(r.Header.Get(HeaderTimestamp), 10, 64)
+	assert.NoError(t, err)
+
+	canonical := CanonicalString(http.MethodDelete, "/receipts/a%2Fb", ts, r.Header.Get(HeaderNonce), nil)
+	assert.Equal(t, Valid(secret, canonical, r.Header.Get(HeaderSignature)), true)
+}
+
+func TestSignUniqueNonces(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for range 100 {
+		r, err := http.NewRequest(http.MethodPost, "https://api.example.com/receipts/process", nil)
+		assert.NoError(t, err)
+		assert.NoError(t, Sign(r, "partner-1", secret))
+
+		nonce := r.Header.Get(HeaderNonce)
+		if seen[nonce] {
+			t.Fatalf("nonce %s used twice", nonce)
+		}
+		seen[nonce] = true
+	}
+}